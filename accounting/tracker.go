@@ -0,0 +1,261 @@
+package accounting
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/atomicfile"
+	"github.com/loseleaf/modelscope-balancer/keymanager"
+)
+
+// dayFormat is the layout of the day labels records are aggregated by
+const dayFormat = "2006-01-02"
+
+// retentionDays is how many days of usage records are kept
+const retentionDays = 90
+
+// Tokens is the token usage an upstream reports for a completion
+type Tokens struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+// Record aggregates the requests and tokens of one key, model and client on one day
+type Record struct {
+	Day    string `json:"day,omitempty"`    // Start date of the daily window, e.g. 2025-01-31
+	Key    string `json:"key,omitempty"`    // Fingerprint of the upstream API key the requests were made with
+	Model  string `json:"model,omitempty"`  // Upstream model that answered
+	Client string `json:"client,omitempty"` // Virtual client ID, empty for the shared API token
+	Tokens
+	Requests int64 `json:"requests"`
+}
+
+// recordKey identifies the record a request is aggregated into
+type recordKey struct {
+	day, key, model, client string
+}
+
+// Tracker aggregates token usage per key, model, client and day and persists it to a JSON file
+type Tracker struct {
+	mu          sync.Mutex
+	records     map[recordKey]*Record
+	path        string
+	windowStart func(time.Time) time.Time // Start of the daily window containing a time
+	logger      *slog.Logger
+	dirty       atomic.Bool // Set when records changed since the last save
+}
+
+// NewTracker creates an empty tracker persisted at path. windowStart defines the
+// daily window requests are aggregated by.
+func NewTracker(path string, windowStart func(time.Time) time.Time, logger *slog.Logger) *Tracker {
+	return &Tracker{
+		records:     make(map[recordKey]*Record),
+		path:        path,
+		windowStart: windowStart,
+		logger:      logger,
+	}
+}
+
+// Load reads the usage records from the tracker file. A missing file leaves the tracker empty.
+func (t *Tracker) Load() error {
+	data, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		t.logger.Info("Usage file does not exist, starting with empty usage", "path", t.path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var loaded []*Record
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("failed to parse usage file %s: %w", t.path, err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.records = make(map[recordKey]*Record, len(loaded))
+	for _, rec := range loaded {
+		// Files written before keys had fingerprints hold raw key values
+		if !isFingerprint(rec.Key) {
+			rec.Key = keymanager.Fingerprint(rec.Key)
+			t.dirty.Store(true)
+		}
+
+		k := recordKey{rec.Day, rec.Key, rec.Model, rec.Client}
+		if existing := t.records[k]; existing != nil {
+			existing.Requests += rec.Requests
+			existing.PromptTokens += rec.PromptTokens
+			existing.CompletionTokens += rec.CompletionTokens
+			existing.TotalTokens += rec.TotalTokens
+			continue
+		}
+		t.records[k] = rec
+	}
+
+	t.logger.Info("Usage records loaded", "path", t.path, "count", len(loaded))
+	return nil
+}
+
+// Save drops records older than the retention period and writes the rest to the tracker file
+func (t *Tracker) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.dirty.Store(false)
+
+	cutoff := t.windowStart(time.Now()).AddDate(0, 0, -retentionDays).Format(dayFormat)
+	records := make([]*Record, 0, len(t.records))
+	for k, rec := range t.records {
+		if rec.Day < cutoff {
+			delete(t.records, k)
+			continue
+		}
+		records = append(records, rec)
+	}
+	sortRecords(records)
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		t.dirty.Store(true)
+		return err
+	}
+	if err := atomicfile.Write(t.path, data, 0644); err != nil {
+		t.dirty.Store(true)
+		t.logger.Error("Failed to write usage file", "path", t.path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// SaveIfDirty saves the records only when they changed since the last save
+func (t *Tracker) SaveIfDirty() error {
+	if !t.dirty.Load() {
+		return nil
+	}
+	return t.Save()
+}
+
+// Record adds one successful request to today's record of its key fingerprint,
+// model and client. tokens is nil when the upstream did not report usage.
+func (t *Tracker) Record(key, model, client string, tokens *Tokens) {
+	day := t.windowStart(time.Now()).Format(dayFormat)
+	k := recordKey{day, key, model, client}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rec := t.records[k]
+	if rec == nil {
+		rec = &Record{Day: day, Key: key, Model: model, Client: client}
+		t.records[k] = rec
+	}
+	rec.Requests++
+	if tokens != nil {
+		rec.PromptTokens += tokens.PromptTokens
+		rec.CompletionTokens += tokens.CompletionTokens
+		rec.TotalTokens += tokens.TotalTokens
+	}
+	t.dirty.Store(true)
+}
+
+// Query selects usage records and sums them per group
+type Query struct {
+	From, To string // Inclusive day range, empty for unbounded
+	Key      string // Only this key, empty for all
+	Model    string // Only this model, empty for all
+	Client   string // Only this client, empty for all
+	// Dimensions to group by: "day", "key", "model" and/or "client".
+	// Dimensions not grouped by are left empty in the results.
+	GroupBy []string
+}
+
+// Query returns the aggregated records matching q, sorted by their grouped dimensions
+func (t *Tracker) Query(q Query) ([]*Record, error) {
+	group := make(map[string]bool, len(q.GroupBy))
+	for _, dim := range q.GroupBy {
+		switch dim {
+		case "day", "key", "model", "client":
+			group[dim] = true
+		default:
+			return nil, fmt.Errorf("unknown group_by dimension %q", dim)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sums := make(map[recordKey]*Record)
+	for _, rec := range t.records {
+		if (q.From != "" && rec.Day < q.From) || (q.To != "" && rec.Day > q.To) ||
+			(q.Key != "" && rec.Key != q.Key) || (q.Model != "" && rec.Model != q.Model) ||
+			(q.Client != "" && rec.Client != q.Client) {
+			continue
+		}
+
+		var k recordKey
+		if group["day"] {
+			k.day = rec.Day
+		}
+		if group["key"] {
+			k.key = rec.Key
+		}
+		if group["model"] {
+			k.model = rec.Model
+		}
+		if group["client"] {
+			k.client = rec.Client
+		}
+
+		sum := sums[k]
+		if sum == nil {
+			sum = &Record{Day: k.day, Key: k.key, Model: k.model, Client: k.client}
+			sums[k] = sum
+		}
+		sum.Requests += rec.Requests
+		sum.PromptTokens += rec.PromptTokens
+		sum.CompletionTokens += rec.CompletionTokens
+		sum.TotalTokens += rec.TotalTokens
+	}
+
+	results := make([]*Record, 0, len(sums))
+	for _, sum := range sums {
+		results = append(results, sum)
+	}
+	sortRecords(results)
+	return results, nil
+}
+
+// isFingerprint reports whether a record key is a key fingerprint rather than a raw key value
+func isFingerprint(key string) bool {
+	if len(key) != len(keymanager.Fingerprint("")) {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// sortRecords orders records by day, key, model and client
+func sortRecords(records []*Record) {
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.Client < b.Client
+	})
+}
@@ -0,0 +1,498 @@
+package batch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/atomicfile"
+	"github.com/loseleaf/modelscope-balancer/clients"
+	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/keymanager"
+	"github.com/loseleaf/modelscope-balancer/proxy"
+)
+
+// Batch statuses, as in the OpenAI Batch API
+const (
+	StatusValidating = "validating"
+	StatusFailed     = "failed"
+	StatusInProgress = "in_progress"
+	StatusFinalizing = "finalizing"
+	StatusCompleted  = "completed"
+	StatusExpired    = "expired"
+	StatusCancelling = "cancelling"
+	StatusCancelled  = "cancelled"
+)
+
+// File purposes
+const (
+	PurposeBatch       = "batch"        // Uploaded batch input
+	PurposeBatchOutput = "batch_output" // Results and errors of a batch
+)
+
+// File is an uploaded batch input or a result file of a batch
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+}
+
+// Batch is a job running the requests of an input file
+type Batch struct {
+	ID               string            `json:"id"`
+	Object           string            `json:"object"`
+	Endpoint         string            `json:"endpoint"`
+	Errors           *Errors           `json:"errors"` // Why the input file was rejected
+	InputFileID      string            `json:"input_file_id"`
+	CompletionWindow string            `json:"completion_window"`
+	Status           string            `json:"status"`
+	OutputFileID     *string           `json:"output_file_id"`
+	ErrorFileID      *string           `json:"error_file_id"`
+	CreatedAt        int64             `json:"created_at"`
+	InProgressAt     *int64            `json:"in_progress_at"`
+	ExpiresAt        *int64            `json:"expires_at"`
+	FinalizingAt     *int64            `json:"finalizing_at"`
+	CompletedAt      *int64            `json:"completed_at"`
+	FailedAt         *int64            `json:"failed_at"`
+	ExpiredAt        *int64            `json:"expired_at"`
+	CancellingAt     *int64            `json:"cancelling_at"`
+	CancelledAt      *int64            `json:"cancelled_at"`
+	RequestCounts    RequestCounts     `json:"request_counts"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// RequestCounts reports the progress of a batch
+type RequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// Errors lists the problems found while validating an input file
+type Errors struct {
+	Object string  `json:"object"`
+	Data   []Error `json:"data"`
+}
+
+// Error is a problem of one line of an input file
+type Error struct {
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	Param   *string `json:"param"`
+	Line    *int    `json:"line"`
+}
+
+// fileRecord is a file together with the client that owns it
+type fileRecord struct {
+	File
+	Client string `json:"client,omitempty"` // Virtual client ID, empty for the shared API token
+}
+
+// batchRecord is a batch together with the client that created it, whose
+// limits and allowed models apply to its requests
+type batchRecord struct {
+	Batch
+	Client string `json:"client,omitempty"`
+}
+
+// state is the content of the state file
+type state struct {
+	Files   []*fileRecord  `json:"files"`
+	Batches []*batchRecord `json:"batches"`
+}
+
+// errStopped cancels the running batch when the balancer shuts down; it resumes after a restart
+var errStopped = errors.New("batch runner stopped")
+
+// errCancelled cancels the running batch when a client cancels it
+var errCancelled = errors.New("batch cancelled")
+
+// Manager stores batch files and runs batches one after another. The requests
+// of the running batch are served concurrently by a pool of workers through
+// the balancer's API handler, so they are balanced across the keys, count
+// against the key quotas and the limits of the client that created the batch.
+type Manager struct {
+	mu      sync.Mutex
+	files   map[string]*fileRecord
+	batches map[string]*batchRecord
+	dir     string
+
+	workers       int // Fixed worker count, 0 for one per usable key
+	maxFileBytes  int64
+	maxRequests   int
+	maxAttempts   int
+	retryInterval time.Duration
+
+	handler   http.Handler // Serves the requests of batches
+	endpoints []string     // API paths batches may be created for, as mounted for the handler
+	clients   *clients.Store
+	keys      *keymanager.KeyManager
+	router    *proxy.Router // Tells which key pools serve the model of a request
+	logger    *slog.Logger
+
+	running   string                  // ID of the running batch, empty when idle
+	cancelRun context.CancelCauseFunc // Stops handing out the requests of the running batch
+	requests  context.Context         // Context of all batch requests, cancelled when a stop times out
+	abort     context.CancelFunc
+	wake      chan struct{} // Signals the runner that a batch was created
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// Open creates the manager described by the settings and loads the stored files
+// and batches. Batch requests are served by handler and may only be sent to
+// endpoints, the POST paths mounted for it; router tells which key pools serve
+// them. Batches that were running when the balancer stopped resume once
+// Start is called.
+func Open(cfg config.BatchSettings, handler http.Handler, endpoints []string, router *proxy.Router, clientStore *clients.Store, km *keymanager.KeyManager, logger *slog.Logger) (*Manager, error) {
+	retryInterval, err := time.ParseDuration(cfg.RetryInterval)
+	if err != nil || retryInterval <= 0 {
+		return nil, fmt.Errorf("invalid batch.retry_interval %q", cfg.RetryInterval)
+	}
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("batch.dir must be set")
+	}
+	if cfg.Workers < 0 || cfg.MaxFileMB <= 0 || cfg.MaxRequests <= 0 || cfg.MaxAttempts <= 0 {
+		return nil, fmt.Errorf("batch.workers must not be negative and max_file_mb, max_requests and max_attempts must be positive")
+	}
+
+	// Files hold prompts and answers, so keep them private
+	for _, dir := range []string{cfg.Dir, filepath.Join(cfg.Dir, "files"), filepath.Join(cfg.Dir, "jobs")} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create batch directory: %w", err)
+		}
+	}
+
+	requests, abort := context.WithCancel(context.Background())
+	m := &Manager{
+		files:         make(map[string]*fileRecord),
+		batches:       make(map[string]*batchRecord),
+		dir:           cfg.Dir,
+		workers:       cfg.Workers,
+		maxFileBytes:  int64(cfg.MaxFileMB) << 20,
+		maxRequests:   cfg.MaxRequests,
+		maxAttempts:   cfg.MaxAttempts,
+		retryInterval: retryInterval,
+		handler:       handler,
+		endpoints:     endpoints,
+		clients:       clientStore,
+		keys:          km,
+		router:        router,
+		logger:        logger,
+		requests:      requests,
+		abort:         abort,
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if err := m.load(); err != nil {
+		abort()
+		return nil, err
+	}
+	return m, nil
+}
+
+// load reads the state file. A missing file leaves the manager empty.
+func (m *Manager) load() error {
+	path := m.statePath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var loaded state
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("failed to parse batch state %s: %w", path, err)
+	}
+	for _, f := range loaded.Files {
+		m.files[f.ID] = f
+	}
+	for _, b := range loaded.Batches {
+		m.batches[b.ID] = b
+	}
+	m.logger.Info("Batches loaded", "path", path, "files", len(m.files), "batches", len(m.batches))
+	return nil
+}
+
+// saveLocked writes the state file. The caller must hold the lock.
+func (m *Manager) saveLocked() error {
+	var s state
+	for _, f := range m.files {
+		s.Files = append(s.Files, f)
+	}
+	for _, b := range m.batches {
+		s.Batches = append(s.Batches, b)
+	}
+	sort.Slice(s.Files, func(i, j int) bool { return s.Files[i].CreatedAt < s.Files[j].CreatedAt })
+	sort.Slice(s.Batches, func(i, j int) bool { return s.Batches[i].CreatedAt < s.Batches[j].CreatedAt })
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.Write(m.statePath(), data, 0600); err != nil {
+		m.logger.Error("Failed to write batch state", "path", m.statePath(), "error", err)
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) statePath() string {
+	return filepath.Join(m.dir, "batches.json")
+}
+
+// filePath returns where the content of a file is kept
+func (m *Manager) filePath(id string) string {
+	return filepath.Join(m.dir, "files", id+".jsonl")
+}
+
+// jobPath returns where the results or errors of a batch are collected while it runs
+func (m *Manager) jobPath(id, kind string) string {
+	return filepath.Join(m.dir, "jobs", id+"."+kind+".jsonl")
+}
+
+// createFile stores an uploaded file whose content was written to the temporary file tmp
+func (m *Manager) createFile(tmp, filename, purpose, client string, size int64) (File, error) {
+	f := &fileRecord{
+		File: File{
+			ID:        newID("file-"),
+			Object:    "file",
+			Bytes:     size,
+			CreatedAt: time.Now().Unix(),
+			Filename:  filename,
+			Purpose:   purpose,
+		},
+		Client: client,
+	}
+	if err := os.Rename(tmp, m.filePath(f.ID)); err != nil {
+		return File{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[f.ID] = f
+	if err := m.saveLocked(); err != nil {
+		delete(m.files, f.ID)
+		os.Remove(m.filePath(f.ID))
+		return File{}, err
+	}
+	return f.File, nil
+}
+
+// file returns a file owned by client
+func (m *Manager) file(id, client string) (File, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[id]
+	if !ok || f.Client != client {
+		return File{}, false
+	}
+	return f.File, true
+}
+
+// listFiles returns the files owned by client, newest first, optionally of one purpose only
+func (m *Manager) listFiles(client, purpose string) []File {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]File, 0)
+	for _, f := range m.files {
+		if f.Client == client && (purpose == "" || f.Purpose == purpose) {
+			list = append(list, f.File)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt > list[j].CreatedAt
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list
+}
+
+// deleteFile removes a file owned by client. The input of a batch that has not
+// finished cannot be deleted.
+func (m *Manager) deleteFile(id, client string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[id]
+	if !ok || f.Client != client {
+		return false, nil
+	}
+	for _, b := range m.batches {
+		if b.InputFileID == id && !finished(b.Status) {
+			return true, fmt.Errorf("file %s is the input of batch %s, which has not finished", id, b.ID)
+		}
+	}
+
+	delete(m.files, id)
+	if err := os.Remove(m.filePath(id)); err != nil && !os.IsNotExist(err) {
+		m.logger.Warn("Failed to remove batch file", "file", id, "error", err)
+	}
+	return true, m.saveLocked()
+}
+
+// createBatch creates a batch for an input file owned by client and queues it
+func (m *Manager) createBatch(inputFileID, endpoint, window string, metadata map[string]string, client string) (Batch, error) {
+	if !slices.Contains(m.endpoints, endpoint) {
+		return Batch{}, fmt.Errorf("endpoint must be one of %s", strings.Join(m.endpoints, ", "))
+	}
+	if window == "" {
+		window = "24h"
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return Batch{}, fmt.Errorf("completion_window must be a duration such as 24h")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[inputFileID]
+	if !ok || f.Client != client {
+		return Batch{}, errFileNotFound(inputFileID)
+	}
+	if f.Purpose != PurposeBatch {
+		return Batch{}, fmt.Errorf("file %s was not uploaded with purpose batch", inputFileID)
+	}
+
+	now := time.Now()
+	expires := now.Add(d).Unix()
+	b := &batchRecord{
+		Batch: Batch{
+			ID:               newID("batch_"),
+			Object:           "batch",
+			Endpoint:         endpoint,
+			InputFileID:      inputFileID,
+			CompletionWindow: window,
+			Status:           StatusValidating,
+			CreatedAt:        now.Unix(),
+			ExpiresAt:        &expires,
+			Metadata:         metadata,
+		},
+		Client: client,
+	}
+	m.batches[b.ID] = b
+	if err := m.saveLocked(); err != nil {
+		delete(m.batches, b.ID)
+		return Batch{}, err
+	}
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	m.logger.Info("Batch created", "batch", b.ID, "input_file", inputFileID, "endpoint", endpoint)
+	return b.Batch, nil
+}
+
+// batch returns a batch created by client
+func (m *Manager) batch(id, client string) (Batch, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.batches[id]
+	if !ok || b.Client != client {
+		return Batch{}, false
+	}
+	return b.Batch, true
+}
+
+// listBatches returns the batches created by client, newest first
+func (m *Manager) listBatches(client string) []Batch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Batch, 0)
+	for _, b := range m.batches {
+		if b.Client == client {
+			list = append(list, b.Batch)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt > list[j].CreatedAt
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list
+}
+
+// cancelBatch cancels a batch created by client. A running batch stops handing
+// out requests and is finalized once its requests in flight finished; a queued
+// batch is finalized right away. Results collected so far stay available.
+func (m *Manager) cancelBatch(id, client string) (Batch, error) {
+	m.mu.Lock()
+	b, ok := m.batches[id]
+	if !ok || b.Client != client {
+		m.mu.Unlock()
+		return Batch{}, errBatchNotFound(id)
+	}
+	switch b.Status {
+	case StatusValidating, StatusInProgress:
+	case StatusCancelling:
+		m.mu.Unlock()
+		return b.Batch, nil
+	default:
+		m.mu.Unlock()
+		return Batch{}, fmt.Errorf("cannot cancel a batch with status '%s'", b.Status)
+	}
+
+	b.Status = StatusCancelling
+	b.CancellingAt = timestamp()
+	m.saveLocked()
+	m.logger.Info("Batch cancelling", "batch", id)
+	if m.running == id {
+		m.cancelRun(errCancelled)
+		snapshot := b.Batch
+		m.mu.Unlock()
+		return snapshot, nil
+	}
+	m.mu.Unlock()
+
+	m.finalize(b, StatusCancelled)
+	return m.snapshot(b), nil
+}
+
+// snapshot returns a copy of a batch that is safe to hand out without the lock
+func (m *Manager) snapshot(b *batchRecord) Batch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return b.Batch
+}
+
+// finished reports whether a batch status is final
+func finished(status string) bool {
+	switch status {
+	case StatusFailed, StatusCompleted, StatusExpired, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// timestamp returns the current Unix time for the timestamps of a batch
+func timestamp() *int64 {
+	now := time.Now().Unix()
+	return &now
+}
+
+// newID returns a random ID with the given prefix
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
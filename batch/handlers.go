@@ -0,0 +1,282 @@
+package batch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/loseleaf/modelscope-balancer/clients"
+)
+
+// notFoundError reports a file or batch that does not exist or belongs to another client
+type notFoundError struct {
+	message string
+}
+
+func (e *notFoundError) Error() string {
+	return e.message
+}
+
+func errFileNotFound(id string) error {
+	return &notFoundError{message: fmt.Sprintf("No such File object: %s", id)}
+}
+
+func errBatchNotFound(id string) error {
+	return &notFoundError{message: fmt.Sprintf("No batch found with id '%s'.", id)}
+}
+
+// HandleUploadFile handles POST /v1/files requests, which upload a batch input
+// file as the multipart fields file and purpose
+func (m *Manager) HandleUploadFile(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "The request must be a multipart/form-data upload with a file and a purpose")
+		return
+	}
+
+	var purpose, filename, tmp string
+	var size int64
+	defer func() {
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+	}()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "The multipart body cannot be read")
+			return
+		}
+
+		switch part.FormName() {
+		case "purpose":
+			value, _ := io.ReadAll(io.LimitReader(part, 64))
+			purpose = strings.TrimSpace(string(value))
+		case "file":
+			if tmp != "" {
+				writeError(w, http.StatusBadRequest, "Only one file can be uploaded at a time")
+				return
+			}
+			filename = filepath.Base(part.FileName())
+			f, err := os.CreateTemp(filepath.Join(m.dir, "files"), "upload-*")
+			if err != nil {
+				m.logger.Error("Failed to create batch upload", "error", err)
+				writeError(w, http.StatusInternalServerError, "Failed to store the file")
+				return
+			}
+			tmp = f.Name()
+			size, err = io.Copy(f, io.LimitReader(part, m.maxFileBytes+1))
+			f.Close()
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "The uploaded file cannot be read")
+				return
+			}
+			if size > m.maxFileBytes {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Files may be at most %d MB", m.maxFileBytes>>20))
+				return
+			}
+		}
+		part.Close()
+	}
+
+	if tmp == "" {
+		writeError(w, http.StatusBadRequest, "The file field is required")
+		return
+	}
+	if purpose != PurposeBatch {
+		writeError(w, http.StatusBadRequest, "Only files with purpose 'batch' can be uploaded")
+		return
+	}
+
+	file, err := m.createFile(tmp, filename, purpose, owner(r), size)
+	if err != nil {
+		m.logger.Error("Failed to store batch file", "error", err)
+		writeError(w, http.StatusInternalServerError, "Failed to store the file")
+		return
+	}
+	tmp = ""
+	writeJSON(w, http.StatusOK, file)
+}
+
+// HandleListFiles handles GET /v1/files requests, optionally filtered by the purpose query parameter
+func (m *Manager) HandleListFiles(w http.ResponseWriter, r *http.Request) {
+	files := m.listFiles(owner(r), r.URL.Query().Get("purpose"))
+	writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": files, "has_more": false})
+}
+
+// HandleGetFile handles GET /v1/files/{id} requests
+func (m *Manager) HandleGetFile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	file, ok := m.file(id, owner(r))
+	if !ok {
+		writeNotFound(w, errFileNotFound(id))
+		return
+	}
+	writeJSON(w, http.StatusOK, file)
+}
+
+// HandleFileContent handles GET /v1/files/{id}/content requests, downloading an
+// input file or the JSONL results of a batch
+func (m *Manager) HandleFileContent(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	file, ok := m.file(id, owner(r))
+	if !ok {
+		writeNotFound(w, errFileNotFound(id))
+		return
+	}
+	f, err := os.Open(m.filePath(id))
+	if err != nil {
+		m.logger.Error("Failed to open batch file", "file", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "Failed to read the file")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.Filename))
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Bytes, 10))
+	io.Copy(w, f)
+}
+
+// HandleDeleteFile handles DELETE /v1/files/{id} requests
+func (m *Manager) HandleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	found, err := m.deleteFile(id, owner(r))
+	if !found {
+		writeNotFound(w, errFileNotFound(id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "object": "file", "deleted": true})
+}
+
+// HandleCreateBatch handles POST /v1/batches requests
+func (m *Manager) HandleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		InputFileID      string            `json:"input_file_id"`
+		Endpoint         string            `json:"endpoint"`
+		CompletionWindow string            `json:"completion_window"`
+		Metadata         map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Request body is not valid JSON")
+		return
+	}
+	if req.InputFileID == "" || req.Endpoint == "" {
+		writeError(w, http.StatusBadRequest, "input_file_id and endpoint are required")
+		return
+	}
+
+	b, err := m.createBatch(req.InputFileID, req.Endpoint, req.CompletionWindow, req.Metadata, owner(r))
+	var notFound *notFoundError
+	switch {
+	case errors.As(err, &notFound):
+		writeNotFound(w, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, b)
+	}
+}
+
+// HandleListBatches handles GET /v1/batches requests, newest first. Pages are
+// selected with the limit (default 20, at most 100) and after query parameters.
+func (m *Manager) HandleListBatches(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 100 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+
+	list := m.listBatches(owner(r))
+	if after := r.URL.Query().Get("after"); after != "" {
+		for i, b := range list {
+			if b.ID == after {
+				list = list[i+1:]
+				break
+			}
+		}
+	}
+	hasMore := len(list) > limit
+	if hasMore {
+		list = list[:limit]
+	}
+
+	page := map[string]any{"object": "list", "data": list, "first_id": nil, "last_id": nil, "has_more": hasMore}
+	if len(list) > 0 {
+		page["first_id"] = list[0].ID
+		page["last_id"] = list[len(list)-1].ID
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// HandleGetBatch handles GET /v1/batches/{id} requests, reporting the status and progress of a batch
+func (m *Manager) HandleGetBatch(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	b, ok := m.batch(id, owner(r))
+	if !ok {
+		writeNotFound(w, errBatchNotFound(id))
+		return
+	}
+	writeJSON(w, http.StatusOK, b)
+}
+
+// HandleCancelBatch handles POST /v1/batches/{id}/cancel requests
+func (m *Manager) HandleCancelBatch(w http.ResponseWriter, r *http.Request) {
+	b, err := m.cancelBatch(chi.URLParam(r, "id"), owner(r))
+	var notFound *notFoundError
+	switch {
+	case errors.As(err, &notFound):
+		writeNotFound(w, err)
+	case err != nil:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, b)
+	}
+}
+
+// owner returns the ID of the virtual client of a request, empty for the shared API token
+func owner(r *http.Request) string {
+	if client := clients.FromContext(r.Context()); client != nil {
+		return client.ID
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers a rejected request with an OpenAI-style error body
+func writeError(w http.ResponseWriter, status int, message string) {
+	errType := "invalid_request_error"
+	if status >= 500 {
+		errType = "server_error"
+	}
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{"message": message, "type": errType, "param": nil, "code": nil},
+	})
+}
+
+func writeNotFound(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusNotFound, err.Error())
+}
@@ -0,0 +1,641 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/clients"
+	"github.com/loseleaf/modelscope-balancer/keymanager"
+)
+
+// maxValidationErrors caps the errors reported for a rejected input file
+const maxValidationErrors = 100
+
+// request is one line of an input file
+type request struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// resultLine is one line of the output or error file of a batch
+type resultLine struct {
+	ID       string          `json:"id"`
+	CustomID string          `json:"custom_id"`
+	Response *resultResponse `json:"response"`
+	Error    *resultError    `json:"error"`
+}
+
+type resultResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type resultError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Start starts running the queued batches in the background. Batches whose
+// cancellation was interrupted by a restart are finalized first.
+func (m *Manager) Start() {
+	m.mu.Lock()
+	var cancelling []*batchRecord
+	for _, b := range m.batches {
+		if b.Status == StatusCancelling {
+			cancelling = append(cancelling, b)
+		}
+	}
+	m.mu.Unlock()
+	for _, b := range cancelling {
+		m.finalize(b, StatusCancelled)
+	}
+
+	go m.run()
+}
+
+// Stop stops handing out batch requests and waits for the requests in flight.
+// Those still running when ctx is done are aborted. The running batch resumes
+// with its remaining requests after a restart.
+func (m *Manager) Stop(ctx context.Context) {
+	close(m.stop)
+	m.mu.Lock()
+	if m.cancelRun != nil {
+		m.cancelRun(errStopped)
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		m.abort()
+		<-m.done
+	}
+	m.abort()
+}
+
+// run processes the queued batches one after another
+func (m *Manager) run() {
+	defer close(m.done)
+	for {
+		b, ctx := m.next()
+		if b == nil {
+			select {
+			case <-m.wake:
+				continue
+			case <-m.stop:
+				return
+			}
+		}
+		m.process(ctx, b)
+		m.mu.Lock()
+		m.running, m.cancelRun = "", nil
+		m.mu.Unlock()
+
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+	}
+}
+
+// next picks the oldest batch that has not finished and marks it as running.
+// Its requests are handed out until the returned context is cancelled.
+func (m *Manager) next() (*batchRecord, context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.stop:
+		return nil, nil
+	default:
+	}
+
+	var queued []*batchRecord
+	for _, b := range m.batches {
+		switch b.Status {
+		case StatusValidating, StatusInProgress, StatusFinalizing:
+			queued = append(queued, b)
+		}
+	}
+	if len(queued) == 0 {
+		return nil, nil
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].CreatedAt != queued[j].CreatedAt {
+			return queued[i].CreatedAt < queued[j].CreatedAt
+		}
+		return queued[i].ID < queued[j].ID
+	})
+
+	b := queued[0]
+	ctx, cancel := context.WithCancelCause(context.Background())
+	m.running, m.cancelRun = b.ID, cancel
+	return b, ctx
+}
+
+// process runs the requests of a batch that were not answered yet and finalizes it
+func (m *Manager) process(ctx context.Context, b *batchRecord) {
+	requests, validationErrors, err := m.readRequests(b)
+	if err != nil {
+		validationErrors = []Error{{Code: "invalid_file", Message: err.Error()}}
+	}
+	if errors.Is(context.Cause(ctx), errCancelled) {
+		m.finalize(b, StatusCancelled)
+		return
+	}
+	if len(validationErrors) > 0 {
+		m.mu.Lock()
+		b.Status = StatusFailed
+		b.FailedAt = timestamp()
+		b.Errors = &Errors{Object: "list", Data: validationErrors}
+		m.saveLocked()
+		m.mu.Unlock()
+		m.logger.Warn("Batch input rejected", "batch", b.ID, "errors", len(validationErrors))
+		return
+	}
+
+	results, err := m.openResults(b)
+	if err != nil {
+		m.logger.Error("Failed to open batch results", "batch", b.ID, "error", err)
+		m.mu.Lock()
+		b.Status = StatusFailed
+		b.FailedAt = timestamp()
+		b.Errors = &Errors{Object: "list", Data: []Error{{Code: "internal_error", Message: "Failed to open the result files"}}}
+		m.saveLocked()
+		m.mu.Unlock()
+		return
+	}
+	defer results.close()
+
+	m.mu.Lock()
+	if b.Status == StatusValidating {
+		b.Status = StatusInProgress
+		b.InProgressAt = timestamp()
+	}
+	b.RequestCounts = RequestCounts{Total: len(requests), Completed: results.completed, Failed: results.failed}
+	m.saveLocked()
+	m.mu.Unlock()
+
+	var pending []*request
+	for _, req := range requests {
+		if !results.done[req.CustomID] {
+			pending = append(pending, req)
+		}
+	}
+	workers := m.workerCount()
+	m.logger.Info("Batch running", "batch", b.ID, "requests", len(requests), "pending", len(pending), "workers", workers)
+
+	// Requests are no longer handed out once the completion window closes
+	ctx, cancelDeadline := context.WithDeadline(ctx, time.Unix(*b.ExpiresAt, 0))
+	defer cancelDeadline()
+
+	queue := make(chan *request)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range queue {
+				m.serve(ctx, b, req, results)
+			}
+		}()
+	}
+feed:
+	for _, req := range pending {
+		select {
+		case queue <- req:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, errStopped):
+		m.logger.Info("Batch paused until restart", "batch", b.ID, "remaining", len(requests)-len(results.done))
+	case errors.Is(cause, errCancelled):
+		m.finalize(b, StatusCancelled)
+	case errors.Is(cause, context.DeadlineExceeded):
+		for _, req := range requests {
+			if !results.done[req.CustomID] {
+				results.write(b, req, nil, &resultError{Code: "batch_expired", Message: "This request could not be executed before the completion window expired."})
+			}
+		}
+		m.finalize(b, StatusExpired)
+	default:
+		m.finalize(b, StatusCompleted)
+	}
+}
+
+// workerCount returns how many requests of a batch run at once: the configured
+// count, or one per usable key
+func (m *Manager) workerCount() int {
+	if m.workers > 0 {
+		return m.workers
+	}
+	usable, _ := m.keyState(nil)
+	return max(usable, 1)
+}
+
+// keyState counts the keys of the given pools, or of every pool when pools is
+// nil, that can serve a request now: active keys and cooling keys whose
+// cooldown elapsed, as long as they have quota left. Keys that are not
+// disabled but cannot serve a request yet are counted as recovering, since they
+// will once their cooldown elapses or their quota resets.
+func (m *Manager) keyState(pools []string) (usable, recovering int) {
+	now := time.Now()
+	for _, key := range m.keys.ListKeys() {
+		if pools != nil && !slices.Contains(pools, key.Pool) {
+			continue
+		}
+		switch {
+		case key.Status == keymanager.StatusDisabled:
+		case (key.Status == keymanager.StatusActive ||
+			(key.Status == keymanager.StatusCooling && !now.Before(key.CooldownUntil))) &&
+			m.keys.RemainingQuota(key) != 0:
+			usable++
+		default:
+			recovering++
+		}
+	}
+	return usable, recovering
+}
+
+// awaitingKeys reports whether no key of the pools can serve a request now but
+// one will by itself later
+func (m *Manager) awaitingKeys(pools []string) bool {
+	usable, recovering := m.keyState(pools)
+	return usable == 0 && recovering > 0
+}
+
+// serve executes one request of a batch and records its result. While no key
+// of the pools the request routes to can serve it, because they are out of
+// quota, cooling down or rate limited, the request waits and is retried
+// without using up an attempt. Other server errors, including those of pools
+// without usable keys, are retried up to the configured number of attempts.
+func (m *Manager) serve(ctx context.Context, b *batchRecord, req *request, results *results) {
+	var fields struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(req.Body, &fields)
+	pools := m.router.Pools(fields.Model)
+	if pools == nil {
+		// The model has no route; the request fails right away
+		pools = []string{}
+	}
+
+	for attempt := 1; ; {
+		for m.awaitingKeys(pools) {
+			if !sleep(ctx, m.retryInterval) {
+				return
+			}
+		}
+
+		var client *clients.Client
+		if b.Client != "" {
+			var ok bool
+			if client, ok = m.clients.Get(b.Client); !ok {
+				results.write(b, req, nil, &resultError{Code: "invalid_api_key", Message: "The API key that created this batch was deleted."})
+				return
+			}
+		}
+
+		status, header, body := m.execute(client, req)
+		if m.requests.Err() != nil {
+			// Aborted by a shutdown, the request runs again after the restart
+			return
+		}
+
+		switch {
+		case status == http.StatusTooManyRequests:
+		case status >= 500 && m.awaitingKeys(pools):
+			// Every key failed and is cooling down now
+		case status >= 500 && attempt < m.maxAttempts:
+			attempt++
+		default:
+			results.write(b, req, &resultResponse{StatusCode: status, RequestID: header.Get("X-Request-Id"), Body: responseBody(body)}, nil)
+			return
+		}
+
+		wait := m.retryInterval
+		if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		if !sleep(ctx, wait) {
+			return
+		}
+	}
+}
+
+// sleep waits for d and reports false when ctx ends first. Requests left
+// waiting are expired or run again after a restart.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// execute serves a request through the balancer's API handler on behalf of the
+// client that created the batch
+func (m *Manager) execute(client *clients.Client, req *request) (int, http.Header, []byte) {
+	ctx := m.requests
+	if client != nil {
+		ctx = clients.NewContext(ctx, client)
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, req.URL, bytes.NewReader(req.Body))
+	if err != nil {
+		return http.StatusBadRequest, http.Header{}, []byte(err.Error())
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = "batch"
+
+	rec := &responseBuffer{header: make(http.Header)}
+	m.handler.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.status, rec.header, rec.body.Bytes()
+}
+
+// responseBody returns a response body as JSON, wrapping plain-text errors in an error object
+func responseBody(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	wrapped, _ := json.Marshal(map[string]any{"error": map[string]string{"message": string(bytes.TrimSpace(body))}})
+	return wrapped
+}
+
+// responseBuffer collects the answer of a batch request
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+func (rb *responseBuffer) WriteHeader(status int) {
+	if rb.status == 0 {
+		rb.status = status
+	}
+}
+
+func (rb *responseBuffer) Write(p []byte) (int, error) {
+	if rb.status == 0 {
+		rb.status = http.StatusOK
+	}
+	return rb.body.Write(p)
+}
+
+// readRequests parses and validates the input file of a batch
+func (m *Manager) readRequests(b *batchRecord) ([]*request, []Error, error) {
+	f, err := os.Open(m.filePath(b.InputFileID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("the input file %s cannot be read", b.InputFileID)
+	}
+	defer f.Close()
+
+	var requests []*request
+	var problems []Error
+	reject := func(line int, code, message string) {
+		if len(problems) < maxValidationErrors {
+			problems = append(problems, Error{Code: code, Message: message, Line: &line})
+		}
+	}
+
+	seen := make(map[string]bool)
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("the input file %s cannot be read", b.InputFileID)
+		}
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 {
+			var req request
+			var body struct {
+				Stream bool `json:"stream"`
+			}
+			switch {
+			case json.Unmarshal(trimmed, &req) != nil:
+				reject(line, "invalid_json", "This line is not valid JSON.")
+			case req.CustomID == "":
+				reject(line, "missing_required_parameter", "The custom_id parameter is required.")
+			case seen[req.CustomID]:
+				reject(line, "duplicate_custom_id", fmt.Sprintf("The custom_id '%s' is used by more than one request.", req.CustomID))
+			case req.Method != http.MethodPost:
+				reject(line, "invalid_method", "Batch requests must use the POST method.")
+			case req.URL != b.Endpoint:
+				reject(line, "mismatched_endpoint", fmt.Sprintf("The url '%s' does not match the endpoint of the batch, %s.", req.URL, b.Endpoint))
+			case json.Unmarshal(req.Body, &body) != nil:
+				reject(line, "invalid_body", "The body must be a JSON object.")
+			case body.Stream:
+				reject(line, "invalid_body", "Streaming is not supported in batches.")
+			}
+			seen[req.CustomID] = true
+			requests = append(requests, &req)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	switch {
+	case len(requests) == 0:
+		problems = append(problems, Error{Code: "empty_file", Message: "The input file contains no requests."})
+	case len(requests) > m.maxRequests:
+		problems = append(problems, Error{Code: "too_many_requests", Message: fmt.Sprintf("A batch may contain at most %d requests.", m.maxRequests)})
+	}
+	return requests, problems, nil
+}
+
+// results collects the output and error lines of the running batch
+type results struct {
+	m                 *Manager
+	mu                sync.Mutex
+	output, errors    *os.File
+	done              map[string]bool // Custom IDs of the answered requests
+	completed, failed int
+}
+
+// openResults opens the result files of a batch for appending. Lines written
+// before a restart are kept and their requests are not run again.
+func (m *Manager) openResults(b *batchRecord) (*results, error) {
+	rs := &results{m: m, done: make(map[string]bool)}
+	var err error
+	if rs.output, rs.completed, err = rs.open(m.jobPath(b.ID, "output")); err != nil {
+		return nil, err
+	}
+	if rs.errors, rs.failed, err = rs.open(m.jobPath(b.ID, "errors")); err != nil {
+		rs.output.Close()
+		return nil, err
+	}
+	return rs, nil
+}
+
+// open opens a result file, drops a line that was cut off by a crash and
+// returns the number of complete lines
+func (rs *results) open(path string) (*os.File, int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete < len(data) {
+		if err := f.Truncate(int64(complete)); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	if _, err := f.Seek(int64(complete), io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	count := 0
+	for _, line := range bytes.Split(data[:complete], []byte("\n")) {
+		var result resultLine
+		if json.Unmarshal(line, &result) == nil && result.CustomID != "" {
+			rs.done[result.CustomID] = true
+			count++
+		}
+	}
+	return f, count, nil
+}
+
+// write records the result of a request. Successful answers go to the output
+// file, failed requests to the error file.
+func (rs *results) write(b *batchRecord, req *request, response *resultResponse, resultErr *resultError) {
+	line := resultLine{ID: newID("batch_req_"), CustomID: req.CustomID, Response: response, Error: resultErr}
+	if response != nil && response.RequestID == "" {
+		response.RequestID = line.ID
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	succeeded := response != nil && response.StatusCode < 300
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.done[req.CustomID] {
+		return
+	}
+	f := rs.errors
+	if succeeded {
+		f = rs.output
+	}
+	if _, err := f.Write(data); err != nil {
+		rs.m.logger.Error("Failed to write batch result", "batch", b.ID, "custom_id", req.CustomID, "error", err)
+		return
+	}
+	rs.done[req.CustomID] = true
+
+	rs.m.mu.Lock()
+	if succeeded {
+		b.RequestCounts.Completed++
+	} else {
+		b.RequestCounts.Failed++
+	}
+	rs.m.mu.Unlock()
+}
+
+func (rs *results) close() {
+	rs.output.Close()
+	rs.errors.Close()
+}
+
+// finalize publishes the collected results of a batch as files and gives it its final status
+func (m *Manager) finalize(b *batchRecord, status string) {
+	m.mu.Lock()
+	if status == StatusCompleted {
+		b.Status = StatusFinalizing
+		b.FinalizingAt = timestamp()
+		m.saveLocked()
+	}
+	m.mu.Unlock()
+
+	outputID := m.publish(b, "output")
+	errorID := m.publish(b, "errors")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b.OutputFileID, b.ErrorFileID = outputID, errorID
+	b.Status = status
+	switch status {
+	case StatusCompleted:
+		b.CompletedAt = timestamp()
+	case StatusExpired:
+		b.ExpiredAt = timestamp()
+	case StatusCancelled:
+		b.CancelledAt = timestamp()
+	}
+	m.saveLocked()
+	m.logger.Info("Batch finished", "batch", b.ID, "status", status,
+		"completed", b.RequestCounts.Completed, "failed", b.RequestCounts.Failed, "total", b.RequestCounts.Total)
+}
+
+// publish turns a result file of a batch into a file the client can download.
+// It returns nil when the batch has no such results.
+func (m *Manager) publish(b *batchRecord, kind string) *string {
+	path := m.jobPath(b.ID, kind)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if info.Size() == 0 {
+		os.Remove(path)
+		return nil
+	}
+
+	f := &fileRecord{
+		File: File{
+			ID:        newID("file-"),
+			Object:    "file",
+			Bytes:     info.Size(),
+			CreatedAt: time.Now().Unix(),
+			Filename:  b.ID + "_" + kind + ".jsonl",
+			Purpose:   PurposeBatchOutput,
+		},
+		Client: b.Client,
+	}
+	if err := os.Rename(path, m.filePath(f.ID)); err != nil {
+		m.logger.Error("Failed to publish batch results", "batch", b.ID, "error", err)
+		return nil
+	}
+
+	m.mu.Lock()
+	m.files[f.ID] = f
+	m.mu.Unlock()
+	return &f.ID
+}
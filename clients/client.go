@@ -0,0 +1,61 @@
+package clients
+
+import (
+	"context"
+	"time"
+)
+
+// Settings are the administrator-controlled properties of a client
+type Settings struct {
+	Name              string    `json:"name"`
+	Enabled           bool      `json:"enabled"`
+	AllowedModels     []string  `json:"allowed_models"`      // Model names or glob patterns, empty allows every model
+	RPM               int       `json:"rpm"`                 // Requests per minute, 0 for unlimited
+	DailyRequestLimit int64     `json:"daily_request_limit"` // Requests per quota window, 0 for unlimited
+	DailyTokenLimit   int64     `json:"daily_token_limit"`   // Tokens per quota window, 0 for unlimited
+	ExpiresAt         time.Time `json:"expires_at"`          // Zero for a token that never expires
+}
+
+// Client is a downstream consumer of the /v1 API authenticated by its own virtual key
+type Client struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"` // Bearer token the client authenticates with
+	CreatedAt time.Time `json:"created_at"`
+	Settings
+
+	// Daily usage, sharing the reset time of the key quota window
+	RequestCount     int64     `json:"request_count"`      // Requests admitted in the current window
+	TokenCount       int64     `json:"token_count"`        // Tokens used in the current window
+	UsageWindowStart time.Time `json:"usage_window_start"` // Start of the window the counters belong to
+	LastUsedAt       time.Time `json:"last_used_at"`
+
+	recent []time.Time // Admission times within the last minute, for the RPM limit
+}
+
+// Expired reports whether the client's token has expired at the given time
+func (c *Client) Expired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && !now.Before(c.ExpiresAt)
+}
+
+// snapshot returns a copy of the client that is safe to hand out without the lock
+func (c *Client) snapshot() *Client {
+	cp := *c
+	cp.AllowedModels = append([]string(nil), c.AllowedModels...)
+	cp.recent = nil
+	return &cp
+}
+
+// contextKey is the request context key of the authenticated client
+type contextKey struct{}
+
+// NewContext returns a context carrying the authenticated client
+func NewContext(ctx context.Context, c *Client) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the client that authenticated the request, or nil when the
+// request used the shared API token or authentication is disabled
+func FromContext(ctx context.Context) *Client {
+	c, _ := ctx.Value(contextKey{}).(*Client)
+	return c
+}
@@ -0,0 +1,107 @@
+package clients
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/loseleaf/modelscope-balancer/middleware"
+)
+
+// Middleware authenticates API requests. A bearer token, or an x-api-key or
+// x-goog-api-key header as sent by Anthropic and Gemini clients, matching a
+// client puts that client into the request context; the shared API token
+// managed by legacy is still accepted without a client. Authentication is
+// disabled only while the shared token is empty and no client exists.
+func (s *Store) Middleware(legacy *middleware.DynamicAuthenticator) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sharedToken := legacy.GetToken()
+			if sharedToken == "" && s.Count() == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, ok := requestToken(r)
+			if !ok {
+				WriteError(w, &LimitError{
+					Status:  http.StatusUnauthorized,
+					Code:    "invalid_api_key",
+					Message: "Authorization header format must be Bearer {token}",
+				})
+				return
+			}
+
+			if sharedToken != "" && token == sharedToken {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			client, err := s.Authenticate(token)
+			if err != nil {
+				WriteError(w, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), client)))
+		})
+	}
+}
+
+// requestToken returns the token a request authenticates with. The
+// Authorization header takes precedence over the API key headers.
+func requestToken(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return bearerToken(header)
+	}
+	for _, name := range []string{"X-Api-Key", "X-Goog-Api-Key"} {
+		if token := r.Header.Get(name); token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// bearerToken extracts the token of a "Bearer {token}" authorization header
+func bearerToken(header string) (string, bool) {
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// WriteError answers a rejected client request with an OpenAI-style error body.
+// Errors other than *LimitError are reported as internal errors.
+func WriteError(w http.ResponseWriter, err error) {
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		limitErr = &LimitError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Internal server error"}
+	}
+
+	errType := "invalid_request_error"
+	switch limitErr.Status {
+	case http.StatusUnauthorized:
+		errType = "authentication_error"
+	case http.StatusForbidden:
+		errType = "permission_error"
+	case http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	}
+
+	if limitErr.RetryAfter > 0 {
+		seconds := int64(limitErr.RetryAfter.Seconds() + 0.999)
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(limitErr.Status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": limitErr.Message,
+			"type":    errType,
+			"param":   nil,
+			"code":    limitErr.Code,
+		},
+	})
+}
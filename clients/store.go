@@ -0,0 +1,388 @@
+package clients
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/atomicfile"
+)
+
+// tokenPrefix marks virtual client keys so they are easy to tell apart from upstream keys
+const tokenPrefix = "msb-"
+
+// rateWindow is the sliding window of the requests-per-minute limit
+const rateWindow = time.Minute
+
+// ErrNotFound is returned for operations on an unknown client ID
+var ErrNotFound = errors.New("client not found")
+
+// LimitError is returned when a client may not make another request right now
+type LimitError struct {
+	Status     int           // HTTP status to answer with
+	Code       string        // Machine-readable error code
+	Message    string        // Human-readable explanation
+	RetryAfter time.Duration // When the request may be retried, 0 if unknown
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+// Store manages the virtual client keys and persists them to a JSON file
+type Store struct {
+	mu          sync.Mutex
+	clients     []*Client
+	byToken     map[string]*Client
+	path        string
+	windowStart func(time.Time) time.Time // Start of the daily window containing a time
+	logger      *slog.Logger
+	dirty       atomic.Bool // Set when usage counters changed since the last save
+}
+
+// NewStore creates an empty client store persisted at path. windowStart defines
+// the daily window the request and token limits apply to.
+func NewStore(path string, windowStart func(time.Time) time.Time, logger *slog.Logger) *Store {
+	return &Store{
+		byToken:     make(map[string]*Client),
+		path:        path,
+		windowStart: windowStart,
+		logger:      logger,
+	}
+}
+
+// Load reads the clients from the store file. A missing file leaves the store empty.
+func (s *Store) Load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.logger.Info("Client store does not exist, starting without clients", "path", s.path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var loaded []*Client
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("failed to parse client store %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = s.clients[:0]
+	s.byToken = make(map[string]*Client, len(loaded))
+	for _, c := range loaded {
+		if c.ID == "" || c.Token == "" || s.byToken[c.Token] != nil {
+			s.logger.Warn("Skipping invalid client in store", "client_id", c.ID, "name", c.Name)
+			continue
+		}
+		s.clients = append(s.clients, c)
+		s.byToken[c.Token] = c
+	}
+
+	s.logger.Info("Clients loaded", "path", s.path, "count", len(s.clients))
+	return nil
+}
+
+// Save writes all clients to the store file
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked()
+}
+
+// SaveIfDirty saves the store only when usage counters changed since the last save
+func (s *Store) SaveIfDirty() error {
+	if !s.dirty.Load() {
+		return nil
+	}
+	return s.Save()
+}
+
+// saveLocked writes the store file. The caller must hold the lock.
+func (s *Store) saveLocked() error {
+	s.dirty.Store(false)
+
+	data, err := json.MarshalIndent(s.clients, "", "  ")
+	if err != nil {
+		s.dirty.Store(true)
+		return err
+	}
+	// The file holds bearer tokens, so keep it private
+	if err := atomicfile.Write(s.path, data, 0600); err != nil {
+		s.dirty.Store(true)
+		s.logger.Error("Failed to write client store", "path", s.path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// Count returns the number of clients
+func (s *Store) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// List returns snapshots of all clients
+func (s *Store) List() []*Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*Client, 0, len(s.clients))
+	now := time.Now()
+	for _, c := range s.clients {
+		s.rollWindow(c, now)
+		list = append(list, c.snapshot())
+	}
+	return list
+}
+
+// Get returns a snapshot of the client with the given ID
+func (s *Store) Get(id string) (*Client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.find(id)
+	if c == nil {
+		return nil, false
+	}
+	s.rollWindow(c, time.Now())
+	return c.snapshot(), true
+}
+
+// Create issues a new client with a freshly generated token and saves the store
+func (s *Store) Create(settings Settings) (*Client, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	token, err := randomHex(24)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		ID:        id,
+		Token:     tokenPrefix + token,
+		CreatedAt: time.Now(),
+		Settings:  settings,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = append(s.clients, c)
+	s.byToken[c.Token] = c
+	if err := s.saveLocked(); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Client created", "client_id", c.ID, "name", c.Name)
+	return c.snapshot(), nil
+}
+
+// Update replaces the settings of a client and saves the store
+func (s *Store) Update(id string, settings Settings) (*Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.find(id)
+	if c == nil {
+		return nil, ErrNotFound
+	}
+	c.Settings = settings
+	if err := s.saveLocked(); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Client updated", "client_id", c.ID, "name", c.Name, "enabled", c.Enabled)
+	return c.snapshot(), nil
+}
+
+// RotateToken issues a new token for a client, invalidating the old one
+func (s *Store) RotateToken(id string) (*Client, error) {
+	token, err := randomHex(24)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.find(id)
+	if c == nil {
+		return nil, ErrNotFound
+	}
+	delete(s.byToken, c.Token)
+	c.Token = tokenPrefix + token
+	s.byToken[c.Token] = c
+	if err := s.saveLocked(); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Client token rotated", "client_id", c.ID, "name", c.Name)
+	return c.snapshot(), nil
+}
+
+// Delete removes a client and saves the store
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.clients {
+		if c.ID != id {
+			continue
+		}
+		s.clients = append(s.clients[:i], s.clients[i+1:]...)
+		delete(s.byToken, c.Token)
+		if err := s.saveLocked(); err != nil {
+			return err
+		}
+		s.logger.Info("Client deleted", "client_id", c.ID, "name", c.Name)
+		return nil
+	}
+	return ErrNotFound
+}
+
+// Authenticate returns a snapshot of the client owning token. It fails for
+// unknown, disabled and expired tokens.
+func (s *Store) Authenticate(token string) (*Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.byToken[token]
+	if c == nil {
+		return nil, &LimitError{Status: http.StatusUnauthorized, Code: "invalid_api_key", Message: "Invalid API key"}
+	}
+	if err := checkUsable(c, time.Now()); err != nil {
+		return nil, err
+	}
+	return c.snapshot(), nil
+}
+
+// Admit counts a request against the limits of a client, or returns a
+// *LimitError when the client is not allowed to make it
+func (s *Store) Admit(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.find(id)
+	if c == nil {
+		return &LimitError{Status: http.StatusUnauthorized, Code: "invalid_api_key", Message: "Invalid API key"}
+	}
+
+	now := time.Now()
+	if err := checkUsable(c, now); err != nil {
+		return err
+	}
+
+	s.rollWindow(c, now)
+	nextWindow := s.windowStart(now).AddDate(0, 0, 1)
+	if c.DailyRequestLimit > 0 && c.RequestCount >= c.DailyRequestLimit {
+		return &LimitError{
+			Status:     http.StatusTooManyRequests,
+			Code:       "daily_request_limit_exceeded",
+			Message:    fmt.Sprintf("Daily request limit of %d reached", c.DailyRequestLimit),
+			RetryAfter: nextWindow.Sub(now),
+		}
+	}
+	if c.DailyTokenLimit > 0 && c.TokenCount >= c.DailyTokenLimit {
+		return &LimitError{
+			Status:     http.StatusTooManyRequests,
+			Code:       "daily_token_limit_exceeded",
+			Message:    fmt.Sprintf("Daily token limit of %d reached", c.DailyTokenLimit),
+			RetryAfter: nextWindow.Sub(now),
+		}
+	}
+
+	// Drop admissions that left the sliding window
+	cutoff := now.Add(-rateWindow)
+	kept := c.recent[:0]
+	for _, t := range c.recent {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	c.recent = kept
+	if c.RPM > 0 && len(c.recent) >= c.RPM {
+		return &LimitError{
+			Status:     http.StatusTooManyRequests,
+			Code:       "rate_limit_exceeded",
+			Message:    fmt.Sprintf("Rate limit of %d requests per minute reached", c.RPM),
+			RetryAfter: c.recent[0].Add(rateWindow).Sub(now),
+		}
+	}
+
+	c.recent = append(c.recent, now)
+	c.RequestCount++
+	c.LastUsedAt = now
+	s.dirty.Store(true)
+	return nil
+}
+
+// RecordTokens adds tokens used by a request of a client to its daily usage
+func (s *Store) RecordTokens(id string, tokens int64) {
+	if tokens <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.find(id)
+	if c == nil {
+		return
+	}
+	s.rollWindow(c, time.Now())
+	c.TokenCount += tokens
+	s.dirty.Store(true)
+}
+
+// find returns the client with the given ID. The caller must hold the lock.
+func (s *Store) find(id string) *Client {
+	for _, c := range s.clients {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// rollWindow resets the daily counters of a client when a new window has
+// started. The caller must hold the lock.
+func (s *Store) rollWindow(c *Client, now time.Time) {
+	start := s.windowStart(now)
+	if c.UsageWindowStart.Before(start) {
+		c.RequestCount = 0
+		c.TokenCount = 0
+		c.UsageWindowStart = start
+	}
+}
+
+// checkUsable rejects disabled and expired clients
+func checkUsable(c *Client, now time.Time) error {
+	if !c.Enabled {
+		return &LimitError{Status: http.StatusForbidden, Code: "client_disabled", Message: "This API key is disabled"}
+	}
+	if c.Expired(now) {
+		return &LimitError{Status: http.StatusUnauthorized, Code: "api_key_expired", Message: "This API key has expired"}
+	}
+	return nil
+}
+
+// randomHex returns n random bytes encoded as hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/envelope"
+	"github.com/loseleaf/modelscope-balancer/keymanager"
+)
+
+// newMasterKeyEnv supplies the new master key of rotate-master-key
+const newMasterKeyEnv = "MSB_NEW_MASTER_KEY"
+
+// runCommand runs a maintenance command and returns the process exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "generate-master-key":
+		return generateMasterKey()
+	case "rotate-master-key":
+		return rotateMasterKey(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, supported: generate-master-key, rotate-master-key\n", name)
+		return 2
+	}
+}
+
+// generateMasterKey prints a new random master key
+func generateMasterKey() int {
+	key, err := envelope.GenerateMasterKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to generate master key:", err)
+		return 1
+	}
+	fmt.Println(key)
+	return 0
+}
+
+// rotateMasterKey rewraps the data key of the saved state with a new master key.
+// The current master key and the storage backend are read from the same sources
+// as on startup.
+func rotateMasterKey(args []string) int {
+	flags := flag.NewFlagSet("rotate-master-key", flag.ContinueOnError)
+	statePath := flags.String("state", "", "state file or database to rotate (default: storage.path)")
+	newKeyFile := flags.String("new-key-file", "", "file holding the new master key (default: $"+newMasterKeyEnv+")")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load configuration:", err)
+		return 1
+	}
+	oldMaster, err := envelope.LoadMasterKey(cfg.Encryption.MasterKeyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load current master key:", err)
+		return 1
+	}
+
+	var newMaster []byte
+	switch {
+	case *newKeyFile != "":
+		newMaster, err = envelope.ReadMasterKeyFile(*newKeyFile)
+	case os.Getenv(newMasterKeyEnv) != "":
+		newMaster, err = envelope.ParseMasterKey(os.Getenv(newMasterKeyEnv))
+	default:
+		err = fmt.Errorf("set -new-key-file or %s", newMasterKeyEnv)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load new master key:", err)
+		return 1
+	}
+
+	if *statePath != "" {
+		cfg.Storage.Path = *statePath
+	}
+	store, err := keymanager.OpenStore(cfg.Storage)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to open state storage:", err)
+		return 1
+	}
+	defer store.Close()
+
+	if err := keymanager.RotateMasterKey(store, oldMaster, newMaster); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to rotate master key:", err)
+		return 1
+	}
+	fmt.Printf("Rotated master key of %s to %s; start the balancer with the new master key\n", store, envelope.MasterKeyID(newMaster))
+	return 0
+}
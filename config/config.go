@@ -1,9 +1,17 @@
 package config
 
 import (
+	"fmt"
+
 	"github.com/spf13/viper"
 )
 
+// DefaultUpstreamName is the name of the upstream created when none is configured
+const DefaultUpstreamName = "modelscope"
+
+// DefaultUpstreamBaseURL is the ModelScope API-Inference endpoint
+const DefaultUpstreamBaseURL = "https://api-inference.modelscope.cn/v1"
+
 // AppViper is the global Viper instance for configuration management
 var AppViper *viper.Viper
 
@@ -16,6 +24,134 @@ type AutoReactivationSettings struct {
 	Timezone string `mapstructure:"timezone"`
 }
 
+// CircuitBreakerSettings represents the per-key cooldown and recovery configuration
+type CircuitBreakerSettings struct {
+	FailureThreshold int    `mapstructure:"failure_threshold"`
+	BaseCooldown     string `mapstructure:"base_cooldown"`
+	MaxCooldown      string `mapstructure:"max_cooldown"`
+	ProbeTimeout     string `mapstructure:"probe_timeout"`
+}
+
+// QuotaSettings represents the daily request quota applied to every API key
+type QuotaSettings struct {
+	DailyLimit int64  `mapstructure:"daily_limit"`
+	ResetTime  string `mapstructure:"reset_time"`
+	Timezone   string `mapstructure:"timezone"`
+}
+
+// KeySelectionSettings represents how the next key is chosen for a request
+type KeySelectionSettings struct {
+	Strategy string `mapstructure:"strategy"`
+}
+
+// UpstreamSettings represents an OpenAI-compatible upstream endpoint served by its own key pool
+type UpstreamSettings struct {
+	Name             string   `mapstructure:"name"`
+	BaseURL          string   `mapstructure:"base_url"`
+	ApiKeys          []string `mapstructure:"api_keys"`
+	ConnectTimeout   string   `mapstructure:"connect_timeout"`
+	FirstByteTimeout string   `mapstructure:"first_byte_timeout"`
+	IdleTimeout      string   `mapstructure:"idle_timeout"`
+}
+
+// RouteSettings maps model names or glob patterns such as "Qwen/*" to the upstream serving them
+type RouteSettings struct {
+	Models   []string `mapstructure:"models"`
+	Upstream string   `mapstructure:"upstream"`
+}
+
+// AliasSettings maps a client-facing model name such as "fast" to the model sent upstream
+type AliasSettings struct {
+	Name  string `mapstructure:"name"`
+	Model string `mapstructure:"model"`
+}
+
+// FallbackSettings lists the models tried in order once every key failed for a model
+type FallbackSettings struct {
+	Model     string   `mapstructure:"model"`
+	Fallbacks []string `mapstructure:"fallbacks"`
+}
+
+// PassthroughSettings allowlists an API path below /v1, such as "/embeddings",
+// that is forwarded to the upstreams unchanged
+type PassthroughSettings struct {
+	Path             string   `mapstructure:"path"`
+	Methods          []string `mapstructure:"methods"`            // Defaults to POST
+	Timeout          string   `mapstructure:"timeout"`            // Bound of one upstream attempt, unbounded when empty
+	FirstByteTimeout string   `mapstructure:"first_byte_timeout"` // Overrides the upstream's first_byte_timeout when set
+}
+
+// MetricsSettings controls the Prometheus /metrics endpoint
+type MetricsSettings struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Token   string `mapstructure:"token"` // Optional bearer token required to scrape
+}
+
+// TracingSettings controls OpenTelemetry tracing and where spans are exported
+type TracingSettings struct {
+	Enabled     bool    `mapstructure:"enabled"`
+	Exporter    string  `mapstructure:"exporter"`     // "otlp", "stdout" or "file"
+	Endpoint    string  `mapstructure:"endpoint"`     // OTLP/HTTP collector URL, e.g. http://localhost:4318
+	FilePath    string  `mapstructure:"file_path"`    // Output file of the "file" exporter
+	ServiceName string  `mapstructure:"service_name"` // service.name resource attribute
+	SampleRatio float64 `mapstructure:"sample_ratio"` // Share of new traces recorded, 0 < ratio <= 1
+}
+
+// WebhookSettings configures a webhook notified about key lifecycle events
+type WebhookSettings struct {
+	Name       string   `mapstructure:"name"`
+	URL        string   `mapstructure:"url"`
+	Format     string   `mapstructure:"format"`      // "json", "dingtalk", "feishu" or "slack"
+	Secret     string   `mapstructure:"secret"`      // Signs deliveries with HMAC-SHA256 when set
+	Events     []string `mapstructure:"events"`      // Event types to deliver, all when empty
+	MaxRetries int      `mapstructure:"max_retries"` // Retries of a failed delivery
+	Timeout    string   `mapstructure:"timeout"`     // Timeout of a single delivery attempt
+}
+
+// StorageSettings selects where the key state is persisted
+type StorageSettings struct {
+	Backend string `mapstructure:"backend"` // "file" (JSON) or "bolt" (embedded database)
+	Path    string `mapstructure:"path"`    // State file or database, defaults to state.json or state.db
+}
+
+// EncryptionSettings controls encryption of key values in the state file
+type EncryptionSettings struct {
+	MasterKeyFile string `mapstructure:"master_key_file"` // File holding the master key, used when MSB_MASTER_KEY and MSB_MASTER_KEY_FILE are unset
+}
+
+// RequestLogSettings controls the log of served API requests
+type RequestLogSettings struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	Path         string `mapstructure:"path"`           // Current log file; rotated files get a .1, .2, ... suffix
+	MaxSizeMB    int    `mapstructure:"max_size_mb"`    // Size at which the file is rotated
+	MaxFiles     int    `mapstructure:"max_files"`      // Rotated files kept besides the current one
+	Bodies       string `mapstructure:"bodies"`         // "none", "redacted" or "full"
+	MaxBodyBytes int    `mapstructure:"max_body_bytes"` // Bytes of each body kept (at most 1 MiB), longer bodies are truncated
+}
+
+// ResponsesSettings configures the store of the Responses API that previous_response_id refers to
+type ResponsesSettings struct {
+	Persist    bool   `mapstructure:"persist"`     // Keep stored responses in responses.json across restarts
+	TTL        string `mapstructure:"ttl"`         // How long a stored response can be retrieved and continued
+	MaxEntries int    `mapstructure:"max_entries"` // Oldest responses are evicted beyond this count
+}
+
+// BatchSettings configures the Batch API and its worker pool
+type BatchSettings struct {
+	Dir           string `mapstructure:"dir"`            // Holds uploaded files, results and the job state
+	Workers       int    `mapstructure:"workers"`        // Concurrent requests of the running batch, one per usable key when 0
+	MaxFileMB     int    `mapstructure:"max_file_mb"`    // Largest file accepted by uploads
+	MaxRequests   int    `mapstructure:"max_requests"`   // Most requests in one batch
+	MaxAttempts   int    `mapstructure:"max_attempts"`   // Attempts of a request failing with a server error
+	RetryInterval string `mapstructure:"retry_interval"` // Wait before retrying while every key is exhausted or rate limited
+}
+
+// ShutdownSettings controls how the server drains on SIGINT or SIGTERM
+type ShutdownSettings struct {
+	DrainDelay   string `mapstructure:"drain_delay"`   // How long /health reports draining before the listener closes
+	DrainTimeout string `mapstructure:"drain_timeout"` // How long in-flight requests may take to finish
+}
+
 // Config represents the application configuration
 type Config struct {
 	ServerAddress    string                   `mapstructure:"server_address"`
@@ -23,6 +159,23 @@ type Config struct {
 	AdminToken       string                   `mapstructure:"admin_token"`
 	ApiToken         string                   `mapstructure:"api_token"`
 	AutoReactivation AutoReactivationSettings `mapstructure:"auto_reactivation"`
+	CircuitBreaker   CircuitBreakerSettings   `mapstructure:"circuit_breaker"`
+	Quota            QuotaSettings            `mapstructure:"quota"`
+	KeySelection     KeySelectionSettings     `mapstructure:"key_selection"`
+	Upstreams        []UpstreamSettings       `mapstructure:"upstreams"`
+	Routes           []RouteSettings          `mapstructure:"routes"`
+	Aliases          []AliasSettings          `mapstructure:"aliases"`
+	Fallbacks        []FallbackSettings       `mapstructure:"fallbacks"`
+	Passthrough      []PassthroughSettings    `mapstructure:"passthrough"`
+	Metrics          MetricsSettings          `mapstructure:"metrics"`
+	Tracing          TracingSettings          `mapstructure:"tracing"`
+	Webhooks         []WebhookSettings        `mapstructure:"webhooks"`
+	Storage          StorageSettings          `mapstructure:"storage"`
+	Encryption       EncryptionSettings       `mapstructure:"encryption"`
+	RequestLog       RequestLogSettings       `mapstructure:"request_log"`
+	Responses        ResponsesSettings        `mapstructure:"responses"`
+	Batch            BatchSettings            `mapstructure:"batch"`
+	Shutdown         ShutdownSettings         `mapstructure:"shutdown"`
 }
 
 // Load loads configuration from file and environment variables
@@ -53,6 +206,72 @@ func Load() (Config, error) {
 	AppViper.SetDefault("auto_reactivation.cron_spec", "0 */10 * * * *")
 	AppViper.SetDefault("auto_reactivation.timezone", "Local")
 
+	// Set default circuit breaker settings
+	AppViper.SetDefault("circuit_breaker.failure_threshold", 3)
+	AppViper.SetDefault("circuit_breaker.base_cooldown", "30s")
+	AppViper.SetDefault("circuit_breaker.max_cooldown", "30m")
+	AppViper.SetDefault("circuit_breaker.probe_timeout", "2m")
+
+	// Set default daily quota settings (a limit of 0 disables quota tracking)
+	AppViper.SetDefault("quota.daily_limit", 0)
+	AppViper.SetDefault("quota.reset_time", "00:00")
+	AppViper.SetDefault("quota.timezone", "Asia/Shanghai")
+
+	// Set default key selection strategy
+	AppViper.SetDefault("key_selection.strategy", "round_robin")
+
+	// Forward the ModelScope endpoints besides chat completions. Image generation
+	// answers only once the image is ready, so it may take longer to start.
+	AppViper.SetDefault("passthrough", []map[string]any{
+		{"path": "/completions"},
+		{"path": "/embeddings"},
+		{"path": "/images/generations", "first_byte_timeout": "300s"},
+	})
+
+	// Expose Prometheus metrics by default
+	AppViper.SetDefault("metrics.enabled", true)
+	AppViper.SetDefault("metrics.token", "")
+
+	// Tracing is opt-in; OTLP honors the standard OTEL_EXPORTER_OTLP_* variables when no endpoint is set
+	AppViper.SetDefault("tracing.enabled", false)
+	AppViper.SetDefault("tracing.exporter", "otlp")
+	AppViper.SetDefault("tracing.endpoint", "")
+	AppViper.SetDefault("tracing.file_path", "traces.jsonl")
+	AppViper.SetDefault("tracing.service_name", "modelscope-balancer")
+	AppViper.SetDefault("tracing.sample_ratio", 1.0)
+
+	// Key state is kept in state.json unless another backend is selected
+	AppViper.SetDefault("storage.backend", "file")
+	AppViper.SetDefault("storage.path", "")
+
+	// State file encryption is enabled by supplying a master key
+	AppViper.SetDefault("encryption.master_key_file", "")
+
+	// The request log is opt-in and records metadata only unless bodies are enabled
+	AppViper.SetDefault("request_log.enabled", false)
+	AppViper.SetDefault("request_log.path", "logs/requests.jsonl")
+	AppViper.SetDefault("request_log.max_size_mb", 50)
+	AppViper.SetDefault("request_log.max_files", 5)
+	AppViper.SetDefault("request_log.bodies", "none")
+	AppViper.SetDefault("request_log.max_body_bytes", 65536)
+
+	// Responses API conversations can be continued for 30 days
+	AppViper.SetDefault("responses.persist", true)
+	AppViper.SetDefault("responses.ttl", "720h")
+	AppViper.SetDefault("responses.max_entries", 10000)
+
+	// Batch requests run one per usable key at a time and wait out exhausted quotas
+	AppViper.SetDefault("batch.dir", "batches")
+	AppViper.SetDefault("batch.workers", 0)
+	AppViper.SetDefault("batch.max_file_mb", 100)
+	AppViper.SetDefault("batch.max_requests", 50000)
+	AppViper.SetDefault("batch.max_attempts", 3)
+	AppViper.SetDefault("batch.retry_interval", "1m")
+
+	// Give load balancers time to notice the shutdown and streams time to finish
+	AppViper.SetDefault("shutdown.drain_delay", "5s")
+	AppViper.SetDefault("shutdown.drain_timeout", "30s")
+
 	// Try to read configuration file
 	// If file doesn't exist, ignore the error as config might be provided entirely by environment variables
 	if err := AppViper.ReadInConfig(); err != nil {
@@ -68,5 +287,47 @@ func Load() (Config, error) {
 		return cfg, err
 	}
 
+	if err := cfg.normalizeUpstreams(); err != nil {
+		return cfg, err
+	}
+
 	return cfg, nil
 }
+
+// normalizeUpstreams makes sure at least one upstream exists. Without an upstreams
+// section the balancer fronts ModelScope with the top-level api_keys; otherwise the
+// top-level api_keys join the pool of the first (default) upstream.
+func (c *Config) normalizeUpstreams() error {
+	if len(c.Upstreams) == 0 {
+		c.Upstreams = []UpstreamSettings{{
+			Name:    DefaultUpstreamName,
+			BaseURL: DefaultUpstreamBaseURL,
+		}}
+	}
+	c.Upstreams[0].ApiKeys = append(c.Upstreams[0].ApiKeys, c.ApiKeys...)
+
+	seen := make(map[string]bool, len(c.Upstreams))
+	for i := range c.Upstreams {
+		upstream := &c.Upstreams[i]
+		if upstream.Name == "" {
+			return fmt.Errorf("upstream #%d has no name", i+1)
+		}
+		if seen[upstream.Name] {
+			return fmt.Errorf("duplicate upstream name %q", upstream.Name)
+		}
+		seen[upstream.Name] = true
+		if upstream.BaseURL == "" {
+			upstream.BaseURL = DefaultUpstreamBaseURL
+		}
+	}
+	return nil
+}
+
+// TotalApiKeys returns the number of configured keys across all upstreams
+func (c *Config) TotalApiKeys() int {
+	total := 0
+	for _, upstream := range c.Upstreams {
+		total += len(upstream.ApiKeys)
+	}
+	return total
+}
@@ -0,0 +1,243 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Algorithm names the cipher used for data keys and sealed values
+const Algorithm = "AES-256-GCM"
+
+// Environment variables supplying the master key, either directly or as a file path
+const (
+	MasterKeyEnv     = "MSB_MASTER_KEY"
+	MasterKeyFileEnv = "MSB_MASTER_KEY_FILE"
+)
+
+// keySize is the size of master and data keys in bytes
+const keySize = 32
+
+// dataKeyAAD binds wrapped data keys to their purpose
+var dataKeyAAD = []byte("modelscope-balancer data key")
+
+// ErrWrongMasterKey is returned when a data key was wrapped with another master key
+var ErrWrongMasterKey = errors.New("data key was encrypted with a different master key")
+
+// LoadMasterKey returns the master key from MSB_MASTER_KEY, the file named by
+// MSB_MASTER_KEY_FILE or the configured file, in that order. It returns nil
+// when no master key is supplied.
+func LoadMasterKey(configuredFile string) ([]byte, error) {
+	if value := os.Getenv(MasterKeyEnv); value != "" {
+		key, err := ParseMasterKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", MasterKeyEnv, err)
+		}
+		return key, nil
+	}
+
+	path := os.Getenv(MasterKeyFileEnv)
+	if path == "" {
+		path = configuredFile
+	}
+	if path == "" {
+		return nil, nil
+	}
+	return ReadMasterKeyFile(path)
+}
+
+// ReadMasterKeyFile reads a master key file holding the encoded key
+func ReadMasterKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key file: %w", err)
+	}
+	key, err := ParseMasterKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// ParseMasterKey decodes a 32-byte master key given in base64 or hex
+func ParseMasterKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	for _, decode := range []func(string) ([]byte, error){
+		base64.StdEncoding.DecodeString,
+		base64.URLEncoding.DecodeString,
+		base64.RawStdEncoding.DecodeString,
+		hex.DecodeString,
+	} {
+		if key, err := decode(value); err == nil && len(key) == keySize {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("master key must be %d bytes encoded as base64 or hex", keySize)
+}
+
+// GenerateMasterKey returns a new random master key encoded as base64
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// MasterKeyID returns a short identifier of a master key that does not reveal it
+func MasterKeyID(master []byte) string {
+	sum := sha256.Sum256(master)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Header describes the data key of an encrypted file. It is stored next to the
+// sealed values.
+type Header struct {
+	Algorithm   string `json:"algorithm"`
+	MasterKeyID string `json:"master_key_id"` // Identifies the master key the data key is wrapped with
+	WrappedKey  string `json:"wrapped_key"`   // Data key sealed with the master key, base64
+}
+
+// Keyring seals and opens values with a data key
+type Keyring struct {
+	header Header
+	aead   cipher.AEAD
+}
+
+// New creates a keyring with a fresh data key wrapped by master
+func New(master []byte) (*Keyring, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(master, dataKey, dataKeyAAD)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyring(Header{Algorithm: Algorithm, MasterKeyID: MasterKeyID(master), WrappedKey: wrapped}, dataKey)
+}
+
+// Open unwraps the data key of a header with master
+func Open(master []byte, header Header) (*Keyring, error) {
+	dataKey, err := unwrap(master, header)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyring(header, dataKey)
+}
+
+// Rewrap returns the header with its data key wrapped by newMaster instead of
+// oldMaster. Values sealed with the data key stay valid.
+func Rewrap(header Header, oldMaster, newMaster []byte) (Header, error) {
+	dataKey, err := unwrap(oldMaster, header)
+	if err != nil {
+		return Header{}, err
+	}
+	wrapped, err := seal(newMaster, dataKey, dataKeyAAD)
+	if err != nil {
+		return Header{}, err
+	}
+	return Header{Algorithm: Algorithm, MasterKeyID: MasterKeyID(newMaster), WrappedKey: wrapped}, nil
+}
+
+// Header returns the header to store with values sealed by the keyring
+func (k *Keyring) Header() Header {
+	return k.header
+}
+
+// Seal encrypts a value. aad binds the ciphertext to its context, such as the
+// ID of the record holding it, and must be passed to Open again.
+func (k *Keyring) Seal(plaintext, aad string) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(plaintext), []byte(aad))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed with the same aad
+func (k *Keyring) Open(sealed, aad string) (string, error) {
+	plaintext, err := open(k.aead, sealed, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// newKeyring creates a keyring from an unwrapped data key
+func newKeyring(header Header, dataKey []byte) (*Keyring, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{header: header, aead: aead}, nil
+}
+
+// unwrap decrypts the data key of a header
+func unwrap(master []byte, header Header) ([]byte, error) {
+	if header.Algorithm != Algorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", header.Algorithm)
+	}
+	if header.MasterKeyID != "" && header.MasterKeyID != MasterKeyID(master) {
+		return nil, ErrWrongMasterKey
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := open(aead, header.WrappedKey, dataKeyAAD)
+	if err != nil {
+		return nil, ErrWrongMasterKey
+	}
+	return dataKey, nil
+}
+
+// seal encrypts plaintext with key, returning nonce and ciphertext as base64
+func seal(key, plaintext, aad []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, aad)), nil
+}
+
+// open decrypts a base64 nonce and ciphertext
+func open(aead cipher.AEAD, sealed string, aad []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed value: %w", err)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("invalid sealed value: too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return plaintext, nil
+}
+
+// newAEAD creates an AES-GCM cipher from a 32-byte key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,183 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type names a kind of event
+type Type string
+
+// Type constants
+const (
+	KeyAdded       Type = "key_added"
+	KeyDeleted     Type = "key_deleted"
+	KeyDisabled    Type = "key_disabled"    // Disabled manually or after the upstream rejected the key
+	KeyReactivated Type = "key_reactivated" // Returned to service manually, by a key test or by the scheduler
+	PoolExhausted  Type = "pool_exhausted"  // No key of a pool can serve requests any more
+	QuotaExhausted Type = "quota_exhausted" // A key used up its daily quota
+	TestCompleted  Type = "test_completed"  // A key test run finished
+	WebhookTest    Type = "webhook_test"    // Sent by the webhook test endpoint only
+
+	// Frequent events, only streamed to the admin interface
+	KeyStateChanged  Type = "key_state_changed" // Any status transition of a key, including cooldowns and probes
+	RequestCompleted Type = "request_completed" // Summary of a served API request
+	SchedulerRun     Type = "scheduler_run"     // A scheduled task ran
+)
+
+// Types lists the event types that webhooks can be notified about
+var Types = []Type{KeyAdded, KeyDeleted, KeyDisabled, KeyReactivated, PoolExhausted, QuotaExhausted, TestCompleted}
+
+// StreamTypes lists all event types of the admin event stream
+var StreamTypes = append(append([]Type(nil), Types...), KeyStateChanged, RequestCompleted, SchedulerRun)
+
+// Event is a notable change inside the balancer. Keys are identified by ID and
+// fingerprint only, never by value.
+type Event struct {
+	ID          uint64         `json:"id"` // Increasing sequence number, assigned on publish
+	Type        Type           `json:"type"`
+	Time        time.Time      `json:"time"`
+	Pool        string         `json:"pool,omitempty"`
+	KeyID       string         `json:"key_id,omitempty"`
+	Fingerprint string         `json:"fingerprint,omitempty"`
+	Reason      string         `json:"reason,omitempty"`
+	Data        map[string]any `json:"data,omitempty"` // Type-specific details
+}
+
+// Text returns a one-line human readable description of the event
+func (ev Event) Text() string {
+	key := ev.KeyID
+	if ev.Fingerprint != "" {
+		key += " (" + ev.Fingerprint + ")"
+	}
+
+	switch ev.Type {
+	case KeyAdded:
+		return fmt.Sprintf("Key %s was added to pool %s", key, ev.Pool)
+	case KeyDeleted:
+		return fmt.Sprintf("Key %s was deleted from pool %s", key, ev.Pool)
+	case KeyDisabled:
+		return fmt.Sprintf("Key %s in pool %s was disabled: %s", key, ev.Pool, ev.Reason)
+	case KeyReactivated:
+		return fmt.Sprintf("Key %s in pool %s was reactivated by %v", key, ev.Pool, ev.Data["trigger"])
+	case PoolExhausted:
+		return fmt.Sprintf("No key of pool %s is available to serve requests", ev.Pool)
+	case QuotaExhausted:
+		return fmt.Sprintf("Key %s in pool %s used up its daily quota of %v requests", key, ev.Pool, ev.Data["daily_limit"])
+	case TestCompleted:
+		return fmt.Sprintf("Key test finished: %v of %v keys passed", ev.Data["passed"], ev.Data["total"])
+	case WebhookTest:
+		return "Webhook test from ModelScope Balancer"
+	case KeyStateChanged:
+		return fmt.Sprintf("Key %s in pool %s changed from %v to %v", key, ev.Pool, ev.Data["from"], ev.Data["to"])
+	case RequestCompleted:
+		return fmt.Sprintf("Request for model %v answered with status %v in %vms", ev.Data["model"], ev.Data["status"], ev.Data["latency_ms"])
+	case SchedulerRun:
+		return fmt.Sprintf("Scheduled task %v ran", ev.Data["task"])
+	default:
+		return string(ev.Type)
+	}
+}
+
+// IsStreamType reports whether t is a type of the admin event stream
+func IsStreamType(t Type) bool {
+	return containsType(StreamTypes, t)
+}
+
+// containsType reports whether types includes t
+func containsType(types []Type, t Type) bool {
+	for _, known := range types {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives published events of the selected types
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	types   map[Type]bool // Empty for all types
+	dropped atomic.Int64
+}
+
+// Dropped returns how many events were dropped because the subscriber fell behind
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// wants reports whether the subscription selected an event type
+func (s *Subscription) wants(t Type) bool {
+	return len(s.types) == 0 || s.types[t]
+}
+
+// Bus fans events out to subscribers. Publishing never blocks: a subscriber
+// whose buffer is full misses the event.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]bool
+	seq  atomic.Uint64
+}
+
+// NewBus creates an event bus without subscribers
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]bool)}
+}
+
+// Publish stamps an event with the next ID and the current time, if unset, and
+// delivers it to all subscribers of its type
+func (b *Bus) Publish(ev Event) {
+	ev.ID = b.seq.Add(1)
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if !sub.wants(ev.Type) {
+			continue
+		}
+		select {
+		case sub.c <- ev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe registers a subscriber for the given event types, or all types when
+// none are given. buffer bounds how many events may wait for the subscriber.
+func (b *Bus) Subscribe(buffer int, types ...Type) *Subscription {
+	c := make(chan Event, buffer)
+	sub := &Subscription{C: c, c: c, types: make(map[Type]bool, len(types))}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	b.mu.Lock()
+	b.subs[sub] = true
+	b.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe removes a subscriber and closes its channel
+func (b *Bus) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[sub] {
+		delete(b.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Default is the bus the balancer components publish to
+var Default = NewBus()
+
+// Publish publishes an event on the default bus
+func Publish(ev Event) {
+	Default.Publish(ev)
+}
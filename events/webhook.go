@@ -0,0 +1,327 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/metrics"
+)
+
+// Webhook payload formats
+const (
+	FormatJSON     = "json"     // The event itself, signed in the X-MSB-Signature header
+	FormatDingTalk = "dingtalk" // DingTalk custom robot text message
+	FormatFeishu   = "feishu"   // Feishu/Lark custom bot text message
+	FormatSlack    = "slack"    // Slack incoming webhook message
+)
+
+// Webhook delivery defaults
+const (
+	defaultWebhookRetries = 3
+	defaultWebhookTimeout = 5 * time.Second
+	webhookQueueSize      = 256
+	maxRetryBackoff       = 30 * time.Second
+)
+
+// textPrefix starts every chat message so it is recognizable in a shared channel
+const textPrefix = "[ModelScope Balancer] "
+
+// ErrUnknownWebhook is returned when a webhook name is not configured
+var ErrUnknownWebhook = errors.New("unknown webhook")
+
+// webhook is a configured delivery target
+type webhook struct {
+	name       string
+	url        string
+	format     string
+	secret     string
+	types      []Type
+	maxRetries int
+	timeout    time.Duration
+}
+
+// Dispatcher delivers events from a bus to the configured webhooks. Every
+// webhook has its own queue, so a slow receiver delays only its own events.
+type Dispatcher struct {
+	webhooks []*webhook
+	subs     []*Subscription
+	bus      *Bus
+	client   *http.Client
+	logger   *slog.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// StartWebhooks validates the webhook settings and starts delivering the events
+// of bus to them
+func StartWebhooks(settings []config.WebhookSettings, bus *Bus, logger *slog.Logger) (*Dispatcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{bus: bus, client: &http.Client{}, logger: logger, ctx: ctx, cancel: cancel}
+
+	for i, s := range settings {
+		wh, err := newWebhook(i, s)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		d.webhooks = append(d.webhooks, wh)
+	}
+
+	for _, wh := range d.webhooks {
+		sub := bus.Subscribe(webhookQueueSize, wh.types...)
+		d.subs = append(d.subs, sub)
+		d.wg.Add(1)
+		go d.run(wh, sub)
+		logger.Info("Webhook configured", "webhook", wh.name, "format", wh.format, "events", wh.types, "signed", wh.secret != "")
+	}
+	return d, nil
+}
+
+// newWebhook validates the settings of the i-th webhook
+func newWebhook(i int, s config.WebhookSettings) (*webhook, error) {
+	wh := &webhook{name: s.Name, url: s.URL, format: s.Format, secret: s.Secret, maxRetries: s.MaxRetries, timeout: defaultWebhookTimeout}
+	if wh.name == "" {
+		wh.name = fmt.Sprintf("webhook-%d", i+1)
+	}
+	if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("webhook %s: invalid url %q", wh.name, s.URL)
+	}
+
+	switch wh.format {
+	case "":
+		wh.format = FormatJSON
+	case FormatJSON, FormatDingTalk, FormatFeishu, FormatSlack:
+	default:
+		return nil, fmt.Errorf("webhook %s: unknown format %q, supported: json, dingtalk, feishu, slack", wh.name, s.Format)
+	}
+
+	for _, name := range s.Events {
+		t := Type(name)
+		if !containsType(Types, t) {
+			return nil, fmt.Errorf("webhook %s: unknown event type %q", wh.name, name)
+		}
+		wh.types = append(wh.types, t)
+	}
+	if len(wh.types) == 0 {
+		// Stream-only events are too frequent for notifications
+		wh.types = Types
+	}
+
+	if wh.maxRetries <= 0 {
+		wh.maxRetries = defaultWebhookRetries
+	}
+	if s.Timeout != "" {
+		timeout, err := time.ParseDuration(s.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("webhook %s: invalid timeout %q", wh.name, s.Timeout)
+		}
+		wh.timeout = timeout
+	}
+	return wh, nil
+}
+
+// Close stops taking new events and delivers the queued ones. Deliveries still
+// pending when ctx is done are abandoned.
+func (d *Dispatcher) Close(ctx context.Context) {
+	for _, sub := range d.subs {
+		d.bus.Unsubscribe(sub)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+	}
+}
+
+// run delivers the events of a subscription to a webhook in order
+func (d *Dispatcher) run(wh *webhook, sub *Subscription) {
+	defer d.wg.Done()
+	for ev := range sub.C {
+		d.deliver(d.ctx, wh, ev)
+	}
+}
+
+// Test sends a test event to the named webhook and returns the delivery error
+func (d *Dispatcher) Test(ctx context.Context, name string) error {
+	for _, wh := range d.webhooks {
+		if wh.name == name {
+			return d.deliver(ctx, wh, Event{Type: WebhookTest, Time: time.Now()})
+		}
+	}
+	return ErrUnknownWebhook
+}
+
+// Names returns the names of the configured webhooks
+func (d *Dispatcher) Names() []string {
+	names := make([]string, 0, len(d.webhooks))
+	for _, wh := range d.webhooks {
+		names = append(names, wh.name)
+	}
+	return names
+}
+
+// deliver sends an event to a webhook, retrying failed attempts with exponential backoff
+func (d *Dispatcher) deliver(ctx context.Context, wh *webhook, ev Event) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := d.send(ctx, wh, ev)
+		if err == nil {
+			metrics.WebhookDeliveries.Inc(wh.name, "success")
+			return nil
+		}
+
+		var permanent permanentError
+		if errors.As(err, &permanent) || attempt >= wh.maxRetries {
+			metrics.WebhookDeliveries.Inc(wh.name, "failed")
+			d.logger.Error("Webhook delivery failed", "webhook", wh.name, "event_id", ev.ID, "event_type", ev.Type, "attempts", attempt+1, "error", err)
+			return err
+		}
+
+		d.logger.Warn("Webhook delivery failed, retrying", "webhook", wh.name, "event_id", ev.ID, "attempt", attempt+1, "backoff", backoff.String(), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			metrics.WebhookDeliveries.Inc(wh.name, "failed")
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// permanentError marks a delivery failure that retrying cannot fix
+type permanentError struct{ error }
+
+// send makes a single delivery attempt
+func (d *Dispatcher) send(ctx context.Context, wh *webhook, ev Event) error {
+	req, err := wh.newRequest(ctx, ev, time.Now())
+	if err != nil {
+		return permanentError{err}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wh.timeout)
+	defer cancel()
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("receiver returned %s", resp.Status)
+	case resp.StatusCode >= 300:
+		return permanentError{fmt.Errorf("receiver returned %s: %s", resp.Status, bytes.TrimSpace(body))}
+	}
+	return checkChatResponse(wh.format, body)
+}
+
+// checkChatResponse detects errors that DingTalk and Feishu report with status 200
+func checkChatResponse(format string, body []byte) error {
+	var result struct {
+		ErrCode *int   `json:"errcode"` // DingTalk
+		ErrMsg  string `json:"errmsg"`
+		Code    *int   `json:"code"` // Feishu
+		Msg     string `json:"msg"`
+	}
+	if json.Unmarshal(body, &result) != nil {
+		return nil
+	}
+	switch {
+	case format == FormatDingTalk && result.ErrCode != nil && *result.ErrCode != 0:
+		return permanentError{fmt.Errorf("dingtalk error %d: %s", *result.ErrCode, result.ErrMsg)}
+	case format == FormatFeishu && result.Code != nil && *result.Code != 0:
+		return permanentError{fmt.Errorf("feishu error %d: %s", *result.Code, result.Msg)}
+	}
+	return nil
+}
+
+// newRequest builds the delivery request of an event in the webhook's format
+func (wh *webhook) newRequest(ctx context.Context, ev Event, now time.Time) (*http.Request, error) {
+	target := wh.url
+	text := textPrefix + ev.Text()
+
+	var payload any
+	switch wh.format {
+	case FormatDingTalk:
+		payload = map[string]any{"msgtype": "text", "text": map[string]string{"content": text}}
+		if wh.secret != "" {
+			// DingTalk signs the millisecond timestamp and the secret, passed as query parameters
+			timestamp := strconv.FormatInt(now.UnixMilli(), 10)
+			sign := base64.StdEncoding.EncodeToString(hmacSHA256([]byte(wh.secret), timestamp+"\n"+wh.secret))
+			u, err := url.Parse(target)
+			if err != nil {
+				return nil, err
+			}
+			q := u.Query()
+			q.Set("timestamp", timestamp)
+			q.Set("sign", sign)
+			u.RawQuery = q.Encode()
+			target = u.String()
+		}
+	case FormatFeishu:
+		msg := map[string]any{"msg_type": "text", "content": map[string]string{"text": text}}
+		if wh.secret != "" {
+			// Feishu uses the timestamp and the secret as the HMAC key of an empty message
+			timestamp := strconv.FormatInt(now.Unix(), 10)
+			msg["timestamp"] = timestamp
+			msg["sign"] = base64.StdEncoding.EncodeToString(hmacSHA256([]byte(timestamp+"\n"+wh.secret), ""))
+		}
+		payload = msg
+	case FormatSlack:
+		payload = map[string]string{"text": text}
+	default:
+		payload = ev
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "modelscope-balancer-webhook")
+	req.Header.Set("X-MSB-Event", string(ev.Type))
+	req.Header.Set("X-MSB-Event-ID", strconv.FormatUint(ev.ID, 10))
+
+	// JSON and Slack receivers verify HMAC-SHA256 over "<timestamp>.<body>"
+	if wh.secret != "" && (wh.format == FormatJSON || wh.format == FormatSlack) {
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		req.Header.Set("X-MSB-Timestamp", timestamp)
+		req.Header.Set("X-MSB-Signature", "sha256="+hex.EncodeToString(hmacSHA256([]byte(wh.secret), timestamp+"."+string(body))))
+	}
+	return req, nil
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of message under key
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
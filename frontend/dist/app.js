@@ -8,6 +8,8 @@ class AdminApp {
         this.isLoading = false;
         this.testInProgress = false;
         this.adminToken = null; // 用于在内存中缓存令牌
+        this.keyEventSource = null; // 密钥页面的实时事件流
+        this.keyReloadTimer = null;
         this.checkAuth();
     }
 
@@ -32,6 +34,7 @@ class AdminApp {
                     // 令牌有效，使用并初始化应用
                     console.log('Saved token is valid, initializing app');
                     this.adminToken = savedToken;
+                    await this.startSession();
                     this.init();
                 } else {
                     // 令牌无效，清除并显示认证界面
@@ -183,6 +186,7 @@ class AdminApp {
                 // 令牌有效，保存并进入主界面
                 localStorage.setItem('adminToken', token);
                 this.adminToken = token;
+                await this.startSession();
 
                 // 清空主内容区
                 mainContent.innerHTML = '';
@@ -223,7 +227,26 @@ class AdminApp {
         }
     }
 
+    // 获取会话 Cookie，EventSource 无法设置 Authorization 头，依靠它进行认证
+    async startSession() {
+        try {
+            const response = await fetch('/admin/api/session', {
+                method: 'POST',
+                headers: {
+                    'Authorization': `Bearer ${this.adminToken}`
+                }
+            });
+            if (!response.ok) throw new Error(`HTTP ${response.status}`);
+        } catch (error) {
+            console.error('Failed to start admin session:', error);
+        }
+    }
+
     logout() {
+        // 关闭实时事件流并清除会话 Cookie
+        this.stopKeyEvents();
+        fetch('/admin/api/session', { method: 'DELETE' }).catch(() => {});
+
         // 清除localStorage中的令牌
         localStorage.removeItem('adminToken');
 
@@ -261,6 +284,9 @@ class AdminApp {
     renderPage(page) {
         const mainContent = document.getElementById('main-content');
 
+        // 实时刷新只在密钥页面需要
+        this.stopKeyEvents();
+
         switch (page) {
             case 'keys':
                 this.renderKeysPage();
@@ -287,8 +313,33 @@ class AdminApp {
         // Setup event listeners
         this.setupKeysPageEvents();
 
-        // Load keys data
+        // Load keys data and keep it current
         this.loadKeys();
+        this.startKeyEvents();
+    }
+
+    // 订阅密钥状态事件，状态变化时自动刷新密钥列表
+    startKeyEvents() {
+        this.stopKeyEvents();
+
+        const types = ['key_state_changed', 'key_added', 'key_deleted', 'key_disabled', 'key_reactivated'];
+        const eventSource = new EventSource(`/admin/api/events?types=${types.join(',')}`);
+        const scheduleReload = () => {
+            // 合并短时间内的多个事件，只刷新一次
+            clearTimeout(this.keyReloadTimer);
+            this.keyReloadTimer = setTimeout(() => this.loadKeys(true), 500);
+        };
+        types.forEach(type => eventSource.addEventListener(type, scheduleReload));
+
+        this.keyEventSource = eventSource;
+    }
+
+    stopKeyEvents() {
+        clearTimeout(this.keyReloadTimer);
+        if (this.keyEventSource) {
+            this.keyEventSource.close();
+            this.keyEventSource = null;
+        }
     }
 
     setupKeysPageEvents() {
@@ -302,14 +353,17 @@ class AdminApp {
         });
     }
 
-    async loadKeys() {
+    // silent 为 true 时在后台刷新，不显示加载状态
+    async loadKeys(silent = false) {
         // 确保有认证token
         if (!this.adminToken) {
             console.log('No admin token available, cannot load keys');
             return;
         }
 
-        this.showKeysLoading(true);
+        if (!silent) {
+            this.showKeysLoading(true);
+        }
 
         try {
             const response = await fetch('/admin/api/keys', {
@@ -324,10 +378,14 @@ class AdminApp {
             this.renderKeysTable();
         } catch (error) {
             console.error('Error loading keys:', error);
-            this.showError('加载密钥失败: ' + error.message);
-            this.showKeysEmpty();
+            if (!silent) {
+                this.showError('加载密钥失败: ' + error.message);
+                this.showKeysEmpty();
+            }
         } finally {
-            this.showKeysLoading(false);
+            if (!silent) {
+                this.showKeysLoading(false);
+            }
         }
     }
 
@@ -410,7 +468,7 @@ class AdminApp {
                </div>`
             : `<div class="inline-flex items-center space-x-2 bg-red-50 border border-red-200 px-3 py-1.5 rounded-lg">
                  <div class="w-2 h-2 bg-red-500 rounded-full"></div>
-                 <span class="text-xs font-semibold text-red-700">DISABLED</span>
+                 <span class="text-xs font-semibold text-red-700">${(key.status || 'disabled').replace('_', '-').toUpperCase()}</span>
                </div>`;
 
         const disabledAt = key.disabled_at && key.disabled_at !== '0001-01-01T00:00:00Z'
@@ -419,14 +477,14 @@ class AdminApp {
 
         // Enhanced action buttons with better styling
         const actionButtons = isActive ? `
-            <button onclick="app.disableKey('${key.value}')"
+            <button onclick="app.disableKey('${key.id}')"
                     class="inline-flex items-center px-4 py-2 bg-orange-500 hover:bg-orange-600 text-white text-sm font-medium rounded-lg transition-colors shadow-sm">
                 <svg class="w-4 h-4 mr-2" fill="none" stroke="currentColor" viewBox="0 0 24 24">
                     <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M12 15v2m-6 4h12a2 2 0 002-2v-6a2 2 0 00-2-2H6a2 2 0 00-2 2v6a2 2 0 002 2zm10-10V7a4 4 0 00-8 0v4h8z"></path>
                 </svg>
                 禁用
             </button>
-            <button onclick="app.deleteKey('${key.value}')"
+            <button onclick="app.deleteKey('${key.id}')"
                     class="inline-flex items-center px-4 py-2 bg-red-500 hover:bg-red-600 text-white text-sm font-medium rounded-lg transition-colors shadow-sm">
                 <svg class="w-4 h-4 mr-2" fill="none" stroke="currentColor" viewBox="0 0 24 24">
                     <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M19 7l-.867 12.142A2 2 0 0116.138 21H7.862a2 2 0 01-1.995-1.858L5 7m5 4v6m4-6v6m1-10V4a1 1 0 00-1-1h-4a1 1 0 00-1 1v3M4 7h16"></path>
@@ -434,14 +492,14 @@ class AdminApp {
                 删除
             </button>
         ` : `
-            <button onclick="app.reactivateKey('${key.value}')"
+            <button onclick="app.reactivateKey('${key.id}')"
                     class="inline-flex items-center px-4 py-2 bg-green-500 hover:bg-green-600 text-white text-sm font-medium rounded-lg transition-colors shadow-sm">
                 <svg class="w-4 h-4 mr-2" fill="none" stroke="currentColor" viewBox="0 0 24 24">
                     <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M4 4v5h.582m15.356 2A8.001 8.001 0 004.582 9m0 0H9m11 11v-5h-.581m0 0a8.003 8.003 0 01-15.357-2m15.357 2H15"></path>
                 </svg>
                 重新激活
             </button>
-            <button onclick="app.deleteKey('${key.value}')"
+            <button onclick="app.deleteKey('${key.id}')"
                     class="inline-flex items-center px-4 py-2 bg-red-500 hover:bg-red-600 text-white text-sm font-medium rounded-lg transition-colors shadow-sm">
                 <svg class="w-4 h-4 mr-2" fill="none" stroke="currentColor" viewBox="0 0 24 24">
                     <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M19 7l-.867 12.142A2 2 0 0116.138 21H7.862a2 2 0 01-1.995-1.858L5 7m5 4v6m4-6v6m1-10V4a1 1 0 00-1-1h-4a1 1 0 00-1 1v3M4 7h16"></path>
@@ -464,9 +522,13 @@ class AdminApp {
                         <div class="absolute -top-1 -right-1 w-4 h-4 ${isActive ? 'bg-green-400' : 'bg-red-400'} rounded-full border-2 border-white ${isActive ? 'animate-pulse' : ''}"></div>
                     </div>
                     <div class="flex-1 min-w-0">
-                        <div class="text-sm font-mono font-bold text-gray-900 truncate mb-1">${key.value.substring(0, 20)}...</div>
-                        <div class="text-xs text-gray-500 font-medium">ModelScope API Key</div>
+                        <div class="text-sm font-mono font-bold text-gray-900 truncate mb-1">${key.value}</div>
+                        <div class="text-xs text-gray-500 font-medium">ModelScope API Key · <span class="font-mono">${key.fingerprint}</span></div>
                     </div>
+                    <button onclick="app.revealKey('${key.id}')" title="显示并复制完整密钥"
+                            class="inline-flex items-center px-3 py-1.5 bg-white hover:bg-gray-100 text-gray-700 text-xs font-medium rounded-lg border border-gray-200 transition-colors shadow-sm">
+                        显示
+                    </button>
                 </div>
 
                 <!-- Status Badge -->
@@ -581,7 +643,7 @@ class AdminApp {
         }
     }
 
-    async deleteKey(keyValue) {
+    async deleteKey(keyId) {
         // Create custom confirmation dialog
         const confirmed = await this.showConfirmDialog(
             '删除密钥',
@@ -593,13 +655,11 @@ class AdminApp {
         if (!confirmed) return;
 
         try {
-            const response = await fetch('/admin/api/keys', {
+            const response = await fetch(`/admin/api/keys/${encodeURIComponent(keyId)}`, {
                 method: 'DELETE',
                 headers: {
-                    'Authorization': `Bearer ${this.adminToken}`,
-                    'Content-Type': 'application/json'
-                },
-                body: JSON.stringify({ value: keyValue })
+                    'Authorization': `Bearer ${this.adminToken}`
+                }
             });
 
             if (!response.ok) {
@@ -615,15 +675,13 @@ class AdminApp {
         }
     }
 
-    async reactivateKey(keyValue) {
+    async reactivateKey(keyId) {
         try {
-            const response = await fetch('/admin/api/keys/reactivate', {
+            const response = await fetch(`/admin/api/keys/${encodeURIComponent(keyId)}/reactivate`, {
                 method: 'POST',
                 headers: {
-                    'Authorization': `Bearer ${this.adminToken}`,
-                    'Content-Type': 'application/json'
-                },
-                body: JSON.stringify({ value: keyValue })
+                    'Authorization': `Bearer ${this.adminToken}`
+                }
             });
 
             if (!response.ok) {
@@ -639,20 +697,20 @@ class AdminApp {
         }
     }
 
-    async disableKey(keyValue) {
+    async disableKey(keyId) {
         // 添加确认对话框
         if (!confirm('确定要禁用这个密钥吗？禁用后将无法使用此密钥进行API调用。')) {
             return;
         }
 
         try {
-            const response = await fetch('/admin/api/keys/disable', {
+            const response = await fetch(`/admin/api/keys/${encodeURIComponent(keyId)}/disable`, {
                 method: 'POST',
                 headers: {
                     'Authorization': `Bearer ${this.adminToken}`,
                     'Content-Type': 'application/json'
                 },
-                body: JSON.stringify({ value: keyValue })
+                body: JSON.stringify({})
             });
 
             if (!response.ok) {
@@ -668,6 +726,42 @@ class AdminApp {
         }
     }
 
+    // 显示完整密钥（每次调用都会记录到服务端审计日志）
+    async revealKey(keyId) {
+        const confirmed = await this.showConfirmDialog(
+            '显示完整密钥',
+            '完整密钥将被显示并复制到剪贴板，此操作会记录到审计日志。',
+            '显示'
+        );
+
+        if (!confirmed) return;
+
+        try {
+            const response = await fetch(`/admin/api/keys/${encodeURIComponent(keyId)}/reveal`, {
+                method: 'POST',
+                headers: {
+                    'Authorization': `Bearer ${this.adminToken}`
+                }
+            });
+
+            if (!response.ok) {
+                const errorData = await response.text();
+                throw new Error(errorData || 'Failed to reveal key');
+            }
+
+            const revealed = await response.json();
+            try {
+                await navigator.clipboard.writeText(revealed.value);
+                this.showSuccess('完整密钥已复制到剪贴板');
+            } catch (clipboardError) {
+                window.prompt('完整密钥', revealed.value);
+            }
+        } catch (error) {
+            console.error('Error revealing key:', error);
+            this.showError('显示密钥失败: ' + error.message);
+        }
+    }
+
     async showConfirmDialog(title, message, confirmText, type = 'primary') {
         return new Promise((resolve) => {
             // Create modal backdrop
@@ -1125,9 +1219,7 @@ class AdminApp {
     }
 
     startEventSourceTest(params) {
-        // Add admin token to URL parameters for EventSource authentication
-        params.set('token', this.adminToken);
-
+        // EventSource requests are authenticated by the admin session cookie
         // Create EventSource URL with parameters
         const url = `/admin/api/keys/test?${params.toString()}`;
 
@@ -1137,9 +1229,12 @@ class AdminApp {
         let testCount = 0;
         let totalKeys = 0;
 
-        // Get total keys count for progress calculation
+        // Get total keys count for progress calculation. Results only carry masked
+        // values, so custom keys are kept to map results back by their index.
+        this.testedCustomKeys = [];
         if (params.get('source') === 'custom' && params.get('keys')) {
-            totalKeys = params.get('keys').split(',').length;
+            this.testedCustomKeys = params.get('keys').split(',');
+            totalKeys = this.testedCustomKeys.length;
         }
 
         // Handle incoming messages
@@ -1180,28 +1275,29 @@ class AdminApp {
 
         // Store result
         this.testResults.push(result);
+        const keyLabel = this.testedCustomKeys?.[result.index] || result.key_value;
 
         if (result.status === 'success') {
-            this.validKeys.push(result.key_value);
+            this.validKeys.push(keyLabel);
             if (validCount) validCount.textContent = this.validKeys.length;
 
             // Add to valid keys textarea
             const validTextarea = document.getElementById('valid-keys-textarea');
             if (validTextarea) {
                 if (validTextarea.value) {
-                    validTextarea.value += '\n' + result.key_value;
+                    validTextarea.value += '\n' + keyLabel;
                 } else {
-                    validTextarea.value = result.key_value;
+                    validTextarea.value = keyLabel;
                 }
             }
         } else {
-            this.invalidKeys.push({key: result.key_value, error: result.error});
+            this.invalidKeys.push({key: keyLabel, id: result.key_id, error: result.error});
             if (invalidCount) invalidCount.textContent = this.invalidKeys.length;
 
             // Add to invalid keys textarea
             const invalidTextarea = document.getElementById('invalid-keys-textarea');
             if (invalidTextarea) {
-                const errorLine = `${result.key_value} - ${result.error || 'Unknown error'}`;
+                const errorLine = `${keyLabel} - ${result.error || 'Unknown error'}`;
                 if (invalidTextarea.value) {
                     invalidTextarea.value += '\n' + errorLine;
                 } else {
@@ -1497,13 +1593,11 @@ class AdminApp {
 
             for (const invalidKey of this.invalidKeys) {
                 try {
-                    const response = await fetch('/admin/api/keys', {
+                    const response = await fetch(`/admin/api/keys/${encodeURIComponent(invalidKey.id)}`, {
                         method: 'DELETE',
                         headers: {
-                            'Content-Type': 'application/json',
                             'Authorization': `Bearer ${this.adminToken}`
-                        },
-                        body: JSON.stringify({ value: invalidKey.key })
+                        }
                     });
 
                     if (response.ok) {
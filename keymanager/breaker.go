@@ -0,0 +1,208 @@
+package keymanager
+
+import (
+	"context"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/events"
+)
+
+// breakerPolicy controls how failing keys cool down and recover
+type breakerPolicy struct {
+	failureThreshold int           // Consecutive transient failures before a key starts cooling
+	baseCooldown     time.Duration // Cooldown after the first trip, doubled on every further trip
+	maxCooldown      time.Duration // Upper bound for the exponential backoff
+	probeTimeout     time.Duration // A half-open trial not reported within this time may be handed out again
+}
+
+// defaultBreakerPolicy is used until ConfigureBreaker is called
+var defaultBreakerPolicy = breakerPolicy{
+	failureThreshold: 3,
+	baseCooldown:     30 * time.Second,
+	maxCooldown:      30 * time.Minute,
+	probeTimeout:     2 * time.Minute,
+}
+
+// ConfigureBreaker applies the circuit breaker settings, keeping the defaults for
+// any value that is missing or invalid
+func (km *KeyManager) ConfigureBreaker(cfg config.CircuitBreakerSettings) {
+	policy := defaultBreakerPolicy
+
+	if cfg.FailureThreshold > 0 {
+		policy.failureThreshold = cfg.FailureThreshold
+	}
+	policy.baseCooldown = km.parseBreakerDuration("base_cooldown", cfg.BaseCooldown, policy.baseCooldown)
+	policy.maxCooldown = km.parseBreakerDuration("max_cooldown", cfg.MaxCooldown, policy.maxCooldown)
+	policy.probeTimeout = km.parseBreakerDuration("probe_timeout", cfg.ProbeTimeout, policy.probeTimeout)
+	if policy.maxCooldown < policy.baseCooldown {
+		policy.maxCooldown = policy.baseCooldown
+	}
+
+	km.mu.Lock()
+	km.breaker = policy
+	km.mu.Unlock()
+
+	km.logger.Info("Circuit breaker configured",
+		"failure_threshold", policy.failureThreshold,
+		"base_cooldown", policy.baseCooldown.String(),
+		"max_cooldown", policy.maxCooldown.String(),
+		"probe_timeout", policy.probeTimeout.String())
+}
+
+// parseBreakerDuration parses a duration setting, falling back to def when it is empty or invalid
+func (km *KeyManager) parseBreakerDuration(name, value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		km.logger.Warn("Invalid circuit breaker duration, using default", "setting", name, "value", value, "default", def.String())
+		return def
+	}
+	return d
+}
+
+// cooldownFor returns the exponential backoff for the given backoff level
+func (p breakerPolicy) cooldownFor(level int) time.Duration {
+	cooldown := p.baseCooldown
+	for i := 1; i < level && cooldown < p.maxCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > p.maxCooldown {
+		cooldown = p.maxCooldown
+	}
+	return cooldown
+}
+
+// probeEligible reports whether a cooling or half-open key may be handed out as
+// the single half-open trial request. The caller must hold the lock.
+func (km *KeyManager) probeEligible(key *ApiKey, now time.Time) bool {
+	switch key.Status {
+	case StatusCooling:
+		return !now.Before(key.CooldownUntil)
+	case StatusHalfOpen:
+		// Only one trial at a time, unless the previous one was never reported back
+		return key.probeStartedAt.IsZero() || now.Sub(key.probeStartedAt) >= km.breaker.probeTimeout
+	default:
+		return false
+	}
+}
+
+// startProbe marks a key as carrying the half-open trial request. The caller
+// must hold the write lock and have checked probeEligible.
+func (km *KeyManager) startProbe(key *ApiKey, now time.Time) {
+	if key.Status == StatusCooling {
+		key.Status = StatusHalfOpen
+		km.logger.Info("Key cooldown elapsed, sending half-open probe", "key_id", key.ID, "backoff_level", key.BackoffLevel)
+	}
+	key.probeStartedAt = now
+}
+
+// ReportFailure records a failed upstream request made with a key and applies the
+// consequence for its failure class: auth failures disable the key, quota failures
+// start a cooldown honoring retryAfter, transient failures start one after
+// repeated occurrences and client failures leave the key untouched. A failing
+// half-open probe sends the key back to cooling with a longer backoff.
+func (km *KeyManager) ReportFailure(ctx context.Context, keyValue string, class FailureClass, reason string, retryAfter time.Duration) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	for _, key := range km.keys {
+		if key.Value != keyValue {
+			continue
+		}
+
+		if class == FailureClient || class == FailureNone {
+			// The key is not at fault, but a half-open trial did not prove anything either
+			if key.Status == StatusHalfOpen {
+				key.probeStartedAt = time.Time{}
+			}
+			return
+		}
+
+		key.LastFailureReason = reason
+		key.LastFailureClass = class
+		key.LastFailureAt = time.Now()
+		key.ConsecutiveFailures++
+
+		// Manually or permanently disabled keys stay disabled
+		if key.Status == StatusDisabled {
+			return
+		}
+
+		from := key.Status
+		defer km.recordTransition(ctx, key, from, reason)
+
+		switch class {
+		case FailureAuth:
+			key.Status = StatusDisabled
+			key.DisabledAt = time.Now()
+			key.probeStartedAt = time.Time{}
+			km.logger.Warn("Key rejected by upstream, disabling", "key_id", key.ID, "reason", reason)
+			publishKeyEvent(events.KeyDisabled, key, reason, map[string]any{"trigger": "upstream", "failure_class": class, "from": from})
+		case FailureQuota:
+			km.trip(key, retryAfter)
+		case FailureTransient:
+			if key.Status == StatusHalfOpen || key.ConsecutiveFailures >= km.breaker.failureThreshold {
+				km.trip(key, 0)
+			}
+		}
+		return
+	}
+}
+
+// ReportSuccess records a successful upstream request made with a key. A
+// half-open key returns to active and its backoff is reset.
+func (km *KeyManager) ReportSuccess(ctx context.Context, keyValue string) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	for _, key := range km.keys {
+		if key.Value != keyValue {
+			continue
+		}
+
+		switch key.Status {
+		case StatusHalfOpen:
+			km.logger.Info("Half-open probe succeeded, key is active again", "key_id", key.ID, "backoff_level", key.BackoffLevel)
+			key.Status = StatusActive
+			key.resetBreaker()
+			km.recordTransition(ctx, key, StatusHalfOpen, "probe succeeded")
+		case StatusActive:
+			key.ConsecutiveFailures = 0
+			key.BackoffLevel = 0
+		}
+		// A late success from a request started before the key began cooling does not end the cooldown
+		return
+	}
+}
+
+// trip moves a key into the cooling state with exponential backoff, waiting at
+// least minCooldown. The caller must hold the write lock.
+func (km *KeyManager) trip(key *ApiKey, minCooldown time.Duration) {
+	key.BackoffLevel++
+	cooldown := km.breaker.cooldownFor(key.BackoffLevel)
+	if minCooldown > cooldown {
+		cooldown = minCooldown
+	}
+
+	key.Status = StatusCooling
+	key.CooldownUntil = time.Now().Add(cooldown)
+	key.probeStartedAt = time.Time{}
+
+	km.logger.Warn("Key cooling down",
+		"key_id", key.ID,
+		"failure_class", key.LastFailureClass,
+		"backoff_level", key.BackoffLevel,
+		"cooldown", cooldown.String())
+}
+
+// resetBreaker clears all circuit breaker state of a key
+func (key *ApiKey) resetBreaker() {
+	key.LastFailureClass = FailureNone
+	key.ConsecutiveFailures = 0
+	key.BackoffLevel = 0
+	key.CooldownUntil = time.Time{}
+	key.probeStartedAt = time.Time{}
+}
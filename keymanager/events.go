@@ -0,0 +1,39 @@
+package keymanager
+
+import (
+	"context"
+
+	"github.com/loseleaf/modelscope-balancer/events"
+)
+
+// Reactivation triggers reported with key_reactivated events and metrics
+const (
+	TriggerManual    = "manual"
+	TriggerKeyTest   = "key_test"
+	TriggerScheduler = "scheduler"
+)
+
+// publishKeyEvent publishes an event about a key. Publishing never blocks, so
+// it may be called with the lock held.
+func publishKeyEvent(t events.Type, key *ApiKey, reason string, data map[string]any) {
+	events.Publish(events.Event{
+		Type:        t,
+		Pool:        key.Pool,
+		KeyID:       key.ID,
+		Fingerprint: key.Fingerprint,
+		Reason:      reason,
+		Data:        data,
+	})
+}
+
+// recordTransition traces and publishes a status change of a key and marks the
+// state dirty, so that the next flush persists it. It does nothing when the
+// status did not change.
+func (km *KeyManager) recordTransition(ctx context.Context, key *ApiKey, from KeyStatus, reason string) {
+	if key.Status == from {
+		return
+	}
+	km.dirty.Store(true)
+	traceTransition(ctx, key, from, reason)
+	publishKeyEvent(events.KeyStateChanged, key, reason, map[string]any{"from": from, "to": key.Status, "backoff_level": key.BackoffLevel})
+}
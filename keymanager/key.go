@@ -1,6 +1,11 @@
 package keymanager
 
-import "time"
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
 
 // KeyStatus represents the status of an API key
 type KeyStatus string
@@ -9,13 +14,101 @@ type KeyStatus string
 const (
 	StatusActive   KeyStatus = "active"
 	StatusDisabled KeyStatus = "disabled"
+	StatusCooling  KeyStatus = "cooling"   // Temporarily skipped until CooldownUntil after repeated failures
+	StatusHalfOpen KeyStatus = "half_open" // Cooldown elapsed; a single trial request decides the key's fate
+)
+
+// FailureClass categorizes why an upstream request made with a key failed
+type FailureClass string
+
+// FailureClass constants
+const (
+	FailureNone      FailureClass = ""          // No failure recorded
+	FailureClient    FailureClass = "client"    // The caller's request was invalid; the key is not at fault
+	FailureAuth      FailureClass = "auth"      // The key was rejected (401/403) and is permanently disabled
+	FailureQuota     FailureClass = "quota"     // The key hit a rate or quota limit (429) and is cooling down
+	FailureTransient FailureClass = "transient" // Network or upstream server error; the request may be retried
 )
 
 // ApiKey represents a ModelScope API key with its metadata
 type ApiKey struct {
-	Value             string    `json:"value"` // The actual API key value
-	Status            KeyStatus `json:"status"`
-	DisabledAt        time.Time `json:"disabled_at"`
-	LastFailureReason string    `json:"last_failure_reason"` // Records the reason for last failure
-	Source            string    `json:"source"`              // "config" or "user" to track key source
+	ID                string       `json:"id"`          // Stable opaque identifier the admin API addresses the key by
+	Fingerprint       string       `json:"fingerprint"` // Short hash of the value, safe to show and log
+	Value             string       `json:"value"`       // The actual API key value
+	Status            KeyStatus    `json:"status"`
+	DisabledAt        time.Time    `json:"disabled_at"`
+	LastFailureReason string       `json:"last_failure_reason"` // Records the reason for last failure
+	LastFailureClass  FailureClass `json:"last_failure_class"`  // Category of the last failure
+	LastFailureAt     time.Time    `json:"last_failure_at"`
+	Source            string       `json:"source"` // "config" or "user" to track key source
+	Pool              string       `json:"pool"`   // Key pool (named after its upstream) the key serves
+	Weight            int          `json:"weight"` // Share of traffic under weighted round-robin, 0 counts as 1
+
+	// Circuit breaker state
+	ConsecutiveFailures int       `json:"consecutive_failures"` // Failures since the last successful request
+	BackoffLevel        int       `json:"backoff_level"`        // Number of consecutive cooldowns, drives exponential backoff
+	CooldownUntil       time.Time `json:"cooldown_until"`       // Next time a cooling key becomes eligible for a probe
+
+	// Daily quota usage
+	UsageCount       int64            `json:"usage_count"`           // Requests made in the current quota window
+	ModelUsage       map[string]int64 `json:"model_usage,omitempty"` // Requests per model in the current quota window
+	UsageWindowStart time.Time        `json:"usage_window_start"`    // Start of the quota window the counters belong to
+
+	probeStartedAt time.Time // When the current half-open trial request was handed out
+	inFlight       int       // Requests currently using this key
+}
+
+// effectiveWeight returns the weighted round-robin weight of a key, treating unset weights as 1
+func (key *ApiKey) effectiveWeight() int {
+	if key.Weight <= 0 {
+		return 1
+	}
+	return key.Weight
+}
+
+// snapshot returns a copy of the key that shares no mutable state with the original
+func (key *ApiKey) snapshot() *ApiKey {
+	copied := *key
+	if key.ModelUsage != nil {
+		copied.ModelUsage = make(map[string]int64, len(key.ModelUsage))
+		for model, count := range key.ModelUsage {
+			copied.ModelUsage[model] = count
+		}
+	}
+	return &copied
+}
+
+// newApiKey creates an active key of a pool with a fresh ID
+func newApiKey(value, source, pool string) *ApiKey {
+	return &ApiKey{
+		ID:          newKeyID(),
+		Fingerprint: Fingerprint(value),
+		Value:       value,
+		Status:      StatusActive,
+		Source:      source,
+		Pool:        pool,
+	}
+}
+
+// newKeyID returns a random key ID
+func newKeyID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic("keymanager: failed to generate key ID: " + err.Error())
+	}
+	return "key_" + hex.EncodeToString(b)
+}
+
+// MaskKey returns a form of a key value that is safe to show in logs and metrics
+func MaskKey(value string) string {
+	if len(value) <= 8 {
+		return "****"
+	}
+	return value[:4] + "****" + value[len(value)-4:]
+}
+
+// Fingerprint returns a short stable identifier of a key value that does not reveal it
+func Fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:6])
 }
@@ -1,70 +1,193 @@
 package keymanager
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"log/slog"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/loseleaf/modelscope-balancer/envelope"
+	"github.com/loseleaf/modelscope-balancer/events"
 )
 
-// KeyManager manages a pool of API keys with thread-safe operations
+// PoolKeys lists the configured API keys of one key pool
+type PoolKeys struct {
+	Pool string
+	Keys []string
+}
+
+// KeyManager manages pools of API keys with thread-safe operations
 type KeyManager struct {
-	mu            sync.RWMutex // Protects concurrent access to the keys slice
-	keys          []*ApiKey    // Stores all API key objects
-	currentIndex  atomic.Int64 // Used for efficient round-robin selection
-	logger        *slog.Logger // Logger for key management operations
-	stateFilePath string       // Path to the state file for persistence
+	mu        sync.RWMutex    // Protects concurrent access to the keys slice
+	saveMu    sync.Mutex      // Serializes writes to the state store
+	keys      []*ApiKey       // Stores all API key objects
+	pools     []string        // Known pool names, the first one is the default pool
+	selector  Selector        // Strategy choosing among the eligible keys
+	logger    *slog.Logger    // Logger for key management operations
+	store     Store           // Persistence backend of the key state
+	breaker   breakerPolicy   // Cooldown and half-open settings for failing keys
+	quota     quotaPolicy     // Daily request quota applied to every key
+	dirty     atomic.Bool     // Set when usage counters, key statuses or new key IDs were not saved yet
+	exhausted map[string]bool // Pools that had no key to hand out at their last request
+
+	masterKey []byte            // Master key wrapping the data key, nil without state encryption
+	keyring   *envelope.Keyring // Data key encrypting key values in the state file, nil without encryption
 }
 
-// New creates a new KeyManager instance with the provided API keys and state file path
-func New(apiKeys []string, stateFilePath string, logger *slog.Logger) *KeyManager {
+// New creates a new KeyManager instance with the provided key pools and state store.
+// The first pool is the default pool.
+func New(pools []PoolKeys, store Store, logger *slog.Logger) *KeyManager {
 	km := &KeyManager{
-		keys:          make([]*ApiKey, 0, len(apiKeys)),
-		logger:        logger,
-		stateFilePath: stateFilePath,
+		keys:      make([]*ApiKey, 0),
+		logger:    logger,
+		store:     store,
+		selector:  &roundRobinSelector{},
+		exhausted: make(map[string]bool),
+		breaker:   defaultBreakerPolicy,
+		quota:     defaultQuotaPolicy,
 	}
 
 	// Initialize each API key from the provided strings
-	for _, keyValue := range apiKeys {
-		apiKey := &ApiKey{
-			Value:  keyValue,     // Store the actual API key value
-			Status: StatusActive, // Set initial status to active
-			Source: "config",     // Mark as config-sourced key
+	seen := make(map[string]bool)
+	for _, pool := range pools {
+		km.pools = append(km.pools, pool.Pool)
+		for _, keyValue := range pool.Keys {
+			// Keys are addressed by value, so each key may only belong to one pool
+			if seen[keyValue] {
+				logger.Warn("Ignoring duplicate API key in configuration", "pool", pool.Pool)
+				continue
+			}
+			seen[keyValue] = true
+
+			// Config keys get their IDs from the state file in LoadState if they were saved before
+			km.keys = append(km.keys, newApiKey(keyValue, "config", pool.Pool))
 		}
-		km.keys = append(km.keys, apiKey)
 	}
 
 	return km
 }
 
-// GetNextActiveKey returns the next active API key using round-robin selection
-// This is the core of load balancing functionality
-func (km *KeyManager) GetNextActiveKey() *ApiKey {
+// DefaultPool returns the name of the default key pool
+func (km *KeyManager) DefaultPool() string {
+	if len(km.pools) == 0 {
+		return ""
+	}
+	return km.pools[0]
+}
+
+// HasPool reports whether a key pool with the given name exists
+func (km *KeyManager) HasPool(pool string) bool {
+	for _, name := range km.pools {
+		if name == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// Pools returns the names of all key pools
+func (km *KeyManager) Pools() []string {
+	return append([]string(nil), km.pools...)
+}
+
+// CountKeys returns the number of keys in a pool regardless of their status. An empty pool selects the default pool.
+func (km *KeyManager) CountKeys(pool string) int {
+	pool = km.resolvePool(pool)
+
 	km.mu.RLock()
 	defer km.mu.RUnlock()
 
-	// Return nil if no keys are available
-	if len(km.keys) == 0 {
+	count := 0
+	for _, key := range km.keys {
+		if key.Pool == pool {
+			count++
+		}
+	}
+	return count
+}
+
+// resolvePool maps an empty pool name to the default pool
+func (km *KeyManager) resolvePool(pool string) string {
+	if pool == "" {
+		return km.DefaultPool()
+	}
+	return pool
+}
+
+// GetNextActiveKey returns the next active API key chosen by the configured selection strategy
+// This is the core of load balancing functionality. Keys that used up their daily
+// quota are skipped, and a cooling key whose cooldown has elapsed is handed out as
+// a half-open probe to a single caller at a time. Callers must hand the key back
+// with ReleaseKey once their request has finished. An empty pool selects the default pool.
+func (km *KeyManager) GetNextActiveKey(ctx context.Context, pool string) *ApiKey {
+	pool = km.resolvePool(pool)
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	// Collect the keys of the pool that may serve a request right now
+	now := time.Now()
+	candidates := make([]*ApiKey, 0, len(km.keys))
+	for _, key := range km.keys {
+		if key.Pool != pool {
+			continue
+		}
+		// Skip keys without remaining daily quota
+		if km.quotaExhausted(key, now) {
+			continue
+		}
+		if key.Status == StatusActive || km.probeEligible(key, now) {
+			candidates = append(candidates, key)
+		}
+	}
+
+	// No active keys found; announce it once until the pool recovers
+	if len(candidates) == 0 {
+		if !km.exhausted[pool] {
+			km.exhausted[pool] = true
+			km.logger.Warn("No key of the pool is available", "pool", pool)
+			events.Publish(events.Event{Type: events.PoolExhausted, Pool: pool, Data: map[string]any{"keys": km.countPoolKeys(pool)}})
+		}
 		return nil
 	}
+	delete(km.exhausted, pool)
 
-	// Loop at most twice the length of the list to ensure we exit if all keys are disabled
-	maxAttempts := len(km.keys) * 2
-	for i := 0; i < maxAttempts; i++ {
-		// Atomically increment and get the current index
-		index := km.currentIndex.Add(1) % int64(len(km.keys))
-		key := km.keys[index]
+	key := km.selector.Select(candidates)
+	if key.Status != StatusActive {
+		from := key.Status
+		km.startProbe(key, now)
+		km.recordTransition(ctx, key, from, "cooldown elapsed")
+	}
+	key.inFlight++
+	return key
+}
 
-		// Return the key if it's active
-		if key.Status == StatusActive {
-			return key
+// countPoolKeys returns the number of keys in a pool. The caller must hold the lock.
+func (km *KeyManager) countPoolKeys(pool string) int {
+	count := 0
+	for _, key := range km.keys {
+		if key.Pool == pool {
+			count++
 		}
 	}
+	return count
+}
 
-	// No active keys found
-	return nil
+// ReleaseKey marks a request made with a key obtained from GetNextActiveKey as finished
+func (km *KeyManager) ReleaseKey(keyValue string) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	for _, key := range km.keys {
+		if key.Value == keyValue {
+			if key.inFlight > 0 {
+				key.inFlight--
+			}
+			return
+		}
+	}
 }
 
 // DisableKey disables a key by value and records the failure reason
@@ -75,9 +198,15 @@ func (km *KeyManager) DisableKey(keyValue string, reason string) {
 	// Find the key by value and disable it
 	for _, key := range km.keys {
 		if key.Value == keyValue {
+			from := key.Status
 			key.Status = StatusDisabled
 			key.DisabledAt = time.Now()
 			key.LastFailureReason = reason
+			key.probeStartedAt = time.Time{}
+			if from != StatusDisabled {
+				publishKeyEvent(events.KeyDisabled, key, reason, map[string]any{"trigger": TriggerManual, "from": from})
+			}
+			km.recordTransition(context.Background(), key, from, reason)
 			return
 		}
 	}
@@ -88,13 +217,28 @@ func (km *KeyManager) ListKeys() []*ApiKey {
 	km.mu.RLock()
 	defer km.mu.RUnlock()
 
-	// Return a copy of the slice to prevent external modification
+	// Return snapshots of the keys so callers never observe concurrent state changes
 	keysCopy := make([]*ApiKey, len(km.keys))
-	copy(keysCopy, km.keys)
+	for i, key := range km.keys {
+		keysCopy[i] = key.snapshot()
+	}
 	return keysCopy
 }
 
 // FindKeyByID finds a key by its ID and returns it along with a boolean indicating if found
+func (km *KeyManager) FindKeyByID(id string) (*ApiKey, bool) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	for _, key := range km.keys {
+		if key.ID == id {
+			return key.snapshot(), true
+		}
+	}
+	return nil, false
+}
+
+// FindKeyByValue finds a key by its value and returns it along with a boolean indicating if found
 func (km *KeyManager) FindKeyByValue(keyValue string) (*ApiKey, bool) {
 	km.mu.RLock()
 	defer km.mu.RUnlock()
@@ -102,22 +246,29 @@ func (km *KeyManager) FindKeyByValue(keyValue string) (*ApiKey, bool) {
 	// Search for the key by value
 	for _, key := range km.keys {
 		if key.Value == keyValue {
-			return key, true
+			return key.snapshot(), true
 		}
 	}
 	return nil, false
 }
 
-// ReactivateKey reactivates a disabled key by value
-func (km *KeyManager) ReactivateKey(keyValue string) {
+// ReactivateKey reactivates a disabled or cooling key by value. trigger tells
+// who reactivated it, TriggerManual or TriggerKeyTest.
+func (km *KeyManager) ReactivateKey(keyValue string, trigger string) {
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
 	// Find the key by value and reactivate it
 	for _, key := range km.keys {
 		if key.Value == keyValue {
+			from := key.Status
 			key.Status = StatusActive
 			key.LastFailureReason = "" // Clear the failure reason
+			key.resetBreaker()
+			if from != StatusActive {
+				publishKeyEvent(events.KeyReactivated, key, "", map[string]any{"trigger": trigger, "from": from})
+			}
+			km.recordTransition(context.Background(), key, from, "reactivated by "+trigger)
 			return
 		}
 	}
@@ -138,23 +289,20 @@ func (km *KeyManager) IsKeyDisabled(keyValue string) bool {
 	return false
 }
 
-// AddKey adds a new API key to the manager and returns the created key
-func (km *KeyManager) AddKey(keyValue string) *ApiKey {
+// AddKey adds a new API key to a pool and returns the created key. An empty pool selects the default pool.
+func (km *KeyManager) AddKey(keyValue string, pool string) *ApiKey {
+	pool = km.resolvePool(pool)
+
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
-	// Create new API key
-	apiKey := &ApiKey{
-		Value:  keyValue,     // Store the actual API key value
-		Status: StatusActive, // Set initial status to active
-		Source: "user",       // Mark as user-added key
-	}
-
-	// Add to the keys slice
+	// Create new API key and add it to the keys slice
+	apiKey := newApiKey(keyValue, "user", pool)
 	km.keys = append(km.keys, apiKey)
+	publishKeyEvent(events.KeyAdded, apiKey, "", nil)
 
-	km.logger.Info("Added new API key", "key_value", keyValue)
-	return apiKey
+	km.logger.Info("Added new API key", "key_id", apiKey.ID, "fingerprint", apiKey.Fingerprint, "pool", pool)
+	return apiKey.snapshot()
 }
 
 // DeleteKey removes an API key from the manager by value
@@ -167,17 +315,21 @@ func (km *KeyManager) DeleteKey(keyValue string) bool {
 		if key.Value == keyValue {
 			// Remove the key from the slice
 			km.keys = append(km.keys[:i], km.keys[i+1:]...)
-			km.logger.Info("Deleted API key", "key_value", keyValue)
+			if f, ok := km.selector.(keyForgetter); ok {
+				f.forget(key)
+			}
+			km.logger.Info("Deleted API key", "key_id", key.ID)
+			publishKeyEvent(events.KeyDeleted, key, "", nil)
 			return true
 		}
 	}
 
-	km.logger.Warn("Attempted to delete non-existent key", "key_value", keyValue)
+	km.logger.Warn("Attempted to delete non-existent key", "key", MaskKey(keyValue))
 	return false
 }
 
 // ReactivateDisabledKeys automatically reactivates keys that have been disabled for longer than the threshold
-func (km *KeyManager) ReactivateDisabledKeys(threshold time.Duration) {
+func (km *KeyManager) ReactivateDisabledKeys(threshold time.Duration) int {
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
@@ -190,12 +342,15 @@ func (km *KeyManager) ReactivateDisabledKeys(threshold time.Duration) {
 			// Reactivate the key
 			key.Status = StatusActive
 			key.LastFailureReason = "" // Clear the failure reason
+			key.resetBreaker()
 			reactivatedCount++
 
 			// Log the reactivation
 			km.logger.Info("Automatically reactivated disabled key",
-				"key_value", key.Value,
+				"key_id", key.ID,
 				"disabled_duration", time.Since(key.DisabledAt).String())
+			publishKeyEvent(events.KeyReactivated, key, "", map[string]any{"trigger": TriggerScheduler, "from": StatusDisabled})
+			km.recordTransition(context.Background(), key, StatusDisabled, "reactivated by "+TriggerScheduler)
 		}
 	}
 
@@ -205,11 +360,12 @@ func (km *KeyManager) ReactivateDisabledKeys(threshold time.Duration) {
 			"reactivated_count", reactivatedCount,
 			"threshold", threshold.String())
 	}
+	return reactivatedCount
 }
 
-// ReactivateAllDisabledKeys reactivates all disabled keys unconditionally
+// ReactivateAllDisabledKeys reactivates all disabled keys unconditionally and returns how many were reactivated
 // This is used for scheduled reactivation tasks
-func (km *KeyManager) ReactivateAllDisabledKeys() {
+func (km *KeyManager) ReactivateAllDisabledKeys() int {
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
@@ -222,83 +378,209 @@ func (km *KeyManager) ReactivateAllDisabledKeys() {
 			// Reactivate the key
 			key.Status = StatusActive
 			key.LastFailureReason = "" // Clear the failure reason
+			key.resetBreaker()
 			reactivatedCount++
 
 			// Log the reactivation
 			km.logger.Info("Scheduled reactivation of disabled key",
-				"key_value", key.Value,
+				"key_id", key.ID,
 				"disabled_duration", time.Since(key.DisabledAt).String())
+			publishKeyEvent(events.KeyReactivated, key, "", map[string]any{"trigger": TriggerScheduler, "from": StatusDisabled})
+			km.recordTransition(context.Background(), key, StatusDisabled, "reactivated by "+TriggerScheduler)
 		}
 	}
 
 	// Log summary
 	km.logger.Info("Scheduled key reactivation completed",
 		"reactivated_count", reactivatedCount)
+	return reactivatedCount
 }
 
-// SaveState saves the current state of user-added keys to the state file
+// SaveState saves user-added keys and the runtime state of config keys to the state store
 func (km *KeyManager) SaveState() error {
-	// Get a read lock since we only need to read the keys slice
-	km.mu.RLock()
-	defer km.mu.RUnlock()
+	// Serialize saves so that an older snapshot never replaces a newer one
+	km.saveMu.Lock()
+	defer km.saveMu.Unlock()
 
-	// Filter only user-added keys for persistence
-	var userKeys []*ApiKey
+	// Copy the keys under the read lock only; encrypting and writing them must not hold up requests
+	km.mu.RLock()
+	// Persist user-added keys completely; config keys are stored without their values for their status and counters
+	stateKeys := make([]*ApiKey, 0, len(km.keys))
+	userKeysCount := 0
 	for _, key := range km.keys {
 		if key.Source == "user" {
-			userKeys = append(userKeys, key)
+			userKeysCount++
 		}
+		stateKeys = append(stateKeys, key.snapshot())
 	}
+	keyring := km.keyring
+
+	// Clear the dirty flag before releasing the lock so that later changes mark it again
+	km.dirty.Store(false)
+	km.mu.RUnlock()
 
-	// Serialize only user-added keys to JSON with indentation for readability
-	jsonData, err := json.MarshalIndent(userKeys, "", "  ")
+	// Encrypt the key values when a master key is set
+	state, err := newState(stateKeys, keyring)
 	if err != nil {
-		km.logger.Error("Failed to marshal user keys to JSON", "error", err)
+		km.dirty.Store(true)
+		km.logger.Error("Failed to encrypt key values", "error", err)
 		return err
 	}
 
-	// Write the JSON data to the state file
-	err = os.WriteFile(km.stateFilePath, jsonData, 0644)
-	if err != nil {
-		km.logger.Error("Failed to write state file", "path", km.stateFilePath, "error", err)
+	// Replace the saved state
+	if err := km.store.Save(state); err != nil {
+		km.dirty.Store(true)
+		km.logger.Error("Failed to write state", "store", km.store.String(), "error", err)
 		return err
 	}
 
-	km.logger.Info("State saved successfully", "path", km.stateFilePath, "user_keys_count", len(userKeys))
+	km.logger.Info("State saved successfully", "store", km.store.String(), "user_keys_count", userKeysCount, "encrypted", keyring != nil)
 	return nil
 }
 
-// LoadState loads user-added keys from the state file and appends them to existing config keys
-func (km *KeyManager) LoadState() error {
-	// Check if the state file exists
-	if _, err := os.Stat(km.stateFilePath); os.IsNotExist(err) {
-		// File doesn't exist, this is the first run - return nil
-		km.logger.Info("State file does not exist, starting with fresh state", "path", km.stateFilePath)
+// SaveStateIfDirty saves the state only when usage counters or key statuses
+// changed or key IDs were generated since the last save
+func (km *KeyManager) SaveStateIfDirty() error {
+	if !km.dirty.Load() {
 		return nil
 	}
+	return km.SaveState()
+}
 
-	// Read the state file
-	jsonData, err := os.ReadFile(km.stateFilePath)
+// LoadState loads user-added keys from the state store and appends them to existing config keys.
+// The status, failure details, breaker state, usage counters and weights stored for config keys are
+// restored onto the configured keys with the same fingerprint; entries of keys removed from the
+// configuration are dropped with the next save.
+// An encrypted state is decrypted with the master key given to SetMasterKey; without
+// it, or with another master key, LoadState fails with ErrStateLocked.
+func (km *KeyManager) LoadState() error {
+	// Read the saved state
+	state, err := km.store.Load()
 	if err != nil {
-		km.logger.Error("Failed to read state file", "path", km.stateFilePath, "error", err)
+		km.logger.Error("Failed to read state", "store", km.store.String(), "error", err)
 		return err
 	}
+	if state == nil {
+		// Nothing saved yet, this is the first run; save the generated key IDs with the next flush
+		km.logger.Info("No saved state, starting with fresh state", "store", km.store.String())
+		km.dirty.Store(true)
+		return nil
+	}
 
 	// Get a write lock since we're going to modify the keys slice
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
-	// Unmarshal the JSON data into a temporary slice (these are user-added keys)
-	var userKeys []*ApiKey
-	err = json.Unmarshal(jsonData, &userKeys)
+	// Adopt the data key of an encrypted state; a plain state is encrypted with the next save
+	switch {
+	case state.Encryption != nil && km.masterKey == nil:
+		return fmt.Errorf("%w and no master key was supplied (set %s, %s or encryption.master_key_file)", ErrStateLocked, envelope.MasterKeyEnv, envelope.MasterKeyFileEnv)
+	case state.Encryption != nil:
+		keyring, err := envelope.Open(km.masterKey, *state.Encryption)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrStateLocked, err)
+		}
+		km.keyring = keyring
+	case km.keyring != nil:
+		km.logger.Warn("State is not encrypted yet, encrypting it with the next save", "store", km.store.String())
+		km.dirty.Store(true)
+	}
+
+	stateKeys, err := state.decryptKeys(km.keyring)
 	if err != nil {
-		km.logger.Error("Failed to unmarshal state file", "path", km.stateFilePath, "error", err)
 		return err
 	}
 
+	configKeys := make(map[string]*ApiKey, len(km.keys))
+	for _, key := range km.keys {
+		configKeys[key.Fingerprint] = key
+	}
+
+	var userKeys []*ApiKey
+	restored := make(map[*ApiKey]bool)
+	dropped := 0
+	for _, stateKey := range stateKeys {
+		// Config keys are saved without their values; keys saved before keys had IDs get new ones
+		if stateKey.Value != "" {
+			stateKey.Fingerprint = Fingerprint(stateKey.Value)
+		}
+		if stateKey.ID == "" {
+			stateKey.ID = newKeyID()
+			km.dirty.Store(true)
+		}
+
+		if stateKey.Source != "config" {
+			// A user key that was added to the configuration since is now a config key
+			if key, ok := configKeys[stateKey.Fingerprint]; ok {
+				if !restored[key] {
+					key.restoreFrom(stateKey)
+					restored[key] = true
+				}
+				km.dirty.Store(true)
+				continue
+			}
+
+			// Keys saved before pools existed belong to the default pool; keys of removed pools fall back to it as well
+			if stateKey.Pool == "" || !km.HasPool(stateKey.Pool) {
+				stateKey.Pool = km.DefaultPool()
+			}
+			userKeys = append(userKeys, stateKey)
+			continue
+		}
+
+		// Restore the runtime state of config keys that are still configured
+		key, ok := configKeys[stateKey.Fingerprint]
+		if !ok || restored[key] {
+			dropped++
+			continue
+		}
+		key.restoreFrom(stateKey)
+		restored[key] = true
+	}
+
+	// Config keys added since the last save keep their generated IDs once saved,
+	// and entries of removed config keys disappear with it
+	if len(restored) < len(km.keys) || dropped > 0 {
+		km.dirty.Store(true)
+	}
+	if dropped > 0 {
+		km.logger.Info("Dropping saved state of keys removed from configuration", "count", dropped)
+	}
+	for key := range restored {
+		if key.Status != StatusActive {
+			km.logger.Info("Restored status of config key", "key_id", key.ID, "status", key.Status, "reason", key.LastFailureReason)
+		}
+	}
+
 	// Append user-added keys to the existing config keys
 	km.keys = append(km.keys, userKeys...)
 
-	km.logger.Info("State loaded successfully", "path", km.stateFilePath, "user_keys_count", len(userKeys), "total_keys_count", len(km.keys))
+	km.logger.Info("State loaded successfully", "store", km.store.String(), "user_keys_count", len(userKeys), "total_keys_count", len(km.keys))
 	return nil
 }
+
+// restoreFrom copies the saved runtime state of a key onto a configured key.
+// The value, source and pool stay as configured.
+func (key *ApiKey) restoreFrom(saved *ApiKey) {
+	key.ID = saved.ID
+	if saved.Status != "" {
+		key.Status = saved.Status
+	}
+	key.DisabledAt = saved.DisabledAt
+	key.LastFailureReason = saved.LastFailureReason
+	key.LastFailureClass = saved.LastFailureClass
+	key.LastFailureAt = saved.LastFailureAt
+	key.Weight = saved.Weight
+	key.ConsecutiveFailures = saved.ConsecutiveFailures
+	key.BackoffLevel = saved.BackoffLevel
+	key.CooldownUntil = saved.CooldownUntil
+	key.UsageCount = saved.UsageCount
+	key.ModelUsage = saved.ModelUsage
+	key.UsageWindowStart = saved.UsageWindowStart
+
+	// The half-open trial in flight before the restart never reports back; its
+	// cooldown has elapsed, so the next request sends a fresh probe
+	if key.Status == StatusHalfOpen {
+		key.Status = StatusCooling
+	}
+}
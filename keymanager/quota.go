@@ -0,0 +1,150 @@
+package keymanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/events"
+)
+
+// quotaPolicy describes the daily call quota applied to every key
+type quotaPolicy struct {
+	dailyLimit  int64          // Maximum requests per key and day, 0 for unlimited
+	resetHour   int            // Hour of day at which the quota window starts
+	resetMinute int            // Minute of the hour at which the quota window starts
+	location    *time.Location // Timezone the reset time is expressed in
+}
+
+// defaultQuotaPolicy is used until ConfigureQuota is called
+var defaultQuotaPolicy = quotaPolicy{location: time.Local}
+
+// ConfigureQuota applies the daily quota settings. An invalid reset time or
+// timezone falls back to midnight local time.
+func (km *KeyManager) ConfigureQuota(cfg config.QuotaSettings) {
+	policy := defaultQuotaPolicy
+	if cfg.DailyLimit > 0 {
+		policy.dailyLimit = cfg.DailyLimit
+	}
+
+	if cfg.ResetTime != "" {
+		if _, err := fmt.Sscanf(cfg.ResetTime, "%d:%d", &policy.resetHour, &policy.resetMinute); err != nil ||
+			policy.resetHour < 0 || policy.resetHour > 23 || policy.resetMinute < 0 || policy.resetMinute > 59 {
+			km.logger.Warn("Invalid quota reset time, using midnight", "reset_time", cfg.ResetTime)
+			policy.resetHour, policy.resetMinute = 0, 0
+		}
+	}
+
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			km.logger.Warn("Invalid quota timezone, using local time", "timezone", cfg.Timezone, "error", err)
+		} else {
+			policy.location = loc
+		}
+	}
+
+	km.mu.Lock()
+	km.quota = policy
+	km.mu.Unlock()
+
+	km.logger.Info("Daily quota configured",
+		"daily_limit", policy.dailyLimit,
+		"reset_time", fmt.Sprintf("%02d:%02d", policy.resetHour, policy.resetMinute),
+		"timezone", policy.location.String())
+}
+
+// windowStart returns the start of the quota window that contains now
+func (p quotaPolicy) windowStart(now time.Time) time.Time {
+	local := now.In(p.location)
+	start := time.Date(local.Year(), local.Month(), local.Day(), p.resetHour, p.resetMinute, 0, 0, p.location)
+	if local.Before(start) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// rollQuotaWindow resets the usage counters of a key when a new quota window has
+// started. The caller must hold the write lock.
+func (km *KeyManager) rollQuotaWindow(key *ApiKey, now time.Time) {
+	start := km.quota.windowStart(now)
+	if key.UsageWindowStart.Before(start) {
+		key.UsageCount = 0
+		key.ModelUsage = nil
+		key.UsageWindowStart = start
+	}
+}
+
+// quotaExhausted reports whether a key has used up its daily quota. The caller
+// must hold the write lock.
+func (km *KeyManager) quotaExhausted(key *ApiKey, now time.Time) bool {
+	if km.quota.dailyLimit <= 0 {
+		return false
+	}
+	km.rollQuotaWindow(key, now)
+	return key.UsageCount >= km.quota.dailyLimit
+}
+
+// RecordUsage counts one request made with a key against its daily quota and
+// the per-model counters
+func (km *KeyManager) RecordUsage(keyValue string, model string) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	for _, key := range km.keys {
+		if key.Value != keyValue {
+			continue
+		}
+
+		km.rollQuotaWindow(key, time.Now())
+		key.UsageCount++
+		if model != "" {
+			if key.ModelUsage == nil {
+				key.ModelUsage = make(map[string]int64)
+			}
+			key.ModelUsage[model]++
+		}
+		km.dirty.Store(true)
+
+		if km.quota.dailyLimit > 0 && key.UsageCount == km.quota.dailyLimit {
+			km.logger.Warn("Key reached its daily quota", "key_id", key.ID, "daily_limit", km.quota.dailyLimit)
+			publishKeyEvent(events.QuotaExhausted, key, "", map[string]any{"daily_limit": km.quota.dailyLimit})
+		}
+		return
+	}
+}
+
+// DailyLimit returns the configured daily request limit per key, 0 for unlimited
+func (km *KeyManager) DailyLimit() int64 {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return km.quota.dailyLimit
+}
+
+// RemainingQuota returns how many requests a key may still make in the current
+// quota window, or -1 when no daily limit is configured
+func (km *KeyManager) RemainingQuota(key *ApiKey) int64 {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	if km.quota.dailyLimit <= 0 {
+		return -1
+	}
+
+	// A snapshot taken before the window rolled over still carries yesterday's usage
+	used := key.UsageCount
+	if key.UsageWindowStart.Before(km.quota.windowStart(time.Now())) {
+		used = 0
+	}
+	if used >= km.quota.dailyLimit {
+		return 0
+	}
+	return km.quota.dailyLimit - used
+}
+
+// QuotaWindowStart returns the start of the daily quota window that contains t
+func (km *KeyManager) QuotaWindowStart(t time.Time) time.Time {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return km.quota.windowStart(t)
+}
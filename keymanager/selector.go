@@ -0,0 +1,175 @@
+package keymanager
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// Key selection strategy names accepted in configuration
+const (
+	StrategyRoundRobin          = "round_robin"
+	StrategyWeightedRoundRobin  = "weighted_round_robin"
+	StrategyLeastInFlight       = "least_in_flight"
+	StrategyLeastRecentlyFailed = "least_recently_failed"
+	StrategyRandom              = "random"
+	StrategyMostRemainingQuota  = "most_remaining_quota"
+)
+
+// Strategies lists all supported key selection strategies
+var Strategies = []string{
+	StrategyRoundRobin,
+	StrategyWeightedRoundRobin,
+	StrategyLeastInFlight,
+	StrategyLeastRecentlyFailed,
+	StrategyRandom,
+	StrategyMostRemainingQuota,
+}
+
+// Selector picks the key to use for the next request among the eligible candidates.
+// Select is always called with the KeyManager write lock held and a non-empty slice.
+type Selector interface {
+	Name() string
+	Select(candidates []*ApiKey) *ApiKey
+}
+
+// keyForgetter is implemented by selectors that keep state per key, which is
+// dropped when the key is deleted
+type keyForgetter interface {
+	forget(key *ApiKey)
+}
+
+// NewSelector creates the selector for the named strategy
+func NewSelector(strategy string) (Selector, error) {
+	switch strategy {
+	case StrategyRoundRobin, "":
+		return &roundRobinSelector{}, nil
+	case StrategyWeightedRoundRobin:
+		return &weightedRoundRobinSelector{current: make(map[string]int)}, nil
+	case StrategyLeastInFlight:
+		return &minSelector{name: StrategyLeastInFlight, less: func(a, b *ApiKey) bool {
+			return a.inFlight < b.inFlight
+		}}, nil
+	case StrategyLeastRecentlyFailed:
+		return &minSelector{name: StrategyLeastRecentlyFailed, less: func(a, b *ApiKey) bool {
+			return a.LastFailureAt.Before(b.LastFailureAt)
+		}}, nil
+	case StrategyRandom:
+		return randomSelector{}, nil
+	case StrategyMostRemainingQuota:
+		// Every key shares the same daily limit, so the least used key has the most quota left
+		return &minSelector{name: StrategyMostRemainingQuota, less: func(a, b *ApiKey) bool {
+			return a.UsageCount < b.UsageCount
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown key selection strategy %q", strategy)
+	}
+}
+
+// roundRobinSelector cycles through the candidates in order
+type roundRobinSelector struct {
+	next atomic.Uint64
+}
+
+func (s *roundRobinSelector) Name() string { return StrategyRoundRobin }
+
+func (s *roundRobinSelector) Select(candidates []*ApiKey) *ApiKey {
+	index := (s.next.Add(1) - 1) % uint64(len(candidates))
+	return candidates[index]
+}
+
+// weightedRoundRobinSelector implements smooth weighted round-robin: every key
+// gains its weight on each pick, the key with the highest running total wins and
+// pays back the total weight. Keys are interleaved instead of picked in bursts.
+type weightedRoundRobinSelector struct {
+	current map[string]int // Running totals by key value
+}
+
+func (s *weightedRoundRobinSelector) Name() string { return StrategyWeightedRoundRobin }
+
+func (s *weightedRoundRobinSelector) Select(candidates []*ApiKey) *ApiKey {
+	var best *ApiKey
+	total := 0
+	for _, key := range candidates {
+		weight := key.effectiveWeight()
+		total += weight
+		s.current[key.Value] += weight
+		if best == nil || s.current[key.Value] > s.current[best.Value] {
+			best = key
+		}
+	}
+	s.current[best.Value] -= total
+	return best
+}
+
+// forget drops the running total of a deleted key
+func (s *weightedRoundRobinSelector) forget(key *ApiKey) {
+	delete(s.current, key.Value)
+}
+
+// minSelector picks the candidate ranked lowest by less. Ties are broken by a
+// rotating start offset so that equally ranked keys still share the load.
+type minSelector struct {
+	name   string
+	less   func(a, b *ApiKey) bool
+	offset atomic.Uint64
+}
+
+func (s *minSelector) Name() string { return s.name }
+
+func (s *minSelector) Select(candidates []*ApiKey) *ApiKey {
+	start := int((s.offset.Add(1) - 1) % uint64(len(candidates)))
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		key := candidates[(start+i)%len(candidates)]
+		if s.less(key, best) {
+			best = key
+		}
+	}
+	return best
+}
+
+// randomSelector picks a uniformly random candidate
+type randomSelector struct{}
+
+func (randomSelector) Name() string { return StrategyRandom }
+
+func (randomSelector) Select(candidates []*ApiKey) *ApiKey {
+	return candidates[rand.IntN(len(candidates))]
+}
+
+// SetStrategy switches the key selection strategy at runtime
+func (km *KeyManager) SetStrategy(strategy string) error {
+	selector, err := NewSelector(strategy)
+	if err != nil {
+		return err
+	}
+
+	km.mu.Lock()
+	km.selector = selector
+	km.mu.Unlock()
+
+	km.logger.Info("Key selection strategy set", "strategy", selector.Name())
+	return nil
+}
+
+// Strategy returns the name of the active key selection strategy
+func (km *KeyManager) Strategy() string {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return km.selector.Name()
+}
+
+// SetKeyWeight sets the weight used by weighted round-robin for a key by value
+func (km *KeyManager) SetKeyWeight(keyValue string, weight int) bool {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	for _, key := range km.keys {
+		if key.Value == keyValue {
+			key.Weight = weight
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package keymanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/loseleaf/modelscope-balancer/envelope"
+)
+
+// StateVersion is the current state schema. Version 1 state files are a plain
+// JSON array of keys and are still read.
+const StateVersion = 2
+
+// ErrStateLocked is returned when the saved state is encrypted and cannot be
+// decrypted with the supplied master key, or no master key was supplied
+var ErrStateLocked = errors.New("state is encrypted")
+
+// State is the persisted form of the keys
+type State struct {
+	Version    int              `json:"version"`
+	Encryption *envelope.Header `json:"encryption,omitempty"` // Set when key values are encrypted
+	Keys       []*StoredKey     `json:"keys"`
+}
+
+// StoredKey is a persisted key holding either its plain or its encrypted value
+type StoredKey struct {
+	*ApiKey
+	Value          string `json:"value,omitempty"`           // Shadows ApiKey.Value
+	EncryptedValue string `json:"encrypted_value,omitempty"` // Value sealed with the data key, bound to the key ID
+}
+
+// SetMasterKey enables encryption of key values in the saved state with a data
+// key wrapped by master. It must be called before LoadState, which adopts the
+// data key of an already encrypted state.
+func (km *KeyManager) SetMasterKey(master []byte) error {
+	keyring, err := envelope.New(master)
+	if err != nil {
+		return err
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	km.masterKey = master
+	km.keyring = keyring
+	km.logger.Info("State file encryption enabled", "master_key_id", envelope.MasterKeyID(master))
+	return nil
+}
+
+// newState builds the persisted form of keys, encrypting their values when a keyring is given
+func newState(keys []*ApiKey, keyring *envelope.Keyring) (*State, error) {
+	state := &State{Version: StateVersion, Keys: make([]*StoredKey, 0, len(keys))}
+	if keyring != nil {
+		header := keyring.Header()
+		state.Encryption = &header
+	}
+
+	for _, key := range keys {
+		sk := &StoredKey{ApiKey: key}
+		if key.Source == "config" {
+			// Config keys are matched by fingerprint, their values stay in the configuration
+		} else if keyring == nil {
+			sk.Value = key.Value
+		} else {
+			sealed, err := keyring.Seal(key.Value, key.ID)
+			if err != nil {
+				return nil, err
+			}
+			sk.EncryptedValue = sealed
+		}
+		state.Keys = append(state.Keys, sk)
+	}
+	return state, nil
+}
+
+// decodeState parses a state file of any version without decrypting it
+func decodeState(data []byte) (*State, error) {
+	// Version 1: a plain array of keys
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var legacy []*ApiKey
+		if err := json.Unmarshal(trimmed, &legacy); err != nil {
+			return nil, err
+		}
+		state := &State{Version: 1}
+		for _, key := range legacy {
+			state.Keys = append(state.Keys, &StoredKey{ApiKey: key, Value: key.Value})
+		}
+		return state, nil
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if err := state.check(); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// check rejects states written by a newer version and fills in missing keys
+func (state *State) check() error {
+	if state.Version > StateVersion {
+		return fmt.Errorf("state version %d is newer than the supported version %d", state.Version, StateVersion)
+	}
+	for _, sk := range state.Keys {
+		if sk.ApiKey == nil {
+			sk.ApiKey = &ApiKey{}
+		}
+	}
+	return nil
+}
+
+// decryptKeys returns the keys of a decoded state with their values restored
+func (state *State) decryptKeys(keyring *envelope.Keyring) ([]*ApiKey, error) {
+	keys := make([]*ApiKey, 0, len(state.Keys))
+	for _, sk := range state.Keys {
+		key := sk.ApiKey
+		key.Value = sk.Value
+		if sk.EncryptedValue != "" {
+			if keyring == nil {
+				return nil, fmt.Errorf("%w: key %s has an encrypted value but the file has no encryption header", ErrStateLocked, key.ID)
+			}
+			value, err := keyring.Open(sk.EncryptedValue, key.ID)
+			if err != nil {
+				return nil, fmt.Errorf("%w: key %s: %v", ErrStateLocked, key.ID, err)
+			}
+			key.Value = value
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RotateMasterKey rewraps the data key of an encrypted state with a new master
+// key. The encrypted key values are left untouched, so the balancer must be
+// stopped while rotating and started with the new master key afterwards.
+func RotateMasterKey(store Store, oldMaster, newMaster []byte) error {
+	state, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load state from %s: %w", store, err)
+	}
+	if state == nil || state.Encryption == nil {
+		return fmt.Errorf("state in %s is not encrypted; start the balancer with a master key to encrypt it", store)
+	}
+	if oldMaster == nil {
+		return fmt.Errorf("%w and no current master key was supplied", ErrStateLocked)
+	}
+
+	header, err := envelope.Rewrap(*state.Encryption, oldMaster, newMaster)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStateLocked, err)
+	}
+	state.Encryption = &header
+	return store.Save(state)
+}
@@ -0,0 +1,130 @@
+package keymanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loseleaf/modelscope-balancer/atomicfile"
+	"github.com/loseleaf/modelscope-balancer/config"
+)
+
+// Storage backends selectable in configuration
+const (
+	BackendFile = "file"
+	BackendBolt = "bolt"
+)
+
+// Default locations of the state for each backend
+const (
+	DefaultStateFile = "state.json"
+	DefaultStateDB   = "state.db"
+)
+
+// Store persists the key state between restarts
+type Store interface {
+	// Load returns the saved state, or nil when nothing was saved yet
+	Load() (*State, error)
+	// Save replaces the saved state
+	Save(state *State) error
+	// Close releases the resources of the store
+	Close() error
+	// String describes where the state is kept
+	String() string
+}
+
+// OpenStore opens the storage backend selected in configuration
+func OpenStore(cfg config.StorageSettings) (Store, error) {
+	switch cfg.Backend {
+	case BackendFile, "":
+		path := cfg.Path
+		if path == "" {
+			path = DefaultStateFile
+		}
+		return NewFileStore(path), nil
+	case BackendBolt:
+		path := cfg.Path
+		if path == "" {
+			path = DefaultStateDB
+		}
+		return OpenBoltStore(path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q, supported: %s, %s", cfg.Backend, BackendFile, BackendBolt)
+	}
+}
+
+// CopyState copies the state of src into dst when dst holds no state yet. It
+// reports whether a state was copied.
+func CopyState(dst, src Store) (bool, error) {
+	existing, err := dst.Load()
+	if err != nil || existing != nil {
+		return false, err
+	}
+	state, err := src.Load()
+	if err != nil || state == nil {
+		return false, err
+	}
+	if err := dst.Save(state); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// FileStore keeps the state in a JSON file that is replaced atomically on every save
+type FileStore struct {
+	path string
+}
+
+// NewFileStore creates a store writing to the JSON file at path
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load reads the state file, returning nil when it does not exist
+func (fs *FileStore) Load() (*State, error) {
+	data, err := os.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(data)
+}
+
+// Save replaces the state file; it holds secrets, so only the owner may read it
+func (fs *FileStore) Save(state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(fs.path, data, 0600)
+}
+
+// Close does nothing, the file is not kept open
+func (fs *FileStore) Close() error {
+	return nil
+}
+
+// String returns the path of the state file
+func (fs *FileStore) String() string {
+	return fs.path
+}
+
+// historyStore is implemented by backends that record key status changes
+type historyStore interface {
+	History(keyID string) ([]StatusChange, error)
+}
+
+// ErrHistoryUnsupported is returned when the storage backend records no key history
+var ErrHistoryUnsupported = errors.New("storage backend does not record key history")
+
+// KeyHistory returns the recorded status changes of a key, oldest first
+func (km *KeyManager) KeyHistory(keyID string) ([]StatusChange, error) {
+	store, ok := km.store.(historyStore)
+	if !ok {
+		return nil, ErrHistoryUnsupported
+	}
+	return store.History(keyID)
+}
@@ -0,0 +1,248 @@
+package keymanager
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+
+	"github.com/loseleaf/modelscope-balancer/envelope"
+)
+
+// Buckets of the bolt database
+var (
+	metaBucket    = []byte("meta")    // Schema version, encryption header and key order
+	keysBucket    = []byte("keys")    // One record per key, by key ID
+	historyBucket = []byte("history") // Status changes of keys, by sequence number
+)
+
+// Records of the meta bucket
+var (
+	versionRecord    = []byte("version")
+	encryptionRecord = []byte("encryption")
+	orderRecord      = []byte("order")
+)
+
+// StatusChange is a status transition of a key recorded by the bolt store
+type StatusChange struct {
+	Time        time.Time `json:"time"`
+	KeyID       string    `json:"key_id"`
+	Fingerprint string    `json:"fingerprint"`
+	From        KeyStatus `json:"from"` // Empty when the key was added
+	To          KeyStatus `json:"to"`   // Empty when the key was deleted
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// BoltStore keeps the state in an embedded bbolt database. Every key is stored
+// as its own record, and status changes between saves are appended to a history.
+type BoltStore struct {
+	path string
+	db   *bolt.DB
+}
+
+// OpenBoltStore opens or creates the database at path. The database is locked
+// while it is open, so only one process can use it.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, berrors.ErrTimeout) {
+		return nil, fmt.Errorf("state database %s is in use by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metaBucket, keysBucket, historyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state database %s: %w", path, err)
+	}
+	return &BoltStore{path: path, db: db}, nil
+}
+
+// Load reads all keys in their saved order, returning nil when nothing was saved yet
+func (bs *BoltStore) Load() (*State, error) {
+	var state *State
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		version := meta.Get(versionRecord)
+		if version == nil {
+			return nil
+		}
+
+		state = &State{}
+		var err error
+		if state.Version, err = strconv.Atoi(string(version)); err != nil {
+			return fmt.Errorf("invalid state version %q", version)
+		}
+		if data := meta.Get(encryptionRecord); data != nil {
+			state.Encryption = &envelope.Header{}
+			if err := json.Unmarshal(data, state.Encryption); err != nil {
+				return err
+			}
+		}
+
+		var order []string
+		if err := json.Unmarshal(meta.Get(orderRecord), &order); err != nil {
+			return fmt.Errorf("invalid key order: %w", err)
+		}
+		keys := tx.Bucket(keysBucket)
+		for _, id := range order {
+			data := keys.Get([]byte(id))
+			if data == nil {
+				return fmt.Errorf("key %s is missing from the state database", id)
+			}
+			var sk StoredKey
+			if err := json.Unmarshal(data, &sk); err != nil {
+				return fmt.Errorf("invalid record of key %s: %w", id, err)
+			}
+			state.Keys = append(state.Keys, &sk)
+		}
+		return state.check()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Save replaces all key records in a single transaction and records the status
+// changes since the previous save
+func (bs *BoltStore) Save(state *State) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		meta, keys, history := tx.Bucket(metaBucket), tx.Bucket(keysBucket), tx.Bucket(historyBucket)
+		now := time.Now()
+
+		if err := meta.Put(versionRecord, []byte(strconv.Itoa(state.Version))); err != nil {
+			return err
+		}
+		if state.Encryption != nil {
+			data, err := json.Marshal(state.Encryption)
+			if err != nil {
+				return err
+			}
+			if err := meta.Put(encryptionRecord, data); err != nil {
+				return err
+			}
+		} else if err := meta.Delete(encryptionRecord); err != nil {
+			return err
+		}
+
+		order := make([]string, 0, len(state.Keys))
+		saved := make(map[string]bool, len(state.Keys))
+		for _, sk := range state.Keys {
+			id := []byte(sk.ID)
+			var previous StoredKey
+			if data := keys.Get(id); data != nil {
+				if err := json.Unmarshal(data, &previous); err != nil {
+					return fmt.Errorf("invalid record of key %s: %w", sk.ID, err)
+				}
+			}
+			if previous.ApiKey == nil || previous.Status != sk.Status {
+				change := StatusChange{Time: now, KeyID: sk.ID, Fingerprint: sk.Fingerprint, To: sk.Status, Reason: sk.LastFailureReason}
+				if previous.ApiKey != nil {
+					change.From = previous.Status
+				}
+				if err := appendHistory(history, change); err != nil {
+					return err
+				}
+			}
+
+			data, err := json.Marshal(sk)
+			if err != nil {
+				return err
+			}
+			if err := keys.Put(id, data); err != nil {
+				return err
+			}
+			order = append(order, sk.ID)
+			saved[sk.ID] = true
+		}
+
+		// Drop the records of deleted keys
+		var deleted []StoredKey
+		err := keys.ForEach(func(id, data []byte) error {
+			if saved[string(id)] {
+				return nil
+			}
+			var sk StoredKey
+			if err := json.Unmarshal(data, &sk); err != nil {
+				return fmt.Errorf("invalid record of key %s: %w", id, err)
+			}
+			deleted = append(deleted, sk)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, sk := range deleted {
+			if err := keys.Delete([]byte(sk.ID)); err != nil {
+				return err
+			}
+			if err := appendHistory(history, StatusChange{Time: now, KeyID: sk.ID, Fingerprint: sk.Fingerprint, From: sk.Status}); err != nil {
+				return err
+			}
+		}
+
+		data, err := json.Marshal(order)
+		if err != nil {
+			return err
+		}
+		return meta.Put(orderRecord, data)
+	})
+}
+
+// History returns the recorded status changes of a key, oldest first. An empty
+// key ID returns the changes of all keys.
+func (bs *BoltStore) History(keyID string) ([]StatusChange, error) {
+	var changes []StatusChange
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).ForEach(func(_, data []byte) error {
+			var change StatusChange
+			if err := json.Unmarshal(data, &change); err != nil {
+				return err
+			}
+			if keyID == "" || change.KeyID == keyID {
+				changes = append(changes, change)
+			}
+			return nil
+		})
+	})
+	return changes, err
+}
+
+// Close closes the database and releases its lock
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+// String returns the path of the database
+func (bs *BoltStore) String() string {
+	return bs.path
+}
+
+// appendHistory stores a status change under the next sequence number
+func appendHistory(history *bolt.Bucket, change StatusChange) error {
+	seq, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return history.Put(key, data)
+}
@@ -0,0 +1,29 @@
+package keymanager
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/loseleaf/modelscope-balancer/tracing"
+)
+
+// traceTransition records a key state change as a span under the request or
+// attempt span in ctx. Nothing is recorded when the state did not change.
+func traceTransition(ctx context.Context, key *ApiKey, from KeyStatus, reason string) {
+	if key.Status == from {
+		return
+	}
+	_, span := tracing.Tracer().Start(ctx, "keymanager.state_change",
+		trace.WithAttributes(
+			attribute.String("msb.key.id", key.ID),
+			attribute.String("msb.key.fingerprint", key.Fingerprint),
+			attribute.String("msb.key.pool", key.Pool),
+			attribute.String("msb.key.from", string(from)),
+			attribute.String("msb.key.to", string(key.Status)),
+			attribute.String("msb.key.reason", reason),
+			attribute.Int("msb.key.backoff_level", key.BackoffLevel),
+		))
+	span.End()
+}
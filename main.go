@@ -1,20 +1,38 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/loseleaf/modelscope-balancer/accounting"
+	"github.com/loseleaf/modelscope-balancer/batch"
+	"github.com/loseleaf/modelscope-balancer/clients"
 	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/envelope"
+	"github.com/loseleaf/modelscope-balancer/events"
 	"github.com/loseleaf/modelscope-balancer/keymanager"
+	"github.com/loseleaf/modelscope-balancer/metrics"
 	authmiddleware "github.com/loseleaf/modelscope-balancer/middleware"
 	"github.com/loseleaf/modelscope-balancer/proxy"
+	"github.com/loseleaf/modelscope-balancer/requestlog"
+	"github.com/loseleaf/modelscope-balancer/responses"
 	"github.com/loseleaf/modelscope-balancer/scheduler"
+	"github.com/loseleaf/modelscope-balancer/tracing"
+	"github.com/loseleaf/modelscope-balancer/upstream"
 	"github.com/loseleaf/modelscope-balancer/webui"
 )
 
@@ -24,6 +42,14 @@ var frontendFS embed.FS
 // Global logger variable
 var logger *slog.Logger
 
+// adminSessionCookie authenticates admin API requests of the web UI that cannot
+// send an Authorization header, such as EventSource streams
+const adminSessionCookie = "msb_admin_session"
+
+// adminSessionTTL is how long an admin session stays valid; the web UI starts a
+// new one whenever it is loaded
+const adminSessionTTL = 12 * time.Hour
+
 // init initializes the global logger with JSON format
 func init() {
 	// Create a JSON handler for structured logging
@@ -37,6 +63,11 @@ func init() {
 }
 
 func main() {
+	// Maintenance commands run instead of the server
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	// Load application configuration
 	cfg, err := config.Load()
 	if err != nil {
@@ -47,7 +78,8 @@ func main() {
 	// Log configuration details (without exposing sensitive tokens)
 	logger.Info("Configuration loaded successfully",
 		"server_address", cfg.ServerAddress,
-		"api_keys_count", len(cfg.ApiKeys),
+		"api_keys_count", cfg.TotalApiKeys(),
+		"upstreams_count", len(cfg.Upstreams),
 		"auto_reactivation_enabled", cfg.AutoReactivation.Enabled,
 		"auto_reactivation_mode", cfg.AutoReactivation.Mode,
 		"auto_reactivation_interval", cfg.AutoReactivation.Interval,
@@ -55,34 +87,174 @@ func main() {
 		"api_token_configured", cfg.ApiToken != "",
 	)
 
+	drainCfg, err := parseShutdownSettings(cfg.Shutdown)
+	if err != nil {
+		logger.Error("Invalid shutdown settings", "error", err)
+		os.Exit(1)
+	}
+
 	// Initialize key manager with API keys from configuration
-	stateFilePath := "state.json"
-	keyManager := keymanager.New(cfg.ApiKeys, stateFilePath, logger)
+	pools := make([]keymanager.PoolKeys, 0, len(cfg.Upstreams))
+	for _, upstreamCfg := range cfg.Upstreams {
+		pools = append(pools, keymanager.PoolKeys{Pool: upstreamCfg.Name, Keys: upstreamCfg.ApiKeys})
+	}
+	stateStore, err := openStateStore(cfg.Storage)
+	if err != nil {
+		logger.Error("Failed to open state storage", "error", err)
+		os.Exit(1)
+	}
+	keyManager := keymanager.New(pools, stateStore, logger)
+	keyManager.ConfigureBreaker(cfg.CircuitBreaker)
+	keyManager.ConfigureQuota(cfg.Quota)
+	if err := keyManager.SetStrategy(cfg.KeySelection.Strategy); err != nil {
+		logger.Error("Invalid key selection strategy, using round robin", "strategy", cfg.KeySelection.Strategy, "error", err)
+	}
 
-	// Load state from file if it exists
-	if err := keyManager.LoadState(); err != nil {
-		logger.Error("Failed to load state from state.json", "error", err)
+	// Enable state file encryption when a master key is supplied
+	masterKey, err := envelope.LoadMasterKey(cfg.Encryption.MasterKeyFile)
+	if err != nil {
+		logger.Error("Failed to load master key", "error", err)
+		os.Exit(1)
+	}
+	if masterKey != nil {
+		if err := keyManager.SetMasterKey(masterKey); err != nil {
+			logger.Error("Failed to enable state file encryption", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Load the saved state if there is one
+	if err := keyManager.LoadState(); errors.Is(err, keymanager.ErrStateLocked) {
+		// Starting without the stored keys would overwrite them with the next save
+		logger.Error("Cannot decrypt the saved state, refusing to start", "store", stateStore.String(), "error", err)
+		os.Exit(1)
+	} else if err != nil {
+		logger.Error("Failed to load saved state", "store", stateStore.String(), "error", err)
 		// For robustness, we continue running with initial configuration
 	} else {
-		logger.Info("Successfully loaded state from state.json")
+		logger.Info("Successfully loaded saved state", "store", stateStore.String())
+	}
+
+	// Encrypt a plain state right away instead of waiting for the next flush
+	if err := keyManager.SaveStateIfDirty(); err != nil {
+		logger.Error("Failed to save state after loading", "error", err)
+	}
+
+	// Load the virtual client keys stored next to the state file. A store that
+	// cannot be read must not silently turn into an open API.
+	clientStore := clients.NewStore("clients.json", keyManager.QuotaWindowStart, logger)
+	if err := clientStore.Load(); err != nil {
+		logger.Error("Failed to load client store", "error", err)
+		os.Exit(1)
+	}
+
+	// Load the token usage records, aggregated per key, model, client and day
+	usageTracker := accounting.NewTracker("usage.json", keyManager.QuotaWindowStart, logger)
+	if err := usageTracker.Load(); err != nil {
+		logger.Error("Failed to load usage records, starting with empty usage", "error", err)
 	}
 
 	// Log service startup information
-	logger.Info("Starting ModelScope Balancer", "loaded_keys", len(cfg.ApiKeys), "active_keys", len(keyManager.ListKeys()))
+	logger.Info("Starting ModelScope Balancer", "loaded_keys", cfg.TotalApiKeys(), "active_keys", len(keyManager.ListKeys()))
+
+	// Install the tracer provider before any component creates spans
+	shutdownTracing, err := tracing.Setup(cfg.Tracing, logger)
+	if err != nil {
+		logger.Error("Failed to configure tracing", "error", err)
+		os.Exit(1)
+	}
+
+	// Create the shared client used for every outbound upstream call
+	upstreamClient, err := upstream.New(cfg.Upstreams, logger)
+	if err != nil {
+		logger.Error("Failed to configure upstreams", "error", err)
+		os.Exit(1)
+	}
+
+	// Build the model router from the routing rules, aliases and fallback chains
+	router, err := proxy.NewRouter(cfg.Routes, cfg.Aliases, cfg.Fallbacks, upstreamClient)
+	if err != nil {
+		logger.Error("Failed to configure routes", "error", err)
+		os.Exit(1)
+	}
+	if router.HasRoutes() {
+		logger.Info("Model routing enabled", "routes", len(cfg.Routes))
+	}
 
 	// Create ChatProxy instance
-	chatProxy := proxy.NewChatProxy(keyManager, logger)
+	chatProxy := proxy.NewChatProxy(keyManager, upstreamClient, router, clientStore, usageTracker, logger)
+
+	// Serve the Responses API with the store that previous_response_id refers to
+	responseStore, err := responses.Open(cfg.Responses, logger)
+	if err != nil {
+		logger.Error("Failed to open response store", "error", err)
+		os.Exit(1)
+	}
+	responsesHandler := proxy.NewResponsesHandler(chatProxy, responseStore)
+
+	// Build the handlers of the allowlisted pass-through paths
+	passthroughs, err := chatProxy.Passthroughs(cfg.Passthrough)
+	if err != nil {
+		logger.Error("Failed to configure pass-through paths", "error", err)
+		os.Exit(1)
+	}
+
+	// Open the request log, which is disabled by default
+	var requestLog *requestlog.Log
+	var requestRecorder proxy.Recorder
+	if cfg.RequestLog.Enabled {
+		requestLog, err = requestlog.Open(cfg.RequestLog, logger)
+		if err != nil {
+			logger.Error("Failed to open request log", "error", err)
+			os.Exit(1)
+		}
+		requestRecorder = requestLog
+		logger.Info("Request log enabled", "path", requestLog.String(), "bodies", cfg.RequestLog.Bodies)
+	}
+
+	// Replayed requests were authenticated when they were first served, and batch
+	// requests when their batch was created, so they skip client authentication
+	replayRouter := chi.NewRouter()
+	replayRouter.Route("/v1", func(r chi.Router) {
+		r.Use(tracing.Middleware)
+		r.Use(metrics.Middleware)
+		r.Use(proxy.Summarize(requestRecorder))
+		mountAPI(r, chatProxy, responsesHandler, passthroughs)
+	})
+	replayRouter.Route("/v1beta", func(r chi.Router) {
+		r.Use(tracing.Middleware)
+		r.Use(metrics.Middleware)
+		r.Use(proxy.Summarize(requestRecorder))
+		mountGemini(r, chatProxy)
+	})
+
+	// Run batches in the background, resuming those interrupted by the last shutdown
+	batchManager, err := batch.Open(cfg.Batch, replayRouter, batchEndpoints(passthroughs), router, clientStore, keyManager, logger)
+	if err != nil {
+		logger.Error("Failed to open batch store", "error", err)
+		os.Exit(1)
+	}
+	batchManager.Start()
 
 	// Initialize and start the task scheduler
-	taskScheduler := scheduler.New(keyManager, logger)
+	taskScheduler := scheduler.New(keyManager, clientStore, usageTracker, responseStore, logger)
 	taskScheduler.Start(cfg.AutoReactivation)
+	taskScheduler.StartMaintenance()
 
 	// Initialize dynamic authentication middlewares
 	adminAuth := authmiddleware.NewDynamicAuthenticator(cfg.AdminToken)
+	adminAuth.EnableSessions(adminSessionCookie, "/admin/api", adminSessionTTL)
 	apiAuth := authmiddleware.NewDynamicAuthenticator(cfg.ApiToken)
 
+	// Deliver key lifecycle events to the configured webhooks
+	webhooks, err := events.StartWebhooks(cfg.Webhooks, events.Default, logger)
+	if err != nil {
+		logger.Error("Failed to configure webhooks", "error", err)
+		os.Exit(1)
+	}
+
 	// Create AdminHandler instance
-	adminHandler := webui.NewAdminHandler(keyManager, logger, cfg.AdminToken, taskScheduler, adminAuth, apiAuth)
+	adminHandler := webui.NewAdminHandler(keyManager, upstreamClient, logger, taskScheduler, adminAuth, apiAuth, clientStore, usageTracker, webhooks, requestLog, replayRouter)
 
 	// Initialize chi router
 	r := chi.NewRouter()
@@ -90,44 +262,89 @@ func main() {
 	// Add useful middlewares
 	r.Use(middleware.RequestID) // Add unique request ID to each request
 	r.Use(middleware.RealIP)    // Get real client IP
+	r.Use(proxy.GeminiKeyQuery) // Take Gemini API keys out of the query before it is logged
 	r.Use(middleware.Logger)    // Request logging compatible with slog
 	r.Use(middleware.Recoverer) // Panic recovery to prevent service crashes
 
-	// Define health check endpoint
+	// Define health check endpoint. It fails while draining so that load balancers stop routing here.
+	var draining atomic.Bool
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+
+		status, code := "running", http.StatusOK
+		if draining.Load() {
+			status, code = "draining", http.StatusServiceUnavailable
+		}
+		w.WriteHeader(code)
 
 		response := map[string]string{
-			"status": "running",
+			"status": status,
 		}
 		json.NewEncoder(w).Encode(response)
 	})
 
-	// Mount v1 API routes with API token authentication
+	// Expose Prometheus metrics, optionally protected by their own token
+	if cfg.Metrics.Enabled {
+		registerKeyMetrics(keyManager)
+		metricsAuth := authmiddleware.NewDynamicAuthenticator(cfg.Metrics.Token)
+		r.With(metricsAuth.Middleware()).Get("/metrics", metrics.Handler().ServeHTTP)
+	}
+
+	// Mount v1 API routes with client key or API token authentication
 	r.Route("/v1", func(r chi.Router) {
-		r.Use(apiAuth.Middleware()) // Apply API token authentication
-		r.Get("/models", chatProxy.HandleGetModels)
-		r.Post("/chat/completions", chatProxy.ServeHTTP)
+		r.Use(tracing.Middleware)               // Start a span per request, continuing incoming traces
+		r.Use(metrics.Middleware)               // Record request counts and latencies
+		r.Use(proxy.Summarize(requestRecorder)) // Publish a summary of every request and write it to the request log
+		r.Use(clientStore.Middleware(apiAuth))  // Apply client key or API token authentication
+		mountAPI(r, chatProxy, responsesHandler, passthroughs)
+		mountBatches(r, batchManager)
+	})
+
+	// Mount the Gemini API, which Google GenAI clients call below /v1beta
+	r.Route("/v1beta", func(r chi.Router) {
+		r.Use(tracing.Middleware)
+		r.Use(metrics.Middleware)
+		r.Use(proxy.Summarize(requestRecorder))
+		r.Use(clientStore.Middleware(apiAuth)) // Apply client key or API token authentication
+		mountGemini(r, chatProxy)
 	})
 
 	// Mount admin API routes with admin token authentication
 	r.Route("/admin/api", func(r chi.Router) {
+		r.Use(tracing.Middleware)     // Start a span per request, continuing incoming traces
 		r.Use(adminAuth.Middleware()) // Apply admin token authentication
+		r.Post("/session", adminHandler.CreateSession)
+		r.Get("/events", adminHandler.StreamEvents)
 		r.Get("/keys", adminHandler.ListKeys)
+		r.Get("/keys/test", adminHandler.TestKeys)  // GET for EventSource
+		r.Post("/keys/test", adminHandler.TestKeys) // POST for regular requests
 		r.Post("/keys", adminHandler.AddKey)
-		r.Delete("/keys", adminHandler.DeleteKey)
-		r.Post("/keys/reactivate", adminHandler.ReactivateKey)
-		r.Post("/keys/disable", adminHandler.DisableKey)
 		r.Post("/keys/batch-add", adminHandler.BatchAddKeys)
+		r.Delete("/keys/{id}", adminHandler.DeleteKey)
+		r.Post("/keys/{id}/reactivate", adminHandler.ReactivateKey)
+		r.Post("/keys/{id}/disable", adminHandler.DisableKey)
+		r.Post("/keys/{id}/weight", adminHandler.SetKeyWeight)
+		r.Post("/keys/{id}/reveal", adminHandler.RevealKey)
+		r.Get("/keys/{id}/history", adminHandler.KeyHistory)
+		r.Get("/usage", adminHandler.GetUsage)
+		r.Get("/clients", adminHandler.ListClients)
+		r.Post("/clients", adminHandler.CreateClient)
+		r.Get("/clients/{id}", adminHandler.GetClient)
+		r.Put("/clients/{id}", adminHandler.UpdateClient)
+		r.Delete("/clients/{id}", adminHandler.DeleteClient)
+		r.Post("/clients/{id}/rotate", adminHandler.RotateClientToken)
 		r.Get("/proxied-models", adminHandler.ProxiedGetModels)
+		r.Get("/requests", adminHandler.ListRequests)
+		r.Get("/requests/{id}", adminHandler.GetRequest)
+		r.Post("/requests/{id}/replay", adminHandler.ReplayRequest)
+		r.Get("/webhooks", adminHandler.ListWebhooks)
+		r.Post("/webhooks/{name}/test", adminHandler.TestWebhook)
 		r.Get("/settings", adminHandler.GetSettings)
 		r.Post("/settings", adminHandler.UpdateSettings)
 	})
 
-	// Special route for TestKeys that handles its own authentication (for EventSource compatibility)
-	r.Get("/admin/api/keys/test", adminHandler.TestKeys)  // GET for EventSource
-	r.Post("/admin/api/keys/test", adminHandler.TestKeys) // POST for regular requests
+	// Logging out must work even after the admin token changed
+	r.Delete("/admin/api/session", adminHandler.DeleteSession)
 
 	// Serve static files from embedded frontend
 	frontendSubFS, err := fs.Sub(frontendFS, "frontend/dist")
@@ -142,8 +359,151 @@ func main() {
 	logger.Info("Server starting", "address", cfg.ServerAddress)
 
 	// Start HTTP server
-	if err := http.ListenAndServe(cfg.ServerAddress, r); err != nil {
+	server := &http.Server{Addr: cfg.ServerAddress, Handler: r}
+	server.RegisterOnShutdown(adminHandler.CloseStreams) // Event streams never end on their own
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	exitCode := 0
+	select {
+	case err := <-serverErr:
 		logger.Error("Server failed to start", "error", err)
-		os.Exit(1)
+		exitCode = 1
+	case sig := <-signals:
+		logger.Info("Shutting down, draining connections", "signal", sig.String(),
+			"drain_delay", drainCfg.delay.String(), "drain_timeout", drainCfg.timeout.String())
+		draining.Store(true)
+		drain(server, signals, drainCfg)
+	}
+
+	// Stop the scheduled tasks and batch workers before the final save so none runs after it
+	taskScheduler.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), drainCfg.timeout)
+	batchManager.Stop(ctx)
+	cancel()
+	if err := keyManager.SaveState(); err != nil {
+		logger.Error("Failed to save key state", "error", err)
+		exitCode = 1
+	}
+	if err := clientStore.SaveIfDirty(); err != nil {
+		logger.Error("Failed to save client store", "error", err)
+		exitCode = 1
+	}
+	if err := usageTracker.SaveIfDirty(); err != nil {
+		logger.Error("Failed to save usage records", "error", err)
+		exitCode = 1
+	}
+	if err := responseStore.SaveIfDirty(); err != nil {
+		logger.Error("Failed to save stored responses", "error", err)
+		exitCode = 1
+	}
+
+	// Deliver queued webhook events and export pending spans
+	ctx, cancel = context.WithTimeout(context.Background(), drainCfg.timeout)
+	webhooks.Close(ctx)
+	shutdownTracing(ctx)
+	cancel()
+
+	if requestLog != nil {
+		requestLog.Close()
+	}
+	stateStore.Close()
+	logger.Info("Shutdown complete")
+	os.Exit(exitCode)
+}
+
+// mountAPI registers the OpenAI-compatible API routes
+func mountAPI(r chi.Router, chatProxy *proxy.ChatProxy, responsesHandler *proxy.ResponsesHandler, passthroughs []proxy.PassthroughRoute) {
+	r.NotFound(proxy.NotFound)
+	r.Get("/models", chatProxy.HandleGetModels)
+	r.Post("/chat/completions", chatProxy.ServeHTTP)
+	r.Post("/messages", chatProxy.HandleMessages)
+	r.Post("/responses", responsesHandler.HandleCreate)
+	r.Get("/responses/{id}", responsesHandler.HandleGet)
+	r.Delete("/responses/{id}", responsesHandler.HandleDelete)
+	for _, route := range passthroughs {
+		for _, method := range route.Methods {
+			r.Method(method, route.Path, route.Handler)
+		}
+	}
+}
+
+// batchEndpoints returns the API paths batch requests may be sent to: chat
+// completions, responses and the pass-through paths that accept POST requests
+func batchEndpoints(passthroughs []proxy.PassthroughRoute) []string {
+	endpoints := []string{"/v1/chat/completions", "/v1/responses"}
+	for _, route := range passthroughs {
+		if slices.Contains(route.Methods, http.MethodPost) {
+			endpoints = append(endpoints, "/v1"+route.Path)
+		}
+	}
+	return endpoints
+}
+
+// mountBatches registers the file and batch routes of the Batch API. They are not
+// mounted for replays, which would run every request of a batch again.
+func mountBatches(r chi.Router, batchManager *batch.Manager) {
+	r.Post("/files", batchManager.HandleUploadFile)
+	r.Get("/files", batchManager.HandleListFiles)
+	r.Get("/files/{id}", batchManager.HandleGetFile)
+	r.Get("/files/{id}/content", batchManager.HandleFileContent)
+	r.Delete("/files/{id}", batchManager.HandleDeleteFile)
+	r.Post("/batches", batchManager.HandleCreateBatch)
+	r.Get("/batches", batchManager.HandleListBatches)
+	r.Get("/batches/{id}", batchManager.HandleGetBatch)
+	r.Post("/batches/{id}/cancel", batchManager.HandleCancelBatch)
+}
+
+// mountGemini registers the Gemini API routes
+func mountGemini(r chi.Router, chatProxy *proxy.ChatProxy) {
+	r.Post("/models/*", chatProxy.HandleGemini)
+}
+
+// registerKeyMetrics exposes the number of keys per pool and status as a gauge
+func registerKeyMetrics(km *keymanager.KeyManager) {
+	statuses := []keymanager.KeyStatus{keymanager.StatusActive, keymanager.StatusCooling, keymanager.StatusHalfOpen, keymanager.StatusDisabled}
+	metrics.NewGaugeFunc("msb_keys", "API keys by pool and status.", []string{"pool", "status"}, func() []metrics.Sample {
+		counts := make(map[string]map[keymanager.KeyStatus]int)
+		for _, pool := range km.Pools() {
+			counts[pool] = make(map[keymanager.KeyStatus]int)
+		}
+		for _, key := range km.ListKeys() {
+			if counts[key.Pool] == nil {
+				counts[key.Pool] = make(map[keymanager.KeyStatus]int)
+			}
+			counts[key.Pool][key.Status]++
+		}
+
+		var samples []metrics.Sample
+		for pool, byStatus := range counts {
+			for _, status := range statuses {
+				samples = append(samples, metrics.Sample{LabelValues: []string{pool, string(status)}, Value: float64(byStatus[status])})
+			}
+		}
+		return samples
+	})
+}
+
+// openStateStore opens the configured state storage. A new database adopts the
+// state of an existing state.json, so switching backends keeps the keys.
+func openStateStore(cfg config.StorageSettings) (keymanager.Store, error) {
+	store, err := keymanager.OpenStore(cfg)
+	if err != nil || cfg.Backend != keymanager.BackendBolt {
+		return store, err
+	}
+
+	copied, err := keymanager.CopyState(store, keymanager.NewFileStore(keymanager.DefaultStateFile))
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to import %s: %w", keymanager.DefaultStateFile, err)
+	}
+	if copied {
+		logger.Info("Imported state into the database", "from", keymanager.DefaultStateFile, "store", store.String())
 	}
+	return store, nil
 }
@@ -0,0 +1,49 @@
+package metrics
+
+// Metrics of the balancer. Key labels always carry masked key values.
+var (
+	// Requests counts /v1 requests by route, model, response status and the key of the last attempt
+	Requests = NewCounterVec("msb_requests_total",
+		"Proxied API requests by route, model, response status and masked key.",
+		"route", "model", "status", "key")
+
+	// RequestDuration observes the latency of /v1 requests including all retries
+	RequestDuration = NewHistogramVec("msb_request_duration_seconds",
+		"Latency of proxied API requests in seconds, including retries.",
+		DefaultBuckets, "route", "model", "status", "key")
+
+	// UpstreamAttempts counts single upstream calls by their outcome: success or the failure class
+	UpstreamAttempts = NewCounterVec("msb_upstream_attempts_total",
+		"Upstream attempts by upstream, masked key and result (success or failure class).",
+		"upstream", "key", "result")
+
+	// Retries counts upstream attempts that repeated a request with another key
+	Retries = NewCounterVec("msb_upstream_retries_total",
+		"Upstream attempts that retried a request with another key.",
+		"upstream")
+
+	// Fallbacks counts requests moved on to a fallback model
+	Fallbacks = NewCounterVec("msb_model_fallbacks_total",
+		"Requests moved to a fallback model after every key failed.",
+		"model", "fallback")
+
+	// Tokens counts tokens reported by the upstreams
+	Tokens = NewCounterVec("msb_tokens_total",
+		"Tokens reported by upstream usage, by model and type (prompt or completion).",
+		"model", "type")
+
+	// Reactivations counts keys returned to service by trigger: scheduler, manual or key_test
+	Reactivations = NewCounterVec("msb_key_reactivations_total",
+		"Disabled keys reactivated, by trigger.",
+		"trigger")
+
+	// KeyTests counts key test results by pool and result: success or the failure class
+	KeyTests = NewCounterVec("msb_key_tests_total",
+		"Key test results by pool and result (success or failure class).",
+		"pool", "result")
+
+	// WebhookDeliveries counts event deliveries to webhooks by result: success or failed
+	WebhookDeliveries = NewCounterVec("msb_webhook_deliveries_total",
+		"Event deliveries to webhooks by webhook and result (success or failed), after retries.",
+		"webhook", "result")
+)
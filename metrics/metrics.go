@@ -0,0 +1,262 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector writes the exposition of one metric family
+type collector interface {
+	metricName() string
+	write(w *bufio.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+// register adds a metric family to the registry exposed by Handler
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+// Handler serves all registered metrics in the Prometheus text exposition format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		collectors := append([]collector(nil), registry...)
+		registryMu.Unlock()
+		sort.Slice(collectors, func(i, j int) bool {
+			return collectors[i].metricName() < collectors[j].metricName()
+		})
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, c := range collectors {
+			c.write(bw)
+		}
+		bw.Flush()
+	})
+}
+
+// series holds the label values of one time series, keyed by their encoding
+type series struct {
+	labels string // Encoded label pairs without braces, e.g. model="a",status="200"
+}
+
+// encodeLabels renders label pairs in exposition syntax
+func encodeLabels(names, values []string) string {
+	if len(values) != len(names) {
+		panic(fmt.Sprintf("metrics: got %d label values for %d labels", len(values), len(names)))
+	}
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// escapeLabel escapes a label value as required by the text format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatValue renders a sample value
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric family
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// writeSample writes one sample line
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	if labels == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatValue(v))
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatValue(v))
+}
+
+// sortedKeys returns the keys of a series map in order
+func sortedKeys[V any](m map[series]V) []series {
+	keys := make([]series, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].labels < keys[j].labels })
+	return keys
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[series]float64
+}
+
+// NewCounterVec creates and registers a counter family
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[series]float64)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter with the given label values by one
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increases the counter with the given label values by v
+func (c *CounterVec) Add(v float64, values ...string) {
+	s := series{labels: encodeLabels(c.labels, values)}
+	c.mu.Lock()
+	c.values[s] += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) metricName() string { return c.name }
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, s := range sortedKeys(c.values) {
+		writeSample(w, c.name, s.labels, c.values[s])
+	}
+}
+
+// DefaultBuckets are latency buckets in seconds suited to LLM requests, which
+// range from fast errors to generations lasting minutes
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+// histogram is the state of one histogram series
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a family of histograms partitioned by labels
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[series]*histogram
+}
+
+// NewHistogramVec creates and registers a histogram family with the given upper bucket bounds
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[series]*histogram)}
+	register(h)
+	return h
+}
+
+// Observe records a value in the histogram with the given label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	s := series{labels: encodeLabels(h.labels, values)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist := h.values[s]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[s] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) metricName() string { return h.name }
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, s := range sortedKeys(h.values) {
+		hist := h.values[s]
+		prefix := s.labels
+		if prefix != "" {
+			prefix += ","
+		}
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			writeSample(w, h.name+"_bucket", prefix+`le="`+formatValue(bound)+`"`, float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", prefix+`le="+Inf"`, float64(hist.count))
+		writeSample(w, h.name+"_sum", s.labels, hist.sum)
+		writeSample(w, h.name+"_count", s.labels, float64(hist.count))
+	}
+}
+
+// Sample is one value reported by a GaugeFunc
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc is a gauge family whose values are collected at scrape time
+type GaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func() []Sample
+}
+
+// NewGaugeFunc creates and registers a gauge family read from collect on every scrape
+func NewGaugeFunc(name, help string, labels []string, collect func() []Sample) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) metricName() string { return g.name }
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	samples := g.collect()
+	values := make(map[series]float64, len(samples))
+	for _, sample := range samples {
+		values[series{labels: encodeLabels(g.labels, sample.LabelValues)}] += sample.Value
+	}
+
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, s := range sortedKeys(values) {
+		writeSample(w, g.name, s.labels, values[s])
+	}
+}
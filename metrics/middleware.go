@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// requestInfo collects the labels a handler learns while serving a request
+type requestInfo struct {
+	mu    sync.Mutex
+	model string
+	key   string
+}
+
+// infoKey is the request context key of the requestInfo
+type infoKey struct{}
+
+// UnknownModel is the model label of requests for a model that cannot be routed
+// or that the upstream rejected, so that made-up model names add no series
+const UnknownModel = "unknown"
+
+// SetModel records the model of the request being served for its request metrics
+func SetModel(ctx context.Context, model string) {
+	if info, ok := ctx.Value(infoKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		info.model = model
+		info.mu.Unlock()
+	}
+}
+
+// SetKey records the masked key of the latest upstream attempt for the request metrics
+func SetKey(ctx context.Context, maskedKey string) {
+	if info, ok := ctx.Value(infoKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		info.key = maskedKey
+		info.mu.Unlock()
+	}
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// Flush keeps streamed responses flowing through the recorder
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Middleware records the request count and latency of every request it wraps
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), infoKey{}, info)))
+
+		route := r.URL.Path
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		info.mu.Lock()
+		model, key := info.model, info.key
+		info.mu.Unlock()
+		if key == "" {
+			key = "none"
+		}
+
+		statusLabel := strconv.Itoa(status)
+		Requests.Inc(route, model, statusLabel, key)
+		RequestDuration.Observe(time.Since(start).Seconds(), route, model, statusLabel, key)
+	})
+}
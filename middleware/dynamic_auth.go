@@ -1,15 +1,22 @@
 package middleware
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
 // DynamicAuthenticator 支持动态更新认证令牌的认证器
 type DynamicAuthenticator struct {
-	mu    sync.RWMutex
-	token string
+	mu            sync.RWMutex
+	token         string
+	sessionCookie string // 会话 Cookie 名称，为空时只接受 Authorization 头
+	sessionPath   string
+	sessionTTL    time.Duration
+	sessions      map[string]time.Time // 会话 ID 到过期时间
 }
 
 // NewDynamicAuthenticator 创建一个新的动态认证器
@@ -19,11 +26,12 @@ func NewDynamicAuthenticator(token string) *DynamicAuthenticator {
 	}
 }
 
-// UpdateToken 更新认证令牌
+// UpdateToken 更新认证令牌，并结束以旧令牌建立的所有会话
 func (da *DynamicAuthenticator) UpdateToken(newToken string) {
 	da.mu.Lock()
 	defer da.mu.Unlock()
 	da.token = newToken
+	clear(da.sessions)
 }
 
 // GetToken 获取当前认证令牌
@@ -33,6 +41,86 @@ func (da *DynamicAuthenticator) GetToken() string {
 	return da.token
 }
 
+// EnableSessions 允许使用会话 Cookie 代替 Authorization 头进行认证，
+// 供无法设置请求头的 EventSource 使用。会话 ID 随机生成并保存在服务端，
+// 在 ttl 后过期，退出登录或更换令牌时失效。
+func (da *DynamicAuthenticator) EnableSessions(cookieName, path string, ttl time.Duration) {
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	da.sessionCookie = cookieName
+	da.sessionPath = path
+	da.sessionTTL = ttl
+	da.sessions = make(map[string]time.Time)
+}
+
+// NewSessionCookie 创建新会话并返回其 Cookie，secure 表示仅通过 HTTPS 发送
+func (da *DynamicAuthenticator) NewSessionCookie(secure bool) (*http.Cookie, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	// 顺便清理过期的会话
+	now := time.Now()
+	for session, expires := range da.sessions {
+		if now.After(expires) {
+			delete(da.sessions, session)
+		}
+	}
+	value := hex.EncodeToString(id)
+	da.sessions[value] = now.Add(da.sessionTTL)
+
+	return &http.Cookie{
+		Name:     da.sessionCookie,
+		Value:    value,
+		Path:     da.sessionPath,
+		MaxAge:   int(da.sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	}, nil
+}
+
+// RevokeSession 结束请求所携带的会话，并返回使浏览器删除会话 Cookie 的 Cookie
+func (da *DynamicAuthenticator) RevokeSession(r *http.Request) *http.Cookie {
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	if cookie, err := r.Cookie(da.sessionCookie); err == nil {
+		delete(da.sessions, cookie.Value)
+	}
+	return &http.Cookie{
+		Name:     da.sessionCookie,
+		Path:     da.sessionPath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// validSession 检查请求是否携带未过期的会话 Cookie
+func (da *DynamicAuthenticator) validSession(r *http.Request) bool {
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	if da.sessionCookie == "" {
+		return false
+	}
+	cookie, err := r.Cookie(da.sessionCookie)
+	if err != nil {
+		return false
+	}
+	expires, ok := da.sessions[cookie.Value]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(da.sessions, cookie.Value)
+		return false
+	}
+	return true
+}
+
 // Middleware 返回认证中间件
 func (da *DynamicAuthenticator) Middleware() func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -47,6 +135,10 @@ func (da *DynamicAuthenticator) Middleware() func(next http.Handler) http.Handle
 			}
 
 			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" && da.validSession(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
 			if authHeader == "" {
 				http.Error(w, "Authorization header is required", http.StatusUnauthorized)
 				return
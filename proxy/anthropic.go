@@ -0,0 +1,548 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// anthropicRequest is a request of the Anthropic Messages API
+type anthropicRequest struct {
+	Model         string               `json:"model"`
+	MaxTokens     *int                 `json:"max_tokens"`
+	System        json.RawMessage      `json:"system"` // A string or text blocks
+	Messages      []anthropicMessage   `json:"messages"`
+	Stream        bool                 `json:"stream"`
+	Temperature   *float64             `json:"temperature"`
+	TopP          *float64             `json:"top_p"`
+	TopK          *int                 `json:"top_k"`
+	StopSequences []string             `json:"stop_sequences"`
+	Tools         []anthropicTool      `json:"tools"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice"`
+	Thinking      *struct {
+		Type string `json:"type"` // "enabled" or "disabled"
+	} `json:"thinking"`
+	Metadata *struct {
+		UserID string `json:"user_id"`
+	} `json:"metadata"`
+}
+
+// anthropicMessage is a user or assistant turn
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"` // A string or content blocks
+}
+
+// anthropicBlock is a content block of a message
+type anthropicBlock struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	Thinking  *string               `json:"thinking,omitempty"`
+	Signature *string               `json:"signature,omitempty"`
+	Source    *anthropicImageSource `json:"source,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     json.RawMessage       `json:"input,omitempty"`
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage       `json:"content,omitempty"` // Result of a tool_result block, a string or blocks
+	IsError   bool                  `json:"is_error,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"` // "base64" or "url"
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+	URL       string `json:"url"`
+}
+
+type anthropicTool struct {
+	Type        string          `json:"type"` // Empty or "custom" for client tools
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type                   string `json:"type"` // "auto", "any", "tool" or "none"
+	Name                   string `json:"name"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use"`
+}
+
+// anthropicUsage reports the tokens of a message
+type anthropicUsage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+// anthropicResponse is a message returned by the Messages API
+type anthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []anthropicBlock `json:"content"`
+	StopReason   *string          `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        anthropicUsage   `json:"usage"`
+}
+
+// HandleMessages handles POST /v1/messages requests of the Anthropic Messages
+// API. Requests are translated into chat completions, served like any chat
+// completion request, and the answer is translated back.
+func (cp *ChatProxy) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		cp.logger.Error("Failed to read request body", "error", err)
+		writeAnthropicError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+	summarizeBody(r, body)
+
+	var req anthropicRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "Request body is not valid JSON")
+		return
+	}
+	chatReq, err := req.toChat()
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	chatBody, err := json.Marshal(chatReq)
+	if err != nil {
+		writeAnthropicError(w, http.StatusInternalServerError, "Failed to translate request")
+		return
+	}
+
+	tw := newTranslatingWriter(w, &anthropicTranslator{model: req.Model})
+	cp.dispatch(tw, r, chatEndpoint, chatBody)
+	tw.finish()
+}
+
+// toChat translates a Messages API request into a chat completion request
+func (req *anthropicRequest) toChat() (*chatCompletionRequest, error) {
+	chat := &chatCompletionRequest{
+		Model:       req.Model,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		TopK:        req.TopK,
+		Stop:        req.StopSequences,
+		Stream:      req.Stream,
+	}
+	if req.Stream {
+		// The usage chunk provides the token counts of the message_delta event
+		chat.StreamOptions = &chatStreamOptions{IncludeUsage: true}
+	}
+	if req.Metadata != nil {
+		chat.User = req.Metadata.UserID
+	}
+	if req.Thinking != nil {
+		enabled := req.Thinking.Type == "enabled"
+		chat.EnableThinking = &enabled
+	}
+
+	if len(req.System) > 0 {
+		blocks, err := anthropicBlocks(req.System)
+		if err != nil {
+			return nil, fmt.Errorf("system: %w", err)
+		}
+		if text := blocksText(blocks); text != "" {
+			chat.Messages = append(chat.Messages, chatMessage{Role: "system", Content: text})
+		}
+	}
+
+	for i, msg := range req.Messages {
+		blocks, err := anthropicBlocks(msg.Content)
+		if err != nil {
+			return nil, fmt.Errorf("messages.%d.content: %w", i, err)
+		}
+		switch msg.Role {
+		case "user":
+			chat.Messages = append(chat.Messages, userMessages(blocks)...)
+		case "assistant":
+			chat.Messages = append(chat.Messages, assistantMessage(blocks))
+		default:
+			return nil, fmt.Errorf("messages.%d.role: unexpected role %q", i, msg.Role)
+		}
+	}
+
+	for _, tool := range req.Tools {
+		if tool.Type != "" && tool.Type != "custom" {
+			// Server tools such as web search are run by Anthropic and have no equivalent upstream
+			continue
+		}
+		chat.Tools = append(chat.Tools, chatTool{
+			Type:     "function",
+			Function: chatFunction{Name: tool.Name, Description: tool.Description, Parameters: tool.InputSchema},
+		})
+	}
+
+	if choice := req.ToolChoice; choice != nil {
+		switch choice.Type {
+		case "auto":
+			chat.ToolChoice = "auto"
+		case "any":
+			chat.ToolChoice = "required"
+		case "none":
+			chat.ToolChoice = "none"
+		case "tool":
+			chat.ToolChoice = map[string]any{"type": "function", "function": map[string]string{"name": choice.Name}}
+		}
+		if choice.DisableParallelToolUse {
+			parallel := false
+			chat.ParallelToolCalls = &parallel
+		}
+	}
+	return chat, nil
+}
+
+// anthropicBlocks decodes message content given either as a string or as blocks
+func anthropicBlocks(raw json.RawMessage) ([]anthropicBlock, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []anthropicBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, fmt.Errorf("content must be a string or an array of content blocks")
+	}
+	return blocks, nil
+}
+
+// blocksText joins the text of the text blocks
+func blocksText(blocks []anthropicBlock) string {
+	var texts []string
+	for _, block := range blocks {
+		if block.Type == "text" && block.Text != "" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// userMessages translates a user turn. Tool results become tool messages, which
+// must directly follow the assistant message that called the tools, so they
+// come before the remaining content.
+func userMessages(blocks []anthropicBlock) []chatMessage {
+	var messages []chatMessage
+	var parts []chatContentPart
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			parts = append(parts, chatContentPart{Type: "text", Text: block.Text})
+		case "image":
+			if part, ok := imagePart(block.Source); ok {
+				parts = append(parts, part)
+			}
+		case "tool_result":
+			result, images := toolResultContent(block)
+			messages = append(messages, chatMessage{Role: "tool", ToolCallID: block.ToolUseID, Content: result})
+			// Tool messages carry text only, so images of a result are sent with the user content
+			parts = append(parts, images...)
+		}
+	}
+
+	if len(parts) == 0 {
+		return messages
+	}
+	if len(parts) == 1 && parts[0].Type == "text" {
+		return append(messages, chatMessage{Role: "user", Content: parts[0].Text})
+	}
+	return append(messages, chatMessage{Role: "user", Content: parts})
+}
+
+// toolResultContent returns the text of a tool result and its images
+func toolResultContent(block anthropicBlock) (string, []chatContentPart) {
+	if len(block.Content) == 0 {
+		return "", nil
+	}
+	blocks, err := anthropicBlocks(block.Content)
+	if err != nil {
+		return string(block.Content), nil
+	}
+
+	var images []chatContentPart
+	for _, b := range blocks {
+		if b.Type == "image" {
+			if part, ok := imagePart(b.Source); ok {
+				images = append(images, part)
+			}
+		}
+	}
+	text := blocksText(blocks)
+	if block.IsError && !strings.HasPrefix(text, "Error") {
+		text = "Error: " + text
+	}
+	return text, images
+}
+
+// imagePart translates an image source into an image_url content part
+func imagePart(source *anthropicImageSource) (chatContentPart, bool) {
+	if source == nil {
+		return chatContentPart{}, false
+	}
+	switch source.Type {
+	case "base64":
+		return chatContentPart{Type: "image_url", ImageURL: &chatImageURL{URL: "data:" + source.MediaType + ";base64," + source.Data}}, true
+	case "url":
+		return chatContentPart{Type: "image_url", ImageURL: &chatImageURL{URL: source.URL}}, true
+	}
+	return chatContentPart{}, false
+}
+
+// assistantMessage translates an assistant turn. Thinking blocks are dropped as
+// chat completions take no reasoning input.
+func assistantMessage(blocks []anthropicBlock) chatMessage {
+	msg := chatMessage{Role: "assistant"}
+	var text strings.Builder
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			arguments := "{}"
+			if len(block.Input) > 0 {
+				arguments = string(block.Input)
+			}
+			msg.ToolCalls = append(msg.ToolCalls, chatToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: chatFunctionCall{Name: block.Name, Arguments: arguments},
+			})
+		}
+	}
+	if text.Len() > 0 || len(msg.ToolCalls) == 0 {
+		msg.Content = text.String()
+	}
+	return msg
+}
+
+// anthropicStopReason maps a chat completion finish reason to a stop reason
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// toolInput returns the arguments of a tool call as a JSON object
+func toolInput(arguments string) json.RawMessage {
+	var input map[string]json.RawMessage
+	if json.Unmarshal([]byte(arguments), &input) != nil || input == nil {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// anthropicUsageOf converts chat completion usage
+func anthropicUsageOf(c *chatCompletion) anthropicUsage {
+	if c.Usage == nil {
+		return anthropicUsage{}
+	}
+	return anthropicUsage{InputTokens: c.Usage.PromptTokens, OutputTokens: c.Usage.CompletionTokens}
+}
+
+// anthropicMessageID derives a message ID from a chat completion ID
+func anthropicMessageID(id string) string {
+	if id == "" {
+		b := make([]byte, 12)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	return "msg_" + strings.TrimPrefix(id, "chatcmpl-")
+}
+
+// anthropicTranslator translates chat completions into Messages API answers
+type anthropicTranslator struct {
+	model string // Requested model, echoed in the answer
+
+	// State of a translated stream
+	started    bool
+	blockIndex int    // Index of the open content block
+	blockType  string // Type of the open content block, empty when none is open
+	toolBlocks map[int]int
+	stopReason string
+	usage      anthropicUsage
+}
+
+func (at *anthropicTranslator) completion(w http.ResponseWriter, c *chatCompletion) {
+	resp := anthropicResponse{
+		ID:      anthropicMessageID(c.ID),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   at.model,
+		Content: []anthropicBlock{},
+		Usage:   anthropicUsageOf(c),
+	}
+	stopReason := "end_turn"
+	if len(c.Choices) > 0 {
+		choice := c.Choices[0]
+		if thinking := choice.Message.ReasoningContent; thinking != "" {
+			signature := ""
+			resp.Content = append(resp.Content, anthropicBlock{Type: "thinking", Thinking: &thinking, Signature: &signature})
+		}
+		if choice.Message.Content != "" {
+			resp.Content = append(resp.Content, anthropicBlock{Type: "text", Text: choice.Message.Content})
+		}
+		for _, call := range choice.Message.ToolCalls {
+			resp.Content = append(resp.Content, anthropicBlock{
+				Type:  "tool_use",
+				ID:    call.ID,
+				Name:  call.Function.Name,
+				Input: toolInput(call.Function.Arguments),
+			})
+		}
+		stopReason = anthropicStopReason(choice.FinishReason)
+	}
+	resp.StopReason = &stopReason
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (at *anthropicTranslator) chunk(w io.Writer, c *chatCompletionChunk) {
+	if !at.started {
+		at.started = true
+		at.blockIndex = -1
+		at.toolBlocks = make(map[int]int)
+		writeEvent(w, "message_start", map[string]any{
+			"type": "message_start",
+			"message": anthropicResponse{
+				ID:      anthropicMessageID(c.ID),
+				Type:    "message",
+				Role:    "assistant",
+				Model:   at.model,
+				Content: []anthropicBlock{},
+			},
+		})
+	}
+	if c.Usage != nil {
+		at.usage = anthropicUsage{InputTokens: c.Usage.PromptTokens, OutputTokens: c.Usage.CompletionTokens}
+	}
+	if len(c.Choices) == 0 {
+		return
+	}
+
+	choice := c.Choices[0]
+	if delta := choice.Delta.ReasoningContent; delta != "" {
+		at.openBlock(w, "thinking", map[string]any{"type": "thinking", "thinking": "", "signature": ""})
+		at.delta(w, at.blockIndex, map[string]any{"type": "thinking_delta", "thinking": delta})
+	}
+	if delta := choice.Delta.Content; delta != "" {
+		at.openBlock(w, "text", map[string]any{"type": "text", "text": ""})
+		at.delta(w, at.blockIndex, map[string]any{"type": "text_delta", "text": delta})
+	}
+	for i, call := range choice.Delta.ToolCalls {
+		callIndex := i
+		if call.Index != nil {
+			callIndex = *call.Index
+		}
+		index, ok := at.toolBlocks[callIndex]
+		if !ok {
+			at.closeBlock(w)
+			at.blockIndex++
+			at.blockType = "tool_use"
+			index = at.blockIndex
+			at.toolBlocks[callIndex] = index
+			writeEvent(w, "content_block_start", map[string]any{
+				"type":          "content_block_start",
+				"index":         index,
+				"content_block": map[string]any{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": map[string]any{}},
+			})
+		}
+		if call.Function.Arguments != "" {
+			at.delta(w, index, map[string]any{"type": "input_json_delta", "partial_json": call.Function.Arguments})
+		}
+	}
+	if choice.FinishReason != "" {
+		at.stopReason = anthropicStopReason(choice.FinishReason)
+	}
+}
+
+// openBlock starts a content block of the given type unless one is open already
+func (at *anthropicTranslator) openBlock(w io.Writer, blockType string, block map[string]any) {
+	if at.blockType == blockType {
+		return
+	}
+	at.closeBlock(w)
+	at.blockIndex++
+	at.blockType = blockType
+	writeEvent(w, "content_block_start", map[string]any{"type": "content_block_start", "index": at.blockIndex, "content_block": block})
+}
+
+// closeBlock ends the open content block, if any
+func (at *anthropicTranslator) closeBlock(w io.Writer) {
+	if at.blockType == "" {
+		return
+	}
+	at.blockType = ""
+	writeEvent(w, "content_block_stop", map[string]any{"type": "content_block_stop", "index": at.blockIndex})
+}
+
+func (at *anthropicTranslator) delta(w io.Writer, index int, delta map[string]any) {
+	writeEvent(w, "content_block_delta", map[string]any{"type": "content_block_delta", "index": index, "delta": delta})
+}
+
+func (at *anthropicTranslator) streamError(w io.Writer, message string) {
+	writeEvent(w, "error", anthropicErrorBody(http.StatusBadGateway, message))
+}
+
+func (at *anthropicTranslator) streamEnd(w io.Writer) {
+	if !at.started {
+		at.chunk(w, &chatCompletionChunk{})
+	}
+	at.closeBlock(w)
+	if at.stopReason == "" {
+		at.stopReason = "end_turn"
+	}
+	writeEvent(w, "message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": at.stopReason, "stop_sequence": nil},
+		"usage": at.usage,
+	})
+	writeEvent(w, "message_stop", map[string]any{"type": "message_stop"})
+}
+
+func (at *anthropicTranslator) error(w http.ResponseWriter, status int, message string) {
+	writeAnthropicError(w, status, message)
+}
+
+// anthropicErrorBody builds the error body of the Messages API
+func anthropicErrorBody(status int, message string) map[string]any {
+	errType := "api_error"
+	switch {
+	case status == http.StatusUnauthorized:
+		errType = "authentication_error"
+	case status == http.StatusForbidden:
+		errType = "permission_error"
+	case status == http.StatusNotFound:
+		errType = "not_found_error"
+	case status == http.StatusRequestEntityTooLarge:
+		errType = "request_too_large"
+	case status == http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	case status == http.StatusServiceUnavailable:
+		errType = "overloaded_error"
+	case status >= 400 && status < 500:
+		errType = "invalid_request_error"
+	}
+	return map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	}
+}
+
+// writeAnthropicError answers a request with an error body of the Messages API
+func writeAnthropicError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, anthropicErrorBody(status, message))
+}
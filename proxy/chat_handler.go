@@ -2,50 +2,77 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/loseleaf/modelscope-balancer/accounting"
+	"github.com/loseleaf/modelscope-balancer/clients"
 	"github.com/loseleaf/modelscope-balancer/keymanager"
+	"github.com/loseleaf/modelscope-balancer/metrics"
+	"github.com/loseleaf/modelscope-balancer/upstream"
 )
 
 // ChatProxy handles chat completion requests with load balancing and failover
 type ChatProxy struct {
 	keyManager *keymanager.KeyManager
+	upstreams  *upstream.Client
+	router     *Router
+	clients    *clients.Store
+	usage      *accounting.Tracker
 	logger     *slog.Logger
-	client     *http.Client
 }
 
 // NewChatProxy creates a new ChatProxy instance
-func NewChatProxy(km *keymanager.KeyManager, logger *slog.Logger) *ChatProxy {
+func NewChatProxy(km *keymanager.KeyManager, upstreams *upstream.Client, router *Router, clientStore *clients.Store, usage *accounting.Tracker, logger *slog.Logger) *ChatProxy {
 	return &ChatProxy{
 		keyManager: km,
+		upstreams:  upstreams,
+		router:     router,
+		clients:    clientStore,
+		usage:      usage,
 		logger:     logger,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
 	}
 }
 
 // ChatRequest represents the structure of a chat completion request
 type ChatRequest struct {
-	Stream bool `json:"stream"`
+	Model  string `json:"model"`
+	Stream bool   `json:"stream"`
 	// Other fields can be added as needed
 }
 
+// streamError is returned when the upstream reports a failure inside an event stream
+type streamError struct {
+	message string
+}
+
+func (e *streamError) Error() string {
+	return "upstream stream error: " + e.message
+}
+
+// errNoKeys is returned when the key pool of an upstream is empty
+var errNoKeys = errors.New("no API keys configured")
+
+// errNoActiveKeys is returned when no key of a pool is currently available
+var errNoActiveKeys = errors.New("no active API keys")
+
+// errEmptyStream is returned when the upstream closes an event stream before sending any event
+var errEmptyStream = errors.New("upstream closed stream without sending data")
+
 // ServeHTTP implements the http.Handler interface for chat proxy
 func (cp *ChatProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Get maximum retry count based on available keys
-	maxRetries := len(cp.keyManager.ListKeys())
-	if maxRetries == 0 {
-		cp.logger.Error("No API keys available")
-		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
-		return
-	}
+	cp.serve(w, r, chatEndpoint)
+}
 
+// serve forwards a request to an endpoint of the upstream serving its model,
+// failing over between keys and then fallback models
+func (cp *ChatProxy) serve(w http.ResponseWriter, r *http.Request, ep endpoint) {
 	// Buffer the complete request body as we may need to send it multiple times
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -54,107 +81,544 @@ func (cp *ChatProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	summarizeBody(r, bodyBytes)
 
-	// Parse request body JSON to check if stream is true
+	cp.dispatch(w, r, ep, bodyBytes)
+}
+
+// dispatch forwards a buffered request body to an endpoint. Handlers that
+// translate another API into chat completions call it with the translated body.
+func (cp *ChatProxy) dispatch(w http.ResponseWriter, r *http.Request, ep endpoint, bodyBytes []byte) {
+	// Parse request body JSON to find the model and check if stream is true
 	var chatReq ChatRequest
 	isStream := false
-	if err := json.Unmarshal(bodyBytes, &chatReq); err == nil {
+	parseErr := json.Unmarshal(bodyBytes, &chatReq)
+	if parseErr == nil {
 		isStream = chatReq.Stream
 	}
+	summarizeRequest(r, chatReq.Model, isStream)
+
+	plan, ok := cp.router.Plan(chatReq.Model)
+	if !ok && chatReq.Model == "" && ep.optionalModel {
+		// Requests without a model, such as multipart uploads, go to the default upstream
+		plan, ok = []Target{{Upstream: cp.upstreams.Default()}}, true
+	}
+	if !ok {
+		if chatReq.Model != "" {
+			metrics.SetModel(r.Context(), metrics.UnknownModel)
+		}
+		switch {
+		case parseErr != nil:
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "Request body is not valid JSON")
+		case chatReq.Model == "":
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "You must provide a model parameter")
+		default:
+			cp.logger.Warn("No route for requested model", "model", chatReq.Model)
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "model_not_found",
+				fmt.Sprintf("The model `%s` does not exist or is not served by this balancer", chatReq.Model))
+		}
+		return
+	}
+	metrics.SetModel(r.Context(), plan[0].Model)
+
+	// Virtual client keys are restricted to their allowed models and request limits
+	if client := clients.FromContext(r.Context()); client != nil {
+		if !modelAllowed(client.AllowedModels, chatReq.Model, plan[0].Model) {
+			cp.logger.Warn("Client requested a model it may not use", "client", client.Name, "model", chatReq.Model)
+			writeOpenAIError(w, http.StatusForbidden, "permission_error", "model_not_allowed",
+				fmt.Sprintf("This API key is not allowed to use the model `%s`", chatReq.Model))
+			return
+		}
+		if err := cp.clients.Admit(client.ID); err != nil {
+			cp.logger.Warn("Client request rejected", "client", client.Name, "reason", err)
+			clients.WriteError(w, err)
+			return
+		}
+	}
+
+	// Ask for a final usage chunk so that streamed completions can be accounted.
+	// When the client did not ask for it itself, that chunk is not forwarded.
+	stripUsage := false
+	if isStream {
+		if withUsage, injected, err := requestStreamUsage(bodyBytes); err == nil {
+			bodyBytes, stripUsage = withUsage, injected
+		}
+	}
+
+	var err error
+	var lastError error
+
+	// Try the requested model first, then each fallback once all keys failed for the previous one
+	for i, target := range plan {
+		body := bodyBytes
+		if target.Model != chatReq.Model {
+			body, err = rewriteModel(bodyBytes, target.Model)
+			if err != nil {
+				cp.logger.Error("Failed to rewrite request model", "model", target.Model, "error", err)
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "Request body is not valid JSON")
+				return
+			}
+		}
+		if i > 0 {
+			metrics.Fallbacks.Inc(plan[i-1].Model, target.Model)
+			cp.logger.Warn("Falling back to next model", "requested_model", chatReq.Model, "model", target.Model, "upstream", target.Upstream.Name, "last_error", lastError)
+		}
+
+		if target.Model != "" {
+			w.Header().Set(modelUsedHeader, target.Model)
+		}
+		done, err := cp.tryTarget(w, r, ep, target, chatReq.Model, isStream, stripUsage, body)
+		if done {
+			return
+		}
+		lastError = err
+	}
+	w.Header().Del(modelUsedHeader)
+	summarizeResult(r.Context(), nil, lastError)
+
+	if errors.Is(lastError, errNoKeys) {
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// All retries failed, return 502 Bad Gateway
+	cp.logger.Error("All retry attempts failed", "model", chatReq.Model, "models_tried", len(plan), "last_error", lastError)
+	http.Error(w, fmt.Sprintf("All API keys failed: %v", lastError), http.StatusBadGateway)
+}
+
+// modelUsedHeader tells the client which upstream model answered after alias
+// resolution and fallbacks
+const modelUsedHeader = "X-Model-Used"
+
+// recordTokens accounts a successful request to its key fingerprint, model and
+// client. tokens is nil when the upstream did not report usage.
+func (cp *ChatProxy) recordTokens(r *http.Request, fingerprint, model string, tokens *accounting.Tokens) {
+	if tokens != nil {
+		metrics.Tokens.Add(float64(tokens.PromptTokens), model, "prompt")
+		metrics.Tokens.Add(float64(tokens.CompletionTokens), model, "completion")
+	}
+
+	clientID := ""
+	if client := clients.FromContext(r.Context()); client != nil {
+		clientID = client.ID
+		if tokens != nil {
+			cp.clients.RecordTokens(client.ID, tokens.TotalTokens)
+		}
+	}
+	cp.usage.Record(fingerprint, model, clientID, tokens)
+}
+
+// totalTokens returns the total token count of a usage report, or 0 without one
+func totalTokens(tokens *accounting.Tokens) int64 {
+	if tokens == nil {
+		return 0
+	}
+	return tokens.TotalTokens
+}
+
+// clientName returns the name of the virtual client that made a request, or an
+// empty string for requests made with the shared API token
+func clientName(r *http.Request) string {
+	if client := clients.FromContext(r.Context()); client != nil {
+		return client.Name
+	}
+	return ""
+}
+
+// rewriteModel returns the request body with its model field replaced
+func rewriteModel(body []byte, model string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	fields["model"] = encoded
+	return json.Marshal(fields)
+}
+
+// tryTarget sends a request for one model to an endpoint, failing over between
+// the keys of its upstream's pool. done reports whether a response was sent to the
+// client (or the client went away); otherwise err tells why every key failed and
+// the request may move on to a fallback model.
+func (cp *ChatProxy) tryTarget(w http.ResponseWriter, r *http.Request, ep endpoint, target Target, requestedModel string, isStream, stripUsage bool, body []byte) (done bool, err error) {
+	up := target.Upstream
+
+	// Get maximum retry count based on the keys of the upstream's pool
+	maxRetries := cp.keyManager.CountKeys(up.Name)
+	if maxRetries == 0 {
+		cp.logger.Error("No API keys available", "upstream", up.Name)
+		return false, errNoKeys
+	}
 
 	var lastError error
 
 	// Retry loop with maximum attempts equal to number of available keys
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		// Get next available API key
-		apiKey := cp.keyManager.GetNextActiveKey()
+		apiKey := cp.keyManager.GetNextActiveKey(r.Context(), up.Name)
 		if apiKey == nil {
-			cp.logger.Error("No active API keys available")
+			cp.logger.Error("No active API keys available", "upstream", up.Name)
 			break
 		}
 
-		cp.logger.Debug("Attempting request", "attempt", attempt+1, "key_value", apiKey.Value)
+		cp.logger.Debug("Attempting request", "attempt", attempt+1, "upstream", up.Name, "model", target.Model, "key_id", apiKey.ID)
+		maskedKey := keymanager.MaskKey(apiKey.Value)
+		metrics.SetKey(r.Context(), maskedKey)
+		summarizeAttempt(r.Context(), up, target.Model, apiKey)
+		if attempt > 0 {
+			metrics.Retries.Inc(up.Name)
+		}
 
-		// Create new request to upstream service
-		proxyReq, err := http.NewRequest(r.Method, "https://api-inference.modelscope.cn/v1/chat/completions", bytes.NewReader(bodyBytes))
-		if err != nil {
-			lastError = err
-			cp.logger.Error("Failed to create proxy request", "error", err)
-			continue
+		ctx, span := startAttemptSpan(r.Context(), ep.span, up, target.Model, apiKey, attempt)
+		committed, tokens, err := cp.forward(w, r.WithContext(ctx), ep, up, apiKey, body, stripUsage)
+		cp.keyManager.ReleaseKey(apiKey.Value)
+		if err == nil {
+			metrics.UpstreamAttempts.Inc(up.Name, maskedKey, "success")
+			cp.keyManager.ReportSuccess(ctx, apiKey.Value)
+			endAttemptSpan(span, "success", nil)
+			cp.keyManager.RecordUsage(apiKey.Value, target.Model)
+			cp.recordTokens(r, apiKey.Fingerprint, target.Model, tokens)
+			summarizeResult(r.Context(), tokens, nil)
+			cp.logger.Info("Request successful", "path", ep.path, "upstream", up.Name, "key_id", apiKey.ID, "model", target.Model, "requested_model", requestedModel, "client", clientName(r), "stream", isStream, "total_tokens", totalTokens(tokens))
+			return true, nil // Success, end function
 		}
 
-		// Copy original request headers
-		for name, values := range r.Header {
-			for _, value := range values {
-				proxyReq.Header.Add(name, value)
+		// Stop retrying once the client has gone away
+		if r.Context().Err() != nil {
+			metrics.UpstreamAttempts.Inc(up.Name, maskedKey, "canceled")
+			endAttemptSpan(span, "canceled", err)
+			cp.logger.Warn("Client disconnected during request", "key_id", apiKey.ID, "error", err)
+			summarizeResult(r.Context(), nil, err)
+			return true, err
+		}
+
+		reason := err.Error()
+		var netErr *upstreamNetworkError
+		if errors.As(err, &netErr) {
+			reason = fmt.Sprintf("Network error: %v", netErr.err)
+		}
+		class, retryAfter := classifyError(err)
+		metrics.UpstreamAttempts.Inc(up.Name, maskedKey, string(class))
+
+		// Client errors are the caller's problem: return the upstream answer and leave the key alone
+		var statusErr *upstreamStatusError
+		if class == keymanager.FailureClient && errors.As(err, &statusErr) {
+			// The model may not exist upstream, which routing without rules cannot tell
+			metrics.SetModel(r.Context(), metrics.UnknownModel)
+			endAttemptSpan(span, string(class), err)
+			cp.logger.Warn("Upstream rejected request, returning error to client", "key_id", apiKey.ID, "status", statusErr.status)
+			statusErr.writeTo(w)
+			summarizeResult(r.Context(), nil, err)
+			return true, err
+		}
+
+		cp.keyManager.ReportFailure(ctx, apiKey.Value, class, reason, retryAfter)
+		endAttemptSpan(span, string(class), err)
+
+		// Bytes already reached the client, so the request can no longer be moved to another key
+		if committed {
+			cp.logger.Error("Upstream failed after response was started", "key_id", apiKey.ID, "failure_class", class, "reason", reason)
+			summarizeResult(r.Context(), nil, err)
+			return true, err
+		}
+
+		lastError = err
+		cp.logger.Warn("Request failed, trying next key", "key_id", apiKey.ID, "failure_class", class, "retry_after", retryAfter.String(), "reason", reason)
+	}
+
+	if lastError == nil {
+		lastError = errNoActiveKeys
+	}
+	return false, lastError
+}
+
+// upstreamNetworkError wraps transport-level failures talking to the upstream
+type upstreamNetworkError struct {
+	err error
+}
+
+func (e *upstreamNetworkError) Error() string {
+	return e.err.Error()
+}
+
+// upstreamStatusError is returned when the upstream answers with a non-200 status
+type upstreamStatusError struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// maxErrorBodySize caps how much of an upstream error response is kept
+const maxErrorBodySize = 64 * 1024
+
+// newUpstreamStatusError captures a non-200 upstream response
+func newUpstreamStatusError(resp *http.Response) *upstreamStatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	return &upstreamStatusError{status: resp.StatusCode, header: resp.Header, body: body}
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.status, string(e.body))
+}
+
+// writeTo relays the captured upstream error response to the client unchanged
+func (e *upstreamStatusError) writeTo(w http.ResponseWriter) {
+	copyResponseHeaders(w.Header(), e.header)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// openAIError is the error body returned by OpenAI-compatible APIs
+type openAIError struct {
+	Error openAIErrorDetail `json:"error"`
+}
+
+type openAIErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// writeOpenAIError answers a request the balancer rejects itself with an OpenAI-style error body
+func writeOpenAIError(w http.ResponseWriter, status int, errType, code, message string) {
+	detail := openAIErrorDetail{Message: message, Type: errType}
+	if code != "" {
+		detail.Code = &code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(openAIError{Error: detail})
+}
+
+// forward sends one attempt of a request to an endpoint with the given key and
+// relays the answer to the client. committed reports whether any part of the
+// response was written to w; only uncommitted attempts may be retried. tokens is
+// the usage reported by the upstream, if any; with stripUsage the usage-only
+// chunk of a stream is consumed instead of forwarded.
+func (cp *ChatProxy) forward(w http.ResponseWriter, r *http.Request, ep endpoint, up *upstream.Upstream, apiKey *keymanager.ApiKey, body []byte, stripUsage bool) (committed bool, tokens *accounting.Tokens, err error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Endpoints with a total timeout bound the whole attempt
+	if ep.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, ep.timeout, errAttemptTimeout)
+		defer cancelTimeout()
+	}
+
+	// Guard the attempt with a first-byte timeout that turns into an idle timeout once data flows
+	firstByteTimeout := up.FirstByteTimeout
+	if ep.firstByteTimeout > 0 {
+		firstByteTimeout = ep.firstByteTimeout
+	}
+	wd := newWatchdog(firstByteTimeout, cancel)
+	defer wd.stop()
+
+	// Create new request to upstream service authorized with the API key
+	path := ep.path
+	if ep.forwardQuery && r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	proxyReq, err := cp.upstreams.NewRequest(ctx, up, r.Method, path, bytes.NewReader(body), apiKey.Value)
+	if err != nil {
+		return false, nil, err
+	}
+
+	// Copy original request headers
+	copyRequestHeaders(proxyReq.Header, r.Header)
+
+	// Send request using the shared upstream client
+	resp, err := cp.upstreams.Do(up, proxyReq)
+	if err != nil {
+		if errors.Is(context.Cause(ctx), errAttemptTimeout) {
+			err = errAttemptTimeout
+		}
+		return false, nil, &upstreamNetworkError{err: wd.wrap(err)}
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		return false, nil, newUpstreamStatusError(resp)
+	}
+
+	upstreamBody := &idleReader{r: resp.Body, wd: wd, timeout: up.IdleTimeout}
+	if isEventStream(resp) {
+		return cp.relayStream(w, resp, upstreamBody, stripUsage)
+	}
+	return cp.relayBuffered(w, resp, upstreamBody)
+}
+
+// relayStream forwards a server-sent event stream to the client one event at a time.
+// The response is only committed once the first non-error event arrives, so an
+// upstream that fails right away can still be retried with another key. The
+// usage of the last chunk reporting one is returned.
+func (cp *ChatProxy) relayStream(w http.ResponseWriter, resp *http.Response, body io.Reader, stripUsage bool) (committed bool, tokens *accounting.Tokens, err error) {
+	flusher, _ := w.(http.Flusher)
+	events := newSSEReader(body)
+
+	for {
+		ev, readErr := events.next()
+		if ev != nil {
+			if message, isErr := ev.upstreamError(); isErr {
+				if committed {
+					// Forward the error event so the client learns why the stream ended
+					w.Write(ev.raw)
+					if flusher != nil {
+						flusher.Flush()
+					}
+				}
+				return committed, nil, &streamError{message: message}
+			}
+
+			forward := true
+			if usage := extractUsage(ev.data); usage != nil {
+				tokens = usage
+				// The client did not ask for the usage chunk, so it is only accounted
+				forward = !stripUsage || !isUsageOnlyChunk(ev.data)
+			}
+
+			if forward {
+				if !committed {
+					copyResponseHeaders(w.Header(), resp.Header)
+					w.Header().Del("Content-Length")
+					w.WriteHeader(resp.StatusCode)
+					committed = true
+				}
+				if _, err := w.Write(ev.raw); err != nil {
+					return true, tokens, err
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
 			}
 		}
 
-		// Set authorization header with API key
-		proxyReq.Header.Set("Authorization", "Bearer "+apiKey.Value)
+		if readErr == io.EOF {
+			if !committed {
+				return false, nil, errEmptyStream
+			}
+			return true, tokens, nil
+		}
+		if readErr != nil {
+			return committed, tokens, &upstreamNetworkError{err: readErr}
+		}
+	}
+}
+
+// relayBuffered reads a complete non-streaming response before writing it to the
+// client, which keeps the attempt retryable until the upstream has fully answered
+func (cp *ChatProxy) relayBuffered(w http.ResponseWriter, resp *http.Response, body io.Reader) (committed bool, tokens *accounting.Tokens, err error) {
+	respBody, err := io.ReadAll(body)
+	if err != nil {
+		return false, nil, &upstreamNetworkError{err: err}
+	}
+	tokens = extractUsage(respBody)
+
+	copyResponseHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := w.Write(respBody); err != nil {
+		return true, tokens, err
+	}
+	return true, tokens, nil
+}
+
+// modelList is the body of a model listing response
+type modelList struct {
+	Object string            `json:"object"`
+	Data   []json.RawMessage `json:"data"`
+}
 
-		// Send request using HTTP client
-		resp, err := cp.client.Do(proxyReq)
+// HandleGetModels handles GET /v1/models requests with load balancing and failover.
+// With routing rules the lists of all routed upstreams are merged, keeping only the
+// models that are routed to the upstream listing them.
+func (cp *ChatProxy) HandleGetModels(w http.ResponseWriter, r *http.Request) {
+	summarizeRequest(r, "", false)
+	if !cp.router.HasRoutes() {
+		header, body, err := cp.fetchModels(r, cp.upstreams.Default())
+		if err != nil {
+			cp.writeModelsError(w, r, err)
+			return
+		}
+		copyResponseHeaders(w.Header(), header)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		return
+	}
+
+	merged := modelList{Object: "list", Data: []json.RawMessage{}}
+	seen := make(map[string]bool)
+	var lastError error
+	succeeded := false
+	for _, up := range cp.router.Targets() {
+		_, body, err := cp.fetchModels(r, up)
 		if err != nil {
-			// Network error occurred
 			lastError = err
-			reason := fmt.Sprintf("Network error: %v", err)
-			cp.keyManager.DisableKey(apiKey.Value, reason)
-			cp.logger.Warn("Request failed, disabling key", "key_value", apiKey.Value, "reason", reason)
+			cp.logger.Warn("Skipping upstream in model listing", "upstream", up.Name, "error", err)
 			continue
 		}
 
-		// Check response status
-		if resp.StatusCode != http.StatusOK {
-			// Non-200 response, disable key
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			reason := fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(bodyBytes))
-			lastError = fmt.Errorf("upstream returned %d", resp.StatusCode)
-			cp.keyManager.DisableKey(apiKey.Value, reason)
-			cp.logger.Warn("Request failed, disabling key", "key_value", apiKey.Value, "status", resp.StatusCode, "reason", reason)
+		var list modelList
+		if err := json.Unmarshal(body, &list); err != nil {
+			lastError = fmt.Errorf("upstream %s returned an invalid model list: %w", up.Name, err)
+			cp.logger.Warn("Skipping upstream in model listing", "upstream", up.Name, "error", lastError)
 			continue
 		}
+		succeeded = true
 
-		// Success! Copy response headers and forward response body
-		for name, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(name, value)
+		for _, raw := range list.Data {
+			var model struct {
+				ID string `json:"id"`
+			}
+			if json.Unmarshal(raw, &model) != nil || model.ID == "" || seen[model.ID] {
+				continue
+			}
+			if target, ok := cp.router.Resolve(model.ID); ok && target == up {
+				seen[model.ID] = true
+				merged.Data = append(merged.Data, raw)
 			}
 		}
+	}
 
-		w.WriteHeader(resp.StatusCode)
-
-		// Forward response body to client
-		_, err = io.Copy(w, resp.Body)
-		resp.Body.Close()
+	if !succeeded {
+		cp.writeModelsError(w, r, lastError)
+		return
+	}
 
-		if err != nil {
-			cp.logger.Error("Failed to copy response body", "error", err)
-		} else {
-			cp.logger.Info("Request successful", "key_value", apiKey.Value, "stream", isStream)
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merged)
+}
 
-		return // Success, end function
-	}
+// writeModelsError answers a failed model listing
+func (cp *ChatProxy) writeModelsError(w http.ResponseWriter, r *http.Request, err error) {
+	summarizeResult(r.Context(), nil, err)
 
-	// All retries failed, return 502 Bad Gateway
-	cp.logger.Error("All retry attempts failed", "max_retries", maxRetries, "last_error", lastError)
-	errorMsg := "All API keys failed"
-	if lastError != nil {
-		errorMsg = fmt.Sprintf("All API keys failed: %v", lastError)
+	var statusErr *upstreamStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		statusErr.writeTo(w)
+	case errors.Is(err, errNoKeys):
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, fmt.Sprintf("All API keys failed: %v", err), http.StatusBadGateway)
 	}
-	http.Error(w, errorMsg, http.StatusBadGateway)
 }
 
-// HandleGetModels handles GET /v1/models requests with load balancing and failover
-func (cp *ChatProxy) HandleGetModels(w http.ResponseWriter, r *http.Request) {
+// fetchModels requests the model list of an upstream, failing over between the
+// keys of its pool. A request the upstream rejects as the client's fault is
+// returned as *upstreamStatusError without trying further keys.
+func (cp *ChatProxy) fetchModels(r *http.Request, up *upstream.Upstream) (http.Header, []byte, error) {
 	// Get maximum retry count based on available keys
-	maxRetries := len(cp.keyManager.ListKeys())
+	maxRetries := cp.keyManager.CountKeys(up.Name)
 	if maxRetries == 0 {
-		cp.logger.Error("No API keys available")
-		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
-		return
+		cp.logger.Error("No API keys available", "upstream", up.Name)
+		return nil, nil, errNoKeys
 	}
 
 	var lastError error
@@ -162,84 +626,149 @@ func (cp *ChatProxy) HandleGetModels(w http.ResponseWriter, r *http.Request) {
 	// Retry loop with maximum attempts equal to number of available keys
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		// Get next available API key
-		apiKey := cp.keyManager.GetNextActiveKey()
+		apiKey := cp.keyManager.GetNextActiveKey(r.Context(), up.Name)
 		if apiKey == nil {
-			cp.logger.Error("No active API keys available")
+			cp.logger.Error("No active API keys available", "upstream", up.Name)
 			break
 		}
 
-		cp.logger.Debug("Attempting models request", "attempt", attempt+1, "key_value", apiKey.Value)
+		cp.logger.Debug("Attempting models request", "attempt", attempt+1, "upstream", up.Name, "key_id", apiKey.ID)
+		maskedKey := keymanager.MaskKey(apiKey.Value)
+		metrics.SetKey(r.Context(), maskedKey)
+		summarizeAttempt(r.Context(), up, "", apiKey)
+		if attempt > 0 {
+			metrics.Retries.Inc(up.Name)
+		}
 
 		// Create new request to upstream service
-		proxyReq, err := http.NewRequest("GET", "https://api-inference.modelscope.cn/v1/models", nil)
+		ctx, span := startAttemptSpan(r.Context(), "upstream.list_models", up, "", apiKey, attempt)
+		ctx, cancelCtx := context.WithTimeout(ctx, modelsRequestTimeout)
+		// cancel ends the attempt and hands the key back to the key manager
+		cancel := func() {
+			cancelCtx()
+			cp.keyManager.ReleaseKey(apiKey.Value)
+		}
+		proxyReq, err := cp.upstreams.NewRequest(ctx, up, "GET", "/models", nil, apiKey.Value)
 		if err != nil {
+			cancel()
+			endAttemptSpan(span, string(keymanager.FailureTransient), err)
 			lastError = err
 			cp.logger.Error("Failed to create proxy request", "error", err)
 			continue
 		}
 
-		// Copy original request headers (except Authorization)
-		for name, values := range r.Header {
-			if name != "Authorization" {
-				for _, value := range values {
-					proxyReq.Header.Add(name, value)
-				}
-			}
-		}
-
-		// Set authorization header with API key
-		proxyReq.Header.Set("Authorization", "Bearer "+apiKey.Value)
+		// Copy original request headers
+		copyRequestHeaders(proxyReq.Header, r.Header)
 
-		// Send request using HTTP client
-		resp, err := cp.client.Do(proxyReq)
+		// Send request using the shared upstream client
+		resp, err := cp.upstreams.Do(up, proxyReq)
 		if err != nil {
-			// Network error occurred
+			cancel()
+			// Network error occurred, retry with the next key without disabling this one
 			lastError = err
 			reason := fmt.Sprintf("Network error: %v", err)
-			cp.keyManager.DisableKey(apiKey.Value, reason)
-			cp.logger.Warn("Models request failed, disabling key", "key_value", apiKey.Value, "reason", reason)
+			metrics.UpstreamAttempts.Inc(up.Name, maskedKey, string(keymanager.FailureTransient))
+			cp.keyManager.ReportFailure(ctx, apiKey.Value, keymanager.FailureTransient, reason, 0)
+			endAttemptSpan(span, string(keymanager.FailureTransient), err)
+			cp.logger.Warn("Models request failed, trying next key", "key_id", apiKey.ID, "reason", reason)
 			continue
 		}
 
 		// Check response status
 		if resp.StatusCode != http.StatusOK {
-			// Non-200 response, disable key
-			bodyBytes, _ := io.ReadAll(resp.Body)
+			statusErr := newUpstreamStatusError(resp)
 			resp.Body.Close()
-			reason := fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(bodyBytes))
+			cancel()
+
+			class := ClassifyStatus(resp.StatusCode)
+			metrics.UpstreamAttempts.Inc(up.Name, maskedKey, string(class))
+			if class == keymanager.FailureClient {
+				endAttemptSpan(span, string(class), statusErr)
+				cp.logger.Warn("Upstream rejected models request, returning error to client", "key_id", apiKey.ID, "status", resp.StatusCode)
+				return nil, nil, statusErr
+			}
+
+			reason := statusErr.Error()
 			lastError = fmt.Errorf("upstream returned %d", resp.StatusCode)
-			cp.keyManager.DisableKey(apiKey.Value, reason)
-			cp.logger.Warn("Models request failed, disabling key", "key_value", apiKey.Value, "status", resp.StatusCode, "reason", reason)
+			cp.keyManager.ReportFailure(ctx, apiKey.Value, class, reason, ParseRetryAfter(resp.Header.Get("Retry-After")))
+			endAttemptSpan(span, string(class), statusErr)
+			cp.logger.Warn("Models request failed, trying next key", "key_id", apiKey.ID, "status", resp.StatusCode, "failure_class", class, "reason", reason)
 			continue
 		}
 
-		// Success! Copy response headers and forward response body
-		for name, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(name, value)
-			}
-		}
-
-		w.WriteHeader(resp.StatusCode)
-
-		// Forward response body to client
-		_, err = io.Copy(w, resp.Body)
+		// Success! Read the complete list before answering
+		body, err := io.ReadAll(resp.Body)
 		resp.Body.Close()
+		cancel()
 
 		if err != nil {
-			cp.logger.Error("Failed to copy models response body", "error", err)
-		} else {
-			cp.logger.Info("Models request successful", "key_value", apiKey.Value)
+			lastError = err
+			reason := fmt.Sprintf("Network error: %v", err)
+			metrics.UpstreamAttempts.Inc(up.Name, maskedKey, string(keymanager.FailureTransient))
+			cp.keyManager.ReportFailure(ctx, apiKey.Value, keymanager.FailureTransient, reason, 0)
+			endAttemptSpan(span, string(keymanager.FailureTransient), err)
+			cp.logger.Warn("Failed to read models response body, trying next key", "key_id", apiKey.ID, "reason", reason)
+			continue
 		}
 
-		return // Success, end function
+		metrics.UpstreamAttempts.Inc(up.Name, maskedKey, "success")
+		cp.keyManager.ReportSuccess(ctx, apiKey.Value)
+		endAttemptSpan(span, "success", nil)
+		cp.logger.Info("Models request successful", "upstream", up.Name, "key_id", apiKey.ID)
+		return resp.Header, body, nil
 	}
 
-	// All retries failed, return 502 Bad Gateway
-	cp.logger.Error("All models request retry attempts failed", "max_retries", maxRetries, "last_error", lastError)
-	errorMsg := "All API keys failed"
-	if lastError != nil {
-		errorMsg = fmt.Sprintf("All API keys failed: %v", lastError)
+	cp.logger.Error("All models request retry attempts failed", "upstream", up.Name, "max_retries", maxRetries, "last_error", lastError)
+	if lastError == nil {
+		lastError = errNoActiveKeys
+	}
+	return nil, nil, lastError
+}
+
+// modelsRequestTimeout bounds a single upstream model listing request
+const modelsRequestTimeout = 30 * time.Second
+
+// hopHeaders lists headers that must not be forwarded between client and upstream
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// credentialHeaders carry the client's credentials of the supported API flavors
+var credentialHeaders = map[string]bool{
+	"Authorization":  true,
+	"X-Api-Key":      true,
+	"X-Goog-Api-Key": true,
+}
+
+// copyRequestHeaders copies client headers onto an upstream request. The client's
+// credentials and body framing are dropped, and Accept-Encoding is left to the
+// transport so that responses arrive decompressed and event streams can be parsed.
+func copyRequestHeaders(dst, src http.Header) {
+	for name, values := range src {
+		if hopHeaders[name] || credentialHeaders[name] || name == "Accept-Encoding" || name == "Content-Length" {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// copyResponseHeaders copies upstream response headers to the client response
+func copyResponseHeaders(dst, src http.Header) {
+	for name, values := range src {
+		if hopHeaders[name] {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
 	}
-	http.Error(w, errorMsg, http.StatusBadGateway)
 }
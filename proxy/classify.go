@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/keymanager"
+)
+
+// ClassifyStatus maps an upstream HTTP status code to the failure class that
+// decides what happens to the key that received it
+func ClassifyStatus(status int) keymanager.FailureClass {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return keymanager.FailureAuth
+	case status == http.StatusTooManyRequests:
+		return keymanager.FailureQuota
+	case status == http.StatusRequestTimeout || status >= 500:
+		return keymanager.FailureTransient
+	case status >= 400:
+		// Malformed requests, unknown models and similar problems are the caller's to fix
+		return keymanager.FailureClient
+	default:
+		// Unexpected non-200 statuses such as redirects are treated as upstream hiccups
+		return keymanager.FailureTransient
+	}
+}
+
+// ParseRetryAfter parses a Retry-After header given either in seconds or as an
+// HTTP date. It returns zero when the header is absent or invalid.
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// classifyError determines the failure class of an error returned by a proxy attempt
+// together with the cooldown requested by the upstream, if any
+func classifyError(err error) (keymanager.FailureClass, time.Duration) {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return ClassifyStatus(statusErr.status), ParseRetryAfter(statusErr.header.Get("Retry-After"))
+	}
+	// Network errors, timeouts and errors reported inside event streams
+	return keymanager.FailureTransient, 0
+}
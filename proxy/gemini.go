@@ -0,0 +1,608 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/loseleaf/modelscope-balancer/accounting"
+)
+
+// geminiRequest is a generateContent request of the Gemini API
+type geminiRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction"`
+	Tools             []geminiTool            `json:"tools"`
+	ToolConfig        *geminiToolConfig       `json:"toolConfig"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig"`
+}
+
+// geminiContent is a turn of a conversation, or the content of a candidate
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"` // "user" or "model"
+	Parts []geminiPart `json:"parts"`
+}
+
+// geminiPart is one part of a content. Exactly one of its fields is set.
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	InlineData       *geminiBlob             `json:"inlineData,omitempty"`
+	FileData         *geminiFileData         `json:"fileData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"` // Base64 encoded
+}
+
+type geminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type geminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	ID       string          `json:"id,omitempty"`
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []struct {
+		Name                 string          `json:"name"`
+		Description          string          `json:"description"`
+		Parameters           json.RawMessage `json:"parameters"`
+		ParametersJSONSchema json.RawMessage `json:"parametersJsonSchema"`
+	} `json:"functionDeclarations"`
+}
+
+type geminiToolConfig struct {
+	FunctionCallingConfig *struct {
+		Mode                 string   `json:"mode"` // "AUTO", "ANY" or "NONE"
+		AllowedFunctionNames []string `json:"allowedFunctionNames"`
+	} `json:"functionCallingConfig"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature        *float64        `json:"temperature"`
+	TopP               *float64        `json:"topP"`
+	TopK               *float64        `json:"topK"`
+	CandidateCount     *int            `json:"candidateCount"`
+	MaxOutputTokens    *int            `json:"maxOutputTokens"`
+	StopSequences      []string        `json:"stopSequences"`
+	PresencePenalty    *float64        `json:"presencePenalty"`
+	FrequencyPenalty   *float64        `json:"frequencyPenalty"`
+	Seed               *int64          `json:"seed"`
+	ResponseMimeType   string          `json:"responseMimeType"`
+	ResponseSchema     json.RawMessage `json:"responseSchema"`
+	ResponseJSONSchema json.RawMessage `json:"responseJsonSchema"`
+	ThinkingConfig     *struct {
+		IncludeThoughts bool `json:"includeThoughts"`
+		ThinkingBudget  *int `json:"thinkingBudget"`
+	} `json:"thinkingConfig"`
+}
+
+// geminiResponse is a generateContent response, or one response of a stream
+type geminiResponse struct {
+	Candidates    []geminiCandidate `json:"candidates"`
+	UsageMetadata *geminiUsage      `json:"usageMetadata,omitempty"`
+	ModelVersion  string            `json:"modelVersion,omitempty"`
+	ResponseID    string            `json:"responseId,omitempty"`
+}
+
+type geminiCandidate struct {
+	Content      geminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+type geminiUsage struct {
+	PromptTokenCount     int64 `json:"promptTokenCount"`
+	CandidatesTokenCount int64 `json:"candidatesTokenCount"`
+	TotalTokenCount      int64 `json:"totalTokenCount"`
+}
+
+// GeminiKeyQuery moves an API key passed in the key query parameter of a
+// /v1beta request, as Gemini clients may do, into the x-goog-api-key header so
+// that it is authenticated like any other key and never forwarded or logged.
+// It must run before the access log, which prints the request URI.
+func GeminiKeyQuery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1beta/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		query := r.URL.Query()
+		if key := query.Get("key"); key != "" {
+			if r.Header.Get("X-Goog-Api-Key") == "" {
+				r.Header.Set("X-Goog-Api-Key", key)
+			}
+			query.Del("key")
+			r.URL.RawQuery = query.Encode()
+			r.RequestURI = r.URL.RequestURI()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleGemini handles POST /v1beta/models/{model}:generateContent and
+// :streamGenerateContent requests of the Gemini API. The model may contain
+// slashes, e.g. models/Qwen/Qwen3-32B:generateContent. Streams are sent as
+// server-sent events with alt=sse and as a JSON array otherwise.
+func (cp *ChatProxy) HandleGemini(w http.ResponseWriter, r *http.Request) {
+	target := chi.URLParam(r, "*")
+	sep := strings.LastIndex(target, ":")
+	if sep <= 0 {
+		writeGeminiError(w, http.StatusNotFound, fmt.Sprintf("Unknown request URL: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	model, method := target[:sep], target[sep+1:]
+	if method != "generateContent" && method != "streamGenerateContent" {
+		writeGeminiError(w, http.StatusNotFound, fmt.Sprintf("Method %q is not supported", method))
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		cp.logger.Error("Failed to read request body", "error", err)
+		writeGeminiError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+	summarizeBody(r, body)
+
+	var req geminiRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeGeminiError(w, http.StatusBadRequest, "Request body is not valid JSON")
+		return
+	}
+	stream := method == "streamGenerateContent"
+	chatReq, err := req.toChat(model, stream)
+	if err != nil {
+		writeGeminiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	chatBody, err := json.Marshal(chatReq)
+	if err != nil {
+		writeGeminiError(w, http.StatusInternalServerError, "Failed to translate request")
+		return
+	}
+
+	translator := &geminiTranslator{
+		model: model,
+		sse:   r.URL.Query().Get("alt") == "sse",
+	}
+	if cfg := req.GenerationConfig; cfg != nil && cfg.ThinkingConfig != nil {
+		translator.includeThoughts = cfg.ThinkingConfig.IncludeThoughts
+	}
+	tw := newTranslatingWriter(w, translator)
+	if !translator.sse {
+		tw.streamType = "application/json"
+	}
+	cp.dispatch(tw, r, chatEndpoint, chatBody)
+	tw.finish()
+}
+
+// toChat translates a generateContent request into a chat completion request
+func (req *geminiRequest) toChat(model string, stream bool) (*chatCompletionRequest, error) {
+	chat := &chatCompletionRequest{Model: model, Stream: stream}
+	if stream {
+		// The usage chunk provides the usage metadata of the last response
+		chat.StreamOptions = &chatStreamOptions{IncludeUsage: true}
+	}
+
+	if cfg := req.GenerationConfig; cfg != nil {
+		chat.Temperature = cfg.Temperature
+		chat.TopP = cfg.TopP
+		if cfg.TopK != nil {
+			topK := int(*cfg.TopK)
+			chat.TopK = &topK
+		}
+		chat.MaxTokens = cfg.MaxOutputTokens
+		chat.Stop = cfg.StopSequences
+		chat.N = cfg.CandidateCount
+		chat.PresencePenalty = cfg.PresencePenalty
+		chat.FrequencyPenalty = cfg.FrequencyPenalty
+		chat.Seed = cfg.Seed
+
+		if cfg.ResponseMimeType == "application/json" {
+			schema := cfg.ResponseJSONSchema
+			if len(schema) == 0 && len(cfg.ResponseSchema) > 0 {
+				schema = lowerSchemaTypes(cfg.ResponseSchema)
+			}
+			if len(schema) > 0 {
+				chat.ResponseFormat = map[string]any{
+					"type":        "json_schema",
+					"json_schema": map[string]any{"name": "response", "schema": schema},
+				}
+			} else {
+				chat.ResponseFormat = map[string]string{"type": "json_object"}
+			}
+		}
+
+		if thinking := cfg.ThinkingConfig; thinking != nil {
+			enabled := thinking.IncludeThoughts || thinking.ThinkingBudget == nil || *thinking.ThinkingBudget != 0
+			chat.EnableThinking = &enabled
+		}
+	}
+
+	if req.SystemInstruction != nil {
+		if text := partsText(req.SystemInstruction.Parts); text != "" {
+			chat.Messages = append(chat.Messages, chatMessage{Role: "system", Content: text})
+		}
+	}
+
+	// Gemini pairs function calls and responses by name when they carry no ID,
+	// chat completions by ID, so calls without one are given an ID
+	pending := make(map[string][]string)
+	calls := 0
+	for i, content := range req.Contents {
+		switch content.Role {
+		case "model":
+			msg := chatMessage{Role: "assistant"}
+			for _, part := range content.Parts {
+				if part.FunctionCall == nil {
+					continue
+				}
+				call := part.FunctionCall
+				id := call.ID
+				if id == "" {
+					calls++
+					id = fmt.Sprintf("call_%d", calls)
+				}
+				pending[call.Name] = append(pending[call.Name], id)
+				arguments := "{}"
+				if len(call.Args) > 0 {
+					arguments = string(call.Args)
+				}
+				msg.ToolCalls = append(msg.ToolCalls, chatToolCall{
+					ID:       id,
+					Type:     "function",
+					Function: chatFunctionCall{Name: call.Name, Arguments: arguments},
+				})
+			}
+			if text := partsText(content.Parts); text != "" || len(msg.ToolCalls) == 0 {
+				msg.Content = text
+			}
+			chat.Messages = append(chat.Messages, msg)
+		case "user", "function", "":
+			var parts []chatContentPart
+			for _, part := range content.Parts {
+				switch {
+				case part.FunctionResponse != nil:
+					resp := part.FunctionResponse
+					id := resp.ID
+					if ids := pending[resp.Name]; id == "" && len(ids) > 0 {
+						id, pending[resp.Name] = ids[0], ids[1:]
+					}
+					chat.Messages = append(chat.Messages, chatMessage{Role: "tool", ToolCallID: id, Content: string(resp.Response)})
+				case part.Text != "" && !part.Thought:
+					parts = append(parts, chatContentPart{Type: "text", Text: part.Text})
+				case part.InlineData != nil:
+					if !strings.HasPrefix(part.InlineData.MimeType, "image/") {
+						return nil, fmt.Errorf("contents[%d]: unsupported inline data of type %q", i, part.InlineData.MimeType)
+					}
+					url := "data:" + part.InlineData.MimeType + ";base64," + part.InlineData.Data
+					parts = append(parts, chatContentPart{Type: "image_url", ImageURL: &chatImageURL{URL: url}})
+				case part.FileData != nil:
+					parts = append(parts, chatContentPart{Type: "image_url", ImageURL: &chatImageURL{URL: part.FileData.FileURI}})
+				}
+			}
+			switch {
+			case len(parts) == 1 && parts[0].Type == "text":
+				chat.Messages = append(chat.Messages, chatMessage{Role: "user", Content: parts[0].Text})
+			case len(parts) > 0:
+				chat.Messages = append(chat.Messages, chatMessage{Role: "user", Content: parts})
+			}
+		default:
+			return nil, fmt.Errorf("contents[%d]: unexpected role %q", i, content.Role)
+		}
+	}
+
+	for _, tool := range req.Tools {
+		for _, decl := range tool.FunctionDeclarations {
+			parameters := decl.ParametersJSONSchema
+			if len(parameters) == 0 && len(decl.Parameters) > 0 {
+				parameters = lowerSchemaTypes(decl.Parameters)
+			}
+			chat.Tools = append(chat.Tools, chatTool{
+				Type:     "function",
+				Function: chatFunction{Name: decl.Name, Description: decl.Description, Parameters: parameters},
+			})
+		}
+	}
+
+	if req.ToolConfig != nil && req.ToolConfig.FunctionCallingConfig != nil {
+		cfg := req.ToolConfig.FunctionCallingConfig
+		switch strings.ToUpper(cfg.Mode) {
+		case "AUTO":
+			chat.ToolChoice = "auto"
+		case "NONE":
+			chat.ToolChoice = "none"
+		case "ANY":
+			chat.ToolChoice = "required"
+			if len(cfg.AllowedFunctionNames) == 1 {
+				chat.ToolChoice = map[string]any{"type": "function", "function": map[string]string{"name": cfg.AllowedFunctionNames[0]}}
+			}
+		}
+	}
+	return chat, nil
+}
+
+// partsText joins the text parts of a content, leaving out thoughts
+func partsText(parts []geminiPart) string {
+	var text strings.Builder
+	for _, part := range parts {
+		if !part.Thought {
+			text.WriteString(part.Text)
+		}
+	}
+	return text.String()
+}
+
+// lowerSchemaTypes converts a Gemini schema, which names types in upper case
+// such as "OBJECT", into a JSON schema
+func lowerSchemaTypes(raw json.RawMessage) json.RawMessage {
+	var schema any
+	if json.Unmarshal(raw, &schema) != nil {
+		return raw
+	}
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for key, value := range v {
+				if s, ok := value.(string); ok && key == "type" {
+					v[key] = strings.ToLower(s)
+					continue
+				}
+				walk(value)
+			}
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(schema)
+	lowered, err := json.Marshal(schema)
+	if err != nil {
+		return raw
+	}
+	return lowered
+}
+
+// geminiFinishReason maps a chat completion finish reason to a Gemini finish reason
+func geminiFinishReason(finishReason string) string {
+	switch finishReason {
+	case "":
+		return ""
+	case "length":
+		return "MAX_TOKENS"
+	case "content_filter":
+		return "SAFETY"
+	default:
+		return "STOP"
+	}
+}
+
+// geminiFunctionCallPart translates a tool call into a function call part
+func geminiFunctionCallPart(call chatFunctionCall, id string) geminiPart {
+	return geminiPart{FunctionCall: &geminiFunctionCall{ID: id, Name: call.Name, Args: toolInput(call.Arguments)}}
+}
+
+// geminiTranslator translates chat completions into generateContent responses
+type geminiTranslator struct {
+	model           string // Requested model, reported as the model version
+	sse             bool   // Whether a stream is sent as server-sent events rather than a JSON array
+	includeThoughts bool   // Whether reasoning is returned as thought parts
+
+	// State of a translated stream
+	written int                         // Responses written so far
+	id      string                      // ID of the streamed completion
+	calls   map[int][]*chatFunctionCall // Tool calls of each candidate, assembled from their pieces
+	callIDs map[int][]string
+	finish  map[int]string // Finish reason of each candidate
+	usage   *geminiUsage
+}
+
+func (gt *geminiTranslator) completion(w http.ResponseWriter, c *chatCompletion) {
+	resp := geminiResponse{
+		Candidates:    []geminiCandidate{},
+		UsageMetadata: geminiUsageOf(c.Usage),
+		ModelVersion:  gt.model,
+		ResponseID:    c.ID,
+	}
+	for _, choice := range c.Choices {
+		parts := []geminiPart{}
+		if choice.Message.ReasoningContent != "" && gt.includeThoughts {
+			parts = append(parts, geminiPart{Text: choice.Message.ReasoningContent, Thought: true})
+		}
+		if choice.Message.Content != "" {
+			parts = append(parts, geminiPart{Text: choice.Message.Content})
+		}
+		for _, call := range choice.Message.ToolCalls {
+			parts = append(parts, geminiFunctionCallPart(call.Function, call.ID))
+		}
+		resp.Candidates = append(resp.Candidates, geminiCandidate{
+			Content:      geminiContent{Role: "model", Parts: parts},
+			FinishReason: geminiFinishReason(choice.FinishReason),
+			Index:        choice.Index,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// geminiUsageOf converts chat completion usage, which may be nil
+func geminiUsageOf(tokens *accounting.Tokens) *geminiUsage {
+	if tokens == nil {
+		return nil
+	}
+	return &geminiUsage{
+		PromptTokenCount:     tokens.PromptTokens,
+		CandidatesTokenCount: tokens.CompletionTokens,
+		TotalTokenCount:      tokens.PromptTokens + tokens.CompletionTokens,
+	}
+}
+
+func (gt *geminiTranslator) chunk(w io.Writer, c *chatCompletionChunk) {
+	if gt.calls == nil {
+		gt.calls = make(map[int][]*chatFunctionCall)
+		gt.callIDs = make(map[int][]string)
+		gt.finish = make(map[int]string)
+	}
+	if gt.id == "" {
+		gt.id = c.ID
+	}
+	if c.Usage != nil {
+		gt.usage = geminiUsageOf(c.Usage)
+	}
+
+	resp := geminiResponse{ModelVersion: gt.model, ResponseID: gt.id}
+	for _, choice := range c.Choices {
+		var parts []geminiPart
+		if choice.Delta.ReasoningContent != "" && gt.includeThoughts {
+			parts = append(parts, geminiPart{Text: choice.Delta.ReasoningContent, Thought: true})
+		}
+		if choice.Delta.Content != "" {
+			parts = append(parts, geminiPart{Text: choice.Delta.Content})
+		}
+		if len(parts) > 0 {
+			resp.Candidates = append(resp.Candidates, geminiCandidate{Content: geminiContent{Role: "model", Parts: parts}, Index: choice.Index})
+		}
+
+		// Function calls are only sent once their arguments are complete
+		for i, call := range choice.Delta.ToolCalls {
+			index := i
+			if call.Index != nil {
+				index = *call.Index
+			}
+			for len(gt.calls[choice.Index]) <= index {
+				gt.calls[choice.Index] = append(gt.calls[choice.Index], &chatFunctionCall{})
+				gt.callIDs[choice.Index] = append(gt.callIDs[choice.Index], "")
+			}
+			assembled := gt.calls[choice.Index][index]
+			if call.ID != "" {
+				gt.callIDs[choice.Index][index] = call.ID
+			}
+			if call.Function.Name != "" {
+				assembled.Name = call.Function.Name
+			}
+			assembled.Arguments += call.Function.Arguments
+		}
+		if choice.FinishReason != "" {
+			gt.finish[choice.Index] = choice.FinishReason
+		}
+	}
+	if len(resp.Candidates) > 0 {
+		gt.write(w, resp)
+	}
+}
+
+// write sends one response of a stream
+func (gt *geminiTranslator) write(w io.Writer, v any) {
+	if gt.sse {
+		writeEvent(w, "", v)
+		gt.written++
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if gt.written == 0 {
+		io.WriteString(w, "[")
+	} else {
+		io.WriteString(w, ",\r\n")
+	}
+	w.Write(data)
+	gt.written++
+}
+
+func (gt *geminiTranslator) streamError(w io.Writer, message string) {
+	gt.write(w, geminiErrorBody(http.StatusBadGateway, message))
+	if !gt.sse {
+		io.WriteString(w, "]")
+	}
+}
+
+// streamEnd sends the function calls, finish reasons and usage in a last response
+func (gt *geminiTranslator) streamEnd(w io.Writer) {
+	resp := geminiResponse{Candidates: []geminiCandidate{}, UsageMetadata: gt.usage, ModelVersion: gt.model, ResponseID: gt.id}
+
+	var indexes []int
+	for index := range gt.finish {
+		indexes = append(indexes, index)
+	}
+	for index := range gt.calls {
+		if _, ok := gt.finish[index]; !ok {
+			indexes = append(indexes, index)
+		}
+	}
+	slices.Sort(indexes)
+	for _, index := range indexes {
+		parts := []geminiPart{}
+		for i, call := range gt.calls[index] {
+			parts = append(parts, geminiFunctionCallPart(*call, gt.callIDs[index][i]))
+		}
+		finishReason := geminiFinishReason(gt.finish[index])
+		if finishReason == "" {
+			finishReason = "STOP"
+		}
+		resp.Candidates = append(resp.Candidates, geminiCandidate{
+			Content:      geminiContent{Role: "model", Parts: parts},
+			FinishReason: finishReason,
+			Index:        index,
+		})
+	}
+	gt.write(w, resp)
+	if !gt.sse {
+		io.WriteString(w, "]")
+	}
+}
+
+func (gt *geminiTranslator) error(w http.ResponseWriter, status int, message string) {
+	writeGeminiError(w, status, message)
+}
+
+// geminiErrorBody builds the error body of the Gemini API
+func geminiErrorBody(status int, message string) map[string]any {
+	code := "INTERNAL"
+	switch {
+	case status == http.StatusUnauthorized:
+		code = "UNAUTHENTICATED"
+	case status == http.StatusForbidden:
+		code = "PERMISSION_DENIED"
+	case status == http.StatusNotFound:
+		code = "NOT_FOUND"
+	case status == http.StatusTooManyRequests:
+		code = "RESOURCE_EXHAUSTED"
+	case status == http.StatusServiceUnavailable:
+		code = "UNAVAILABLE"
+	case status == http.StatusGatewayTimeout:
+		code = "DEADLINE_EXCEEDED"
+	case status >= 400 && status < 500:
+		code = "INVALID_ARGUMENT"
+	}
+	return map[string]any{
+		"error": map[string]any{"code": status, "message": message, "status": code},
+	}
+}
+
+// writeGeminiError answers a request with an error body of the Gemini API
+func writeGeminiError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, geminiErrorBody(status, message))
+}
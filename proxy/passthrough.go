@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/config"
+)
+
+// endpoint is an upstream API path served through the key retry loop
+type endpoint struct {
+	path             string        // API path below the upstream base URL, e.g. "/chat/completions"
+	span             string        // Name of the span of each upstream attempt
+	optionalModel    bool          // Whether requests without a model go to the default upstream instead of being rejected
+	forwardQuery     bool          // Whether the query string of the request is sent upstream
+	timeout          time.Duration // Bound of one whole attempt, 0 for none
+	firstByteTimeout time.Duration // Overrides the upstream's first byte timeout when set
+}
+
+// chatEndpoint serves chat completions
+var chatEndpoint = endpoint{path: "/chat/completions", span: "upstream.chat_completion"}
+
+// errAttemptTimeout is reported when an attempt exceeds the total timeout of its endpoint
+var errAttemptTimeout = errors.New("upstream request timeout")
+
+// reservedPaths are served by the balancer's own handlers and cannot be passed through
+var reservedPaths = map[string]bool{
+	"/batches":          true,
+	"/chat/completions": true,
+	"/files":            true,
+	"/messages":         true,
+	"/models":           true,
+	"/responses":        true,
+}
+
+// PassthroughRoute is an allowlisted API path that is forwarded to the upstreams
+// unchanged, balanced and failed over like chat completions
+type PassthroughRoute struct {
+	Path    string   // Path below /v1
+	Methods []string // Upper-cased HTTP methods
+	Handler http.Handler
+}
+
+// Passthroughs builds the handlers of the allowlisted pass-through paths. The
+// model of a JSON request body is routed, aliased and falls back like a chat
+// model; requests without one are sent to the default upstream.
+func (cp *ChatProxy) Passthroughs(settings []config.PassthroughSettings) ([]PassthroughRoute, error) {
+	routes := make([]PassthroughRoute, 0, len(settings))
+	seen := make(map[string]bool, len(settings))
+	for i, s := range settings {
+		path := "/" + strings.Trim(strings.TrimSpace(s.Path), "/")
+		if path == "/" {
+			return nil, fmt.Errorf("passthrough #%d has no path", i+1)
+		}
+		if strings.ContainsAny(path, "{}*?") {
+			return nil, fmt.Errorf("passthrough %q: paths must be literal", path)
+		}
+		if reservedPaths[path] {
+			return nil, fmt.Errorf("passthrough %q: path is served by the balancer itself", path)
+		}
+		if seen[path] {
+			return nil, fmt.Errorf("duplicate passthrough path %q", path)
+		}
+		seen[path] = true
+
+		ep := endpoint{path: path, span: "upstream.passthrough", optionalModel: true, forwardQuery: true}
+		var err error
+		if ep.timeout, err = parseOptionalDuration(s.Timeout); err != nil {
+			return nil, fmt.Errorf("passthrough %q: invalid timeout: %w", path, err)
+		}
+		if ep.firstByteTimeout, err = parseOptionalDuration(s.FirstByteTimeout); err != nil {
+			return nil, fmt.Errorf("passthrough %q: invalid first_byte_timeout: %w", path, err)
+		}
+
+		methods := []string{http.MethodPost}
+		if len(s.Methods) > 0 {
+			methods = methods[:0]
+			for _, method := range s.Methods {
+				methods = append(methods, strings.ToUpper(strings.TrimSpace(method)))
+			}
+		}
+
+		routes = append(routes, PassthroughRoute{
+			Path:    path,
+			Methods: methods,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				cp.serve(w, r, ep)
+			}),
+		})
+	}
+	return routes, nil
+}
+
+// parseOptionalDuration parses a positive duration setting, returning 0 when it is empty
+func parseOptionalDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive, got %s", value)
+	}
+	return d, nil
+}
+
+// NotFound answers requests for API paths that are neither served nor allowlisted
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "unknown_url",
+		fmt.Sprintf("Unknown request URL: %s %s", r.Method, r.URL.Path))
+}
@@ -0,0 +1,784 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/loseleaf/modelscope-balancer/accounting"
+	"github.com/loseleaf/modelscope-balancer/clients"
+	"github.com/loseleaf/modelscope-balancer/responses"
+)
+
+// responsesRequest is a request of the OpenAI Responses API
+type responsesRequest struct {
+	Model              string          `json:"model"`
+	Input              json.RawMessage `json:"input"` // A string or input items
+	Instructions       *string         `json:"instructions"`
+	PreviousResponseID string          `json:"previous_response_id"`
+	Tools              json.RawMessage `json:"tools"`       // Echoed in the response, see responsesTool
+	ToolChoice         json.RawMessage `json:"tool_choice"` // A mode string or a forced function
+	ParallelToolCalls  *bool           `json:"parallel_tool_calls"`
+	Stream             bool            `json:"stream"`
+	Store              *bool           `json:"store"` // Defaults to true
+	Temperature        *float64        `json:"temperature"`
+	TopP               *float64        `json:"top_p"`
+	MaxOutputTokens    *int            `json:"max_output_tokens"`
+	Text               json.RawMessage `json:"text"` // Echoed in the response, see responsesText
+	Reasoning          *struct {
+		Effort string `json:"effort"`
+	} `json:"reasoning"`
+	Metadata json.RawMessage `json:"metadata"`
+	User     string          `json:"user"`
+}
+
+// responsesItem is an input item: a message, a function call made by the model
+// or the output of such a call
+type responsesItem struct {
+	Type      string          `json:"type"` // "message" when empty
+	Role      string          `json:"role"`
+	Content   json.RawMessage `json:"content"` // A string or content parts
+	CallID    string          `json:"call_id"`
+	Name      string          `json:"name"`
+	Arguments string          `json:"arguments"`
+	Output    json.RawMessage `json:"output"` // A string or content parts
+}
+
+// responsesPart is a content part of an input message
+type responsesPart struct {
+	Type     string `json:"type"` // "input_text", "output_text", "refusal" or "input_image"
+	Text     string `json:"text"`
+	Refusal  string `json:"refusal"`
+	ImageURL string `json:"image_url"`
+	Detail   string `json:"detail"`
+}
+
+type responsesTool struct {
+	Type        string          `json:"type"` // Only "function" tools are run by the client
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type responsesText struct {
+	Format *struct {
+		Type   string          `json:"type"` // "text", "json_object" or "json_schema"
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+		Strict *bool           `json:"strict"`
+	} `json:"format"`
+}
+
+// responseObject is a response returned by the Responses API
+type responseObject struct {
+	ID                 string             `json:"id"`
+	Object             string             `json:"object"`
+	CreatedAt          int64              `json:"created_at"`
+	Status             string             `json:"status"` // "in_progress", "completed", "incomplete" or "failed"
+	Error              *responseError     `json:"error"`
+	IncompleteDetails  *incompleteDetails `json:"incomplete_details"`
+	Instructions       *string            `json:"instructions"`
+	MaxOutputTokens    *int               `json:"max_output_tokens"`
+	Model              string             `json:"model"`
+	Output             []any              `json:"output"`
+	ParallelToolCalls  bool               `json:"parallel_tool_calls"`
+	PreviousResponseID *string            `json:"previous_response_id"`
+	Store              bool               `json:"store"`
+	Temperature        *float64           `json:"temperature"`
+	Text               json.RawMessage    `json:"text"`
+	ToolChoice         json.RawMessage    `json:"tool_choice"`
+	Tools              json.RawMessage    `json:"tools"`
+	TopP               *float64           `json:"top_p"`
+	Usage              *responseUsage     `json:"usage"`
+	User               *string            `json:"user"`
+	Metadata           json.RawMessage    `json:"metadata"`
+}
+
+type responseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type incompleteDetails struct {
+	Reason string `json:"reason"` // "max_output_tokens" or "content_filter"
+}
+
+type responseUsage struct {
+	InputTokens        int64 `json:"input_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokens        int64 `json:"output_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int64 `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+	TotalTokens int64 `json:"total_tokens"`
+}
+
+// responseMessage is an output item holding the answer text
+type responseMessage struct {
+	Type    string               `json:"type"`
+	ID      string               `json:"id"`
+	Status  string               `json:"status"`
+	Role    string               `json:"role"`
+	Content []responseOutputText `json:"content"`
+}
+
+type responseOutputText struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+// responseReasoning is an output item holding the thinking of reasoning models
+type responseReasoning struct {
+	Type    string                `json:"type"`
+	ID      string                `json:"id"`
+	Summary []responseSummaryText `json:"summary"`
+}
+
+type responseSummaryText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// responseFunctionCall is an output item calling a function of the client
+type responseFunctionCall struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Status    string `json:"status"`
+}
+
+// ResponsesHandler serves the OpenAI Responses API. Requests are translated
+// into chat completions served by a ChatProxy, and the answers are kept in a
+// store so that later requests can continue them with previous_response_id.
+type ResponsesHandler struct {
+	proxy *ChatProxy
+	store *responses.Store
+}
+
+// NewResponsesHandler creates a handler serving the Responses API through cp
+func NewResponsesHandler(cp *ChatProxy, store *responses.Store) *ResponsesHandler {
+	return &ResponsesHandler{proxy: cp, store: store}
+}
+
+// HandleCreate handles POST /v1/responses requests
+func (h *ResponsesHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.proxy.logger.Error("Failed to read request body", "error", err)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+	summarizeBody(r, body)
+
+	var req responsesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "Request body is not valid JSON")
+		return
+	}
+
+	// The conversation is stored without the instructions, which apply to one request only
+	client := responsesClient(r)
+	var conversation []chatMessage
+	if req.PreviousResponseID != "" {
+		entry, ok := h.lookup(req.PreviousResponseID, client)
+		if !ok {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "previous_response_not_found",
+				fmt.Sprintf("Previous response with id '%s' not found.", req.PreviousResponseID))
+			return
+		}
+		if err := json.Unmarshal(entry.Messages, &conversation); err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, "server_error", "", "Stored conversation is corrupt")
+			return
+		}
+	}
+	input, err := responsesInput(req.Input)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+	conversation = append(conversation, input...)
+
+	chatReq, err := req.toChat(conversation)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+	chatBody, err := json.Marshal(chatReq)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "", "Failed to translate request")
+		return
+	}
+
+	tw := newTranslatingWriter(w, newResponsesTranslator(h, &req, client, conversation))
+	h.proxy.dispatch(tw, r, chatEndpoint, chatBody)
+	tw.finish()
+}
+
+// HandleGet handles GET /v1/responses/{id} requests, returning a stored response
+func (h *ResponsesHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	entry, ok := h.lookup(id, responsesClient(r))
+	if !ok {
+		writeResponseNotFound(w, id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(entry.Response)
+}
+
+// HandleDelete handles DELETE /v1/responses/{id} requests
+func (h *ResponsesHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, ok := h.lookup(id, responsesClient(r)); !ok || !h.store.Delete(id) {
+		writeResponseNotFound(w, id)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "object": "response.deleted", "deleted": true})
+}
+
+// lookup returns a stored response, hiding the responses of other clients
+func (h *ResponsesHandler) lookup(id, client string) (*responses.Entry, bool) {
+	entry, ok := h.store.Get(id)
+	if !ok || entry.Client != client {
+		return nil, false
+	}
+	return entry, true
+}
+
+// responsesClient returns the ID of the virtual client of a request, empty for the shared API token
+func responsesClient(r *http.Request) string {
+	if client := clients.FromContext(r.Context()); client != nil {
+		return client.ID
+	}
+	return ""
+}
+
+func writeResponseNotFound(w http.ResponseWriter, id string) {
+	writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "",
+		fmt.Sprintf("Response with id '%s' not found.", id))
+}
+
+// toChat translates a Responses API request continuing the given conversation
+// into a chat completion request
+func (req *responsesRequest) toChat(conversation []chatMessage) (*chatCompletionRequest, error) {
+	chat := &chatCompletionRequest{
+		Model:             req.Model,
+		MaxTokens:         req.MaxOutputTokens,
+		Temperature:       req.Temperature,
+		TopP:              req.TopP,
+		Stream:            req.Stream,
+		ParallelToolCalls: req.ParallelToolCalls,
+		User:              req.User,
+	}
+	if req.Stream {
+		// The usage chunk provides the token counts of the response.completed event
+		chat.StreamOptions = &chatStreamOptions{IncludeUsage: true}
+	}
+	if req.Reasoning != nil && req.Reasoning.Effort != "" {
+		enabled := req.Reasoning.Effort != "none" && req.Reasoning.Effort != "minimal"
+		chat.EnableThinking = &enabled
+	}
+
+	if req.Instructions != nil && *req.Instructions != "" {
+		chat.Messages = append(chat.Messages, chatMessage{Role: "system", Content: *req.Instructions})
+	}
+	chat.Messages = append(chat.Messages, conversation...)
+
+	if len(req.Tools) > 0 {
+		var tools []responsesTool
+		if err := json.Unmarshal(req.Tools, &tools); err != nil {
+			return nil, fmt.Errorf("tools must be an array of tools")
+		}
+		for _, tool := range tools {
+			if tool.Type != "function" {
+				// Built-in tools such as web search are run by OpenAI and have no equivalent upstream
+				continue
+			}
+			chat.Tools = append(chat.Tools, chatTool{
+				Type:     "function",
+				Function: chatFunction{Name: tool.Name, Description: tool.Description, Parameters: tool.Parameters},
+			})
+		}
+	}
+
+	if len(req.ToolChoice) > 0 {
+		var mode string
+		var forced struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+		}
+		switch {
+		case json.Unmarshal(req.ToolChoice, &mode) == nil:
+			chat.ToolChoice = mode
+		case json.Unmarshal(req.ToolChoice, &forced) == nil && forced.Type == "function":
+			chat.ToolChoice = map[string]any{"type": "function", "function": map[string]string{"name": forced.Name}}
+		}
+	}
+
+	if len(req.Text) > 0 {
+		var text responsesText
+		if err := json.Unmarshal(req.Text, &text); err != nil {
+			return nil, fmt.Errorf("text must be an object")
+		}
+		if format := text.Format; format != nil {
+			switch format.Type {
+			case "json_object":
+				chat.ResponseFormat = map[string]string{"type": "json_object"}
+			case "json_schema":
+				schema := map[string]any{"name": format.Name, "schema": format.Schema}
+				if format.Strict != nil {
+					schema["strict"] = *format.Strict
+				}
+				chat.ResponseFormat = map[string]any{"type": "json_schema", "json_schema": schema}
+			}
+		}
+	}
+	return chat, nil
+}
+
+// responsesInput translates the input of a request into chat messages
+func responsesInput(raw json.RawMessage) ([]chatMessage, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []chatMessage{{Role: "user", Content: text}}, nil
+	}
+	var items []responsesItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("input must be a string or an array of input items")
+	}
+
+	var messages []chatMessage
+	for i, item := range items {
+		switch item.Type {
+		case "", "message":
+			msg, err := responsesMessage(item)
+			if err != nil {
+				return nil, fmt.Errorf("input.%d: %w", i, err)
+			}
+			messages = append(messages, msg)
+		case "function_call":
+			call := chatToolCall{ID: item.CallID, Type: "function", Function: chatFunctionCall{Name: item.Name, Arguments: item.Arguments}}
+			// Calls made in one turn belong to one assistant message
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+			} else {
+				messages = append(messages, chatMessage{Role: "assistant", ToolCalls: []chatToolCall{call}})
+			}
+		case "function_call_output":
+			output, _, err := responsesContent(item.Output)
+			if err != nil {
+				return nil, fmt.Errorf("input.%d.output: %w", i, err)
+			}
+			messages = append(messages, chatMessage{Role: "tool", ToolCallID: item.CallID, Content: output})
+		case "reasoning", "item_reference":
+			// Chat completions take no reasoning input, and referenced items are
+			// part of the stored conversation already
+		default:
+			return nil, fmt.Errorf("input.%d: unsupported item type %q", i, item.Type)
+		}
+	}
+	return messages, nil
+}
+
+// responsesMessage translates an input message
+func responsesMessage(item responsesItem) (chatMessage, error) {
+	role := item.Role
+	switch role {
+	case "user", "assistant", "system":
+	case "developer":
+		role = "system"
+	default:
+		return chatMessage{}, fmt.Errorf("unexpected role %q", item.Role)
+	}
+
+	text, parts, err := responsesContent(item.Content)
+	if err != nil {
+		return chatMessage{}, fmt.Errorf("content: %w", err)
+	}
+	if role != "user" || len(parts) == 0 {
+		// Only user messages carry images
+		return chatMessage{Role: role, Content: text}, nil
+	}
+	if text != "" {
+		parts = append([]chatContentPart{{Type: "text", Text: text}}, parts...)
+	}
+	return chatMessage{Role: role, Content: parts}, nil
+}
+
+// responsesContent returns the joined text and the images of content given
+// either as a string or as content parts
+func responsesContent(raw json.RawMessage) (string, []chatContentPart, error) {
+	if len(raw) == 0 {
+		return "", nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil, nil
+	}
+	var parts []responsesPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil, fmt.Errorf("content must be a string or an array of content parts")
+	}
+
+	var texts []string
+	var images []chatContentPart
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text", "text":
+			texts = append(texts, part.Text)
+		case "refusal":
+			texts = append(texts, part.Refusal)
+		case "input_image":
+			if part.ImageURL == "" {
+				return "", nil, fmt.Errorf("input_image parts need an image_url, file IDs are not supported")
+			}
+			images = append(images, chatContentPart{Type: "image_url", ImageURL: &chatImageURL{URL: part.ImageURL, Detail: part.Detail}})
+		default:
+			return "", nil, fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+	}
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// newResponseID returns a random ID with the prefix of an object type, e.g. "resp"
+func newResponseID(prefix string) string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return prefix + "_" + hex.EncodeToString(b)
+}
+
+// responsesTranslator translates chat completions into Responses API answers
+// and stores the completed responses
+type responsesTranslator struct {
+	h            *ResponsesHandler
+	resp         responseObject
+	client       string
+	conversation []chatMessage // Messages sent without the instructions
+
+	// State of a translated stream
+	started  bool
+	sequence int
+	open     any             // The output item being streamed, nil when none is open
+	text     strings.Builder // Text of the open message or reasoning item
+	calls    map[int]*responseFunctionCall
+	finish   string
+	usage    *accounting.Tokens
+}
+
+func newResponsesTranslator(h *ResponsesHandler, req *responsesRequest, client string, conversation []chatMessage) *responsesTranslator {
+	resp := responseObject{
+		ID:                newResponseID("resp"),
+		Object:            "response",
+		CreatedAt:         time.Now().Unix(),
+		Status:            "in_progress",
+		Instructions:      req.Instructions,
+		MaxOutputTokens:   req.MaxOutputTokens,
+		Model:             req.Model,
+		Output:            []any{},
+		ParallelToolCalls: req.ParallelToolCalls == nil || *req.ParallelToolCalls,
+		Store:             req.Store == nil || *req.Store,
+		Temperature:       req.Temperature,
+		Text:              req.Text,
+		ToolChoice:        req.ToolChoice,
+		Tools:             req.Tools,
+		TopP:              req.TopP,
+		Metadata:          req.Metadata,
+	}
+	if req.PreviousResponseID != "" {
+		resp.PreviousResponseID = &req.PreviousResponseID
+	}
+	if req.User != "" {
+		resp.User = &req.User
+	}
+	if len(resp.Text) == 0 {
+		resp.Text = json.RawMessage(`{"format":{"type":"text"}}`)
+	}
+	if len(resp.ToolChoice) == 0 {
+		resp.ToolChoice = json.RawMessage(`"auto"`)
+	}
+	if len(resp.Tools) == 0 {
+		resp.Tools = json.RawMessage(`[]`)
+	}
+	if len(resp.Metadata) == 0 {
+		resp.Metadata = json.RawMessage(`{}`)
+	}
+	return &responsesTranslator{h: h, resp: resp, client: client, conversation: conversation, calls: make(map[int]*responseFunctionCall)}
+}
+
+func (rt *responsesTranslator) completion(w http.ResponseWriter, c *chatCompletion) {
+	finish := ""
+	if len(c.Choices) > 0 {
+		choice := c.Choices[0]
+		if thinking := choice.Message.ReasoningContent; thinking != "" {
+			rt.resp.Output = append(rt.resp.Output, &responseReasoning{
+				Type:    "reasoning",
+				ID:      newResponseID("rs"),
+				Summary: []responseSummaryText{{Type: "summary_text", Text: thinking}},
+			})
+		}
+		if choice.Message.Content != "" {
+			rt.resp.Output = append(rt.resp.Output, &responseMessage{
+				Type:    "message",
+				ID:      newResponseID("msg"),
+				Status:  "completed",
+				Role:    "assistant",
+				Content: []responseOutputText{{Type: "output_text", Text: choice.Message.Content, Annotations: []any{}}},
+			})
+		}
+		for _, call := range choice.Message.ToolCalls {
+			rt.resp.Output = append(rt.resp.Output, &responseFunctionCall{
+				Type:      "function_call",
+				ID:        newResponseID("fc"),
+				CallID:    call.ID,
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+				Status:    "completed",
+			})
+		}
+		finish = choice.FinishReason
+	}
+	rt.complete(finish, c.Usage)
+	writeJSON(w, http.StatusOK, rt.resp)
+}
+
+func (rt *responsesTranslator) chunk(w io.Writer, c *chatCompletionChunk) {
+	if !rt.started {
+		rt.started = true
+		rt.emit(w, "response.created", map[string]any{"response": rt.resp})
+		rt.emit(w, "response.in_progress", map[string]any{"response": rt.resp})
+	}
+	if c.Usage != nil {
+		rt.usage = c.Usage
+	}
+	if len(c.Choices) == 0 {
+		return
+	}
+
+	choice := c.Choices[0]
+	if delta := choice.Delta.ReasoningContent; delta != "" {
+		item, ok := rt.open.(*responseReasoning)
+		if !ok {
+			item = &responseReasoning{Type: "reasoning", ID: newResponseID("rs"), Summary: []responseSummaryText{}}
+			rt.openItem(w, item)
+			rt.emit(w, "response.reasoning_summary_part.added", map[string]any{
+				"item_id": item.ID, "output_index": rt.index(), "summary_index": 0,
+				"part": responseSummaryText{Type: "summary_text"},
+			})
+		}
+		rt.text.WriteString(delta)
+		rt.emit(w, "response.reasoning_summary_text.delta", map[string]any{
+			"item_id": item.ID, "output_index": rt.index(), "summary_index": 0, "delta": delta,
+		})
+	}
+	if delta := choice.Delta.Content; delta != "" {
+		item, ok := rt.open.(*responseMessage)
+		if !ok {
+			item = &responseMessage{Type: "message", ID: newResponseID("msg"), Status: "in_progress", Role: "assistant", Content: []responseOutputText{}}
+			rt.openItem(w, item)
+			rt.emit(w, "response.content_part.added", map[string]any{
+				"item_id": item.ID, "output_index": rt.index(), "content_index": 0,
+				"part": responseOutputText{Type: "output_text", Annotations: []any{}},
+			})
+		}
+		rt.text.WriteString(delta)
+		rt.emit(w, "response.output_text.delta", map[string]any{
+			"item_id": item.ID, "output_index": rt.index(), "content_index": 0, "delta": delta,
+		})
+	}
+	for i, call := range choice.Delta.ToolCalls {
+		callIndex := i
+		if call.Index != nil {
+			callIndex = *call.Index
+		}
+		item, ok := rt.calls[callIndex]
+		if !ok {
+			item = &responseFunctionCall{Type: "function_call", ID: newResponseID("fc"), CallID: call.ID, Name: call.Function.Name, Status: "in_progress"}
+			rt.calls[callIndex] = item
+			rt.openItem(w, item)
+		}
+		if call.Function.Arguments != "" {
+			item.Arguments += call.Function.Arguments
+			rt.emit(w, "response.function_call_arguments.delta", map[string]any{
+				"item_id": item.ID, "output_index": rt.indexOf(item), "delta": call.Function.Arguments,
+			})
+		}
+	}
+	if choice.FinishReason != "" {
+		rt.finish = choice.FinishReason
+	}
+}
+
+// openItem closes the open output item, if any, and starts streaming the given one
+func (rt *responsesTranslator) openItem(w io.Writer, item any) {
+	rt.closeItem(w)
+	rt.open = item
+	rt.text.Reset()
+	rt.resp.Output = append(rt.resp.Output, item)
+	rt.emit(w, "response.output_item.added", map[string]any{"output_index": rt.index(), "item": item})
+}
+
+// closeItem completes the open output item, if any
+func (rt *responsesTranslator) closeItem(w io.Writer) {
+	index := rt.index()
+	switch item := rt.open.(type) {
+	case *responseReasoning:
+		part := responseSummaryText{Type: "summary_text", Text: rt.text.String()}
+		item.Summary = []responseSummaryText{part}
+		rt.emit(w, "response.reasoning_summary_text.done", map[string]any{
+			"item_id": item.ID, "output_index": index, "summary_index": 0, "text": part.Text,
+		})
+		rt.emit(w, "response.reasoning_summary_part.done", map[string]any{
+			"item_id": item.ID, "output_index": index, "summary_index": 0, "part": part,
+		})
+	case *responseMessage:
+		part := responseOutputText{Type: "output_text", Text: rt.text.String(), Annotations: []any{}}
+		item.Content = []responseOutputText{part}
+		item.Status = "completed"
+		rt.emit(w, "response.output_text.done", map[string]any{
+			"item_id": item.ID, "output_index": index, "content_index": 0, "text": part.Text,
+		})
+		rt.emit(w, "response.content_part.done", map[string]any{
+			"item_id": item.ID, "output_index": index, "content_index": 0, "part": part,
+		})
+	case *responseFunctionCall:
+		item.Status = "completed"
+		rt.emit(w, "response.function_call_arguments.done", map[string]any{
+			"item_id": item.ID, "output_index": index, "arguments": item.Arguments,
+		})
+	default:
+		return
+	}
+	rt.emit(w, "response.output_item.done", map[string]any{"output_index": index, "item": rt.open})
+	rt.open = nil
+}
+
+// index returns the output index of the open item
+func (rt *responsesTranslator) index() int {
+	return rt.indexOf(rt.open)
+}
+
+func (rt *responsesTranslator) indexOf(item any) int {
+	for i, output := range rt.resp.Output {
+		if output == item {
+			return i
+		}
+	}
+	return -1
+}
+
+// emit writes a typed stream event, numbering it in sequence
+func (rt *responsesTranslator) emit(w io.Writer, eventType string, fields map[string]any) {
+	fields["type"] = eventType
+	fields["sequence_number"] = rt.sequence
+	rt.sequence++
+	writeEvent(w, eventType, fields)
+}
+
+func (rt *responsesTranslator) streamError(w io.Writer, message string) {
+	rt.resp.Status = "failed"
+	rt.resp.Error = &responseError{Code: "server_error", Message: message}
+	rt.emit(w, "response.failed", map[string]any{"response": rt.resp})
+}
+
+func (rt *responsesTranslator) streamEnd(w io.Writer) {
+	if !rt.started {
+		rt.chunk(w, &chatCompletionChunk{})
+	}
+	rt.closeItem(w)
+	rt.complete(rt.finish, rt.usage)
+	eventType := "response.completed"
+	if rt.resp.Status == "incomplete" {
+		eventType = "response.incomplete"
+	}
+	rt.emit(w, eventType, map[string]any{"response": rt.resp})
+}
+
+func (rt *responsesTranslator) error(w http.ResponseWriter, status int, message string) {
+	writeOpenAIError(w, status, responsesErrorType(status), "", message)
+}
+
+// complete sets the final status and usage of the response and stores it
+func (rt *responsesTranslator) complete(finishReason string, usage *accounting.Tokens) {
+	rt.resp.Status = "completed"
+	switch finishReason {
+	case "length":
+		rt.resp.Status = "incomplete"
+		rt.resp.IncompleteDetails = &incompleteDetails{Reason: "max_output_tokens"}
+	case "content_filter":
+		rt.resp.Status = "incomplete"
+		rt.resp.IncompleteDetails = &incompleteDetails{Reason: "content_filter"}
+	}
+	if usage != nil {
+		rt.resp.Usage = &responseUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens, TotalTokens: usage.TotalTokens}
+	}
+	if !rt.resp.Store {
+		return
+	}
+
+	answer := chatMessage{Role: "assistant"}
+	var text strings.Builder
+	for _, output := range rt.resp.Output {
+		switch item := output.(type) {
+		case *responseMessage:
+			for _, part := range item.Content {
+				text.WriteString(part.Text)
+			}
+		case *responseFunctionCall:
+			answer.ToolCalls = append(answer.ToolCalls, chatToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: chatFunctionCall{Name: item.Name, Arguments: item.Arguments},
+			})
+		}
+	}
+	if text.Len() > 0 || len(answer.ToolCalls) == 0 {
+		answer.Content = text.String()
+	}
+
+	messages, err := json.Marshal(append(rt.conversation, answer))
+	if err != nil {
+		return
+	}
+	response, err := json.Marshal(rt.resp)
+	if err != nil {
+		return
+	}
+	rt.h.store.Put(&responses.Entry{
+		ID:        rt.resp.ID,
+		Client:    rt.client,
+		CreatedAt: time.Unix(rt.resp.CreatedAt, 0),
+		Messages:  messages,
+		Response:  response,
+	})
+}
+
+// responsesErrorType maps the status of a failed request to an OpenAI error type
+func responsesErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 400 && status < 500:
+		return "invalid_request_error"
+	default:
+		return "server_error"
+	}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/upstream"
+)
+
+// route maps model name patterns to the upstream (and key pool) serving them
+type route struct {
+	patterns []string // Lower-cased glob patterns
+	upstream *upstream.Upstream
+}
+
+// Target is one model to try for a request together with the upstream serving it
+type Target struct {
+	Model    string
+	Upstream *upstream.Upstream
+}
+
+// Router resolves model aliases, fallback chains and the upstream for a requested
+// model. Without routing rules every model goes to the default upstream.
+type Router struct {
+	routes    []route
+	aliases   map[string]string   // Alias name to upstream model
+	fallbacks map[string][]string // Upstream model to the models tried after it
+	upstreams *upstream.Client
+}
+
+// NewRouter builds a router from the configured routing rules, model aliases and
+// fallback chains. Rules are evaluated in order and the first matching pattern wins.
+func NewRouter(routes []config.RouteSettings, aliases []config.AliasSettings, fallbacks []config.FallbackSettings, upstreams *upstream.Client) (*Router, error) {
+	router := &Router{
+		aliases:   make(map[string]string, len(aliases)),
+		fallbacks: make(map[string][]string, len(fallbacks)),
+		upstreams: upstreams,
+	}
+
+	for i, s := range aliases {
+		if s.Name == "" || s.Model == "" {
+			return nil, fmt.Errorf("alias #%d needs both a name and a model", i+1)
+		}
+		if _, exists := router.aliases[s.Name]; exists {
+			return nil, fmt.Errorf("duplicate model alias %q", s.Name)
+		}
+		router.aliases[s.Name] = s.Model
+	}
+
+	for i, s := range fallbacks {
+		if s.Model == "" || len(s.Fallbacks) == 0 {
+			return nil, fmt.Errorf("fallback chain #%d needs a model and at least one fallback", i+1)
+		}
+		model := router.Alias(s.Model)
+		if _, exists := router.fallbacks[model]; exists {
+			return nil, fmt.Errorf("duplicate fallback chain for model %q", model)
+		}
+		router.fallbacks[model] = s.Fallbacks
+	}
+
+	for i, s := range routes {
+		if len(s.Models) == 0 {
+			return nil, fmt.Errorf("route #%d has no model patterns", i+1)
+		}
+		up, ok := upstreams.Get(s.Upstream)
+		if !ok {
+			return nil, fmt.Errorf("route #%d refers to unknown upstream %q", i+1, s.Upstream)
+		}
+
+		rt := route{upstream: up}
+		for _, pattern := range s.Models {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if pattern == "" {
+				return nil, fmt.Errorf("route #%d has an empty model pattern", i+1)
+			}
+			rt.patterns = append(rt.patterns, pattern)
+		}
+		router.routes = append(router.routes, rt)
+	}
+	return router, nil
+}
+
+// HasRoutes reports whether any routing rules are configured
+func (rt *Router) HasRoutes() bool {
+	return len(rt.routes) > 0
+}
+
+// Resolve returns the upstream serving a model. It returns false when routing
+// rules are configured and none of them matches the model.
+func (rt *Router) Resolve(model string) (*upstream.Upstream, bool) {
+	if !rt.HasRoutes() {
+		return rt.upstreams.Default(), true
+	}
+
+	name := strings.ToLower(model)
+	for _, r := range rt.routes {
+		for _, pattern := range r.patterns {
+			if matchGlob(pattern, name) {
+				return r.upstream, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Alias returns the upstream model for a client-facing model name, or the name
+// itself when it is not an alias
+func (rt *Router) Alias(model string) string {
+	if target, ok := rt.aliases[model]; ok {
+		return target
+	}
+	return model
+}
+
+// Plan returns the models to try for a request in order: the requested model
+// with its alias resolved, followed by its fallback chain. Fallbacks without a
+// route are left out. It returns false when the requested model itself has no route.
+func (rt *Router) Plan(model string) ([]Target, bool) {
+	model = rt.Alias(model)
+	up, ok := rt.Resolve(model)
+	if !ok {
+		return nil, false
+	}
+
+	plan := []Target{{Model: model, Upstream: up}}
+	seen := map[string]bool{model: true}
+	for _, fallback := range rt.fallbacks[model] {
+		fallback = rt.Alias(fallback)
+		if seen[fallback] {
+			continue
+		}
+		seen[fallback] = true
+
+		up, ok := rt.Resolve(fallback)
+		if !ok {
+			continue
+		}
+		plan = append(plan, Target{Model: fallback, Upstream: up})
+	}
+	return plan, true
+}
+
+// Pools returns the key pools that may serve a request for a model: those of
+// the upstreams in its plan, or the default upstream's pool for a request
+// without a model. It returns nil when the model has no route.
+func (rt *Router) Pools(model string) []string {
+	plan, ok := rt.Plan(model)
+	if !ok {
+		if model != "" {
+			return nil
+		}
+		return []string{rt.upstreams.Default().Name}
+	}
+
+	var pools []string
+	for _, target := range plan {
+		if !slices.Contains(pools, target.Upstream.Name) {
+			pools = append(pools, target.Upstream.Name)
+		}
+	}
+	return pools
+}
+
+// Targets returns the distinct upstreams that routing rules point to, in rule
+// order, or only the default upstream when no rules are configured
+func (rt *Router) Targets() []*upstream.Upstream {
+	if !rt.HasRoutes() {
+		return []*upstream.Upstream{rt.upstreams.Default()}
+	}
+
+	var targets []*upstream.Upstream
+	seen := make(map[string]bool)
+	for _, r := range rt.routes {
+		if !seen[r.upstream.Name] {
+			seen[r.upstream.Name] = true
+			targets = append(targets, r.upstream)
+		}
+	}
+	return targets
+}
+
+// modelAllowed reports whether any of the allowed model patterns matches the
+// requested model or the model its alias resolves to. No patterns allow every model.
+func modelAllowed(patterns []string, requested, resolved string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	requested, resolved = strings.ToLower(requested), strings.ToLower(resolved)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if matchGlob(pattern, requested) || matchGlob(pattern, resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches name against a pattern where '*' matches any sequence of
+// characters (including '/') and '?' matches exactly one character
+func matchGlob(pattern, name string) bool {
+	p, n := 0, 0
+	starP, starN := -1, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case p < len(pattern) && pattern[p] == '*':
+			// Remember the star and first try to match it against nothing
+			starP, starN = p, n
+			p++
+		case starP >= 0:
+			// Let the last star swallow one more character
+			starN++
+			p, n = starP+1, starN
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
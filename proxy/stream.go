@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// errFirstByteTimeout is reported when the upstream does not start answering in time
+	errFirstByteTimeout = errors.New("upstream first byte timeout")
+	// errIdleTimeout is reported when the upstream stops sending data mid-response
+	errIdleTimeout = errors.New("upstream idle timeout")
+)
+
+// watchdog cancels an upstream request when its timer fires
+type watchdog struct {
+	timer   *time.Timer
+	expired atomic.Bool
+	idle    atomic.Bool // Whether the watchdog is guarding idle time rather than the first byte
+}
+
+// newWatchdog starts a watchdog that calls cancel if it is not reset within d
+func newWatchdog(d time.Duration, cancel context.CancelFunc) *watchdog {
+	wd := &watchdog{}
+	wd.timer = time.AfterFunc(d, func() {
+		wd.expired.Store(true)
+		cancel()
+	})
+	return wd
+}
+
+// reset switches the watchdog into idle mode and restarts its timer
+func (wd *watchdog) reset(d time.Duration) {
+	wd.idle.Store(true)
+	wd.timer.Reset(d)
+}
+
+// stop disarms the watchdog
+func (wd *watchdog) stop() {
+	wd.timer.Stop()
+}
+
+// wrap translates a context cancellation caused by the watchdog into a timeout error
+func (wd *watchdog) wrap(err error) error {
+	if err == nil || !wd.expired.Load() {
+		return err
+	}
+	if wd.idle.Load() {
+		return errIdleTimeout
+	}
+	return errFirstByteTimeout
+}
+
+// idleReader resets the watchdog every time data is read from the upstream body
+type idleReader struct {
+	r       io.Reader
+	wd      *watchdog
+	timeout time.Duration
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.wd.reset(ir.timeout)
+	}
+	return n, ir.wd.wrap(err)
+}
+
+// sseEvent is a single raw server-sent event including its trailing blank line
+type sseEvent struct {
+	raw  []byte // Exact bytes received from upstream, forwarded unchanged
+	data []byte // Concatenated payload of the event's data: lines
+	name string // Value of the event: field, if any
+}
+
+// sseReader splits an upstream body into server-sent events
+type sseReader struct {
+	br *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{br: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// next reads the next complete event. At EOF a trailing partial event is
+// returned together with io.EOF.
+func (sr *sseReader) next() (*sseEvent, error) {
+	ev := &sseEvent{}
+	for {
+		line, err := sr.br.ReadBytes('\n')
+		if len(line) > 0 {
+			ev.raw = append(ev.raw, line...)
+			trimmed := bytes.TrimRight(line, "\r\n")
+			if len(trimmed) == 0 {
+				// A blank line terminates the event
+				return ev, nil
+			}
+			if value, ok := bytes.CutPrefix(trimmed, []byte("data:")); ok {
+				if len(ev.data) > 0 {
+					ev.data = append(ev.data, '\n')
+				}
+				ev.data = append(ev.data, bytes.TrimPrefix(value, []byte(" "))...)
+			} else if value, ok := bytes.CutPrefix(trimmed, []byte("event:")); ok {
+				ev.name = string(bytes.TrimSpace(value))
+			}
+		}
+		if err != nil {
+			if len(ev.raw) > 0 && err == io.EOF {
+				return ev, io.EOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// upstreamError extracts the error message from an event that reports an
+// upstream failure, returning false for regular completion chunks
+func (ev *sseEvent) upstreamError() (string, bool) {
+	if ev.name == "error" {
+		return string(ev.data), true
+	}
+	if len(ev.data) == 0 || bytes.Equal(ev.data, []byte("[DONE]")) {
+		return "", false
+	}
+
+	var payload struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(ev.data, &payload); err != nil {
+		return "", false
+	}
+	if len(payload.Error) == 0 || bytes.Equal(payload.Error, []byte("null")) {
+		return "", false
+	}
+	return string(payload.Error), true
+}
+
+// isEventStream reports whether the upstream answered with a server-sent event stream
+func isEventStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
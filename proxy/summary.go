@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/loseleaf/modelscope-balancer/accounting"
+	"github.com/loseleaf/modelscope-balancer/events"
+	"github.com/loseleaf/modelscope-balancer/keymanager"
+	"github.com/loseleaf/modelscope-balancer/upstream"
+)
+
+// Summary describes a served API request. Keys are identified by ID and
+// fingerprint only, never by value.
+type Summary struct {
+	ID          string             `json:"id"`                   // Unique ID of the summary
+	RequestID   string             `json:"request_id,omitempty"` // ID assigned by the request ID middleware
+	Time        time.Time          `json:"time"`
+	Method      string             `json:"method"`
+	Route       string             `json:"route"`           // Route pattern, grouping requests to the same endpoint
+	Path        string             `json:"path,omitempty"`  // Requested path
+	Query       string             `json:"query,omitempty"` // Raw query string, without a key parameter
+	Status      int                `json:"status"`
+	LatencyMS   int64              `json:"latency_ms"`
+	Model       string             `json:"model,omitempty"`      // Requested model
+	ModelUsed   string             `json:"model_used,omitempty"` // Model of the last attempt, after aliases and fallbacks
+	Upstream    string             `json:"upstream,omitempty"`
+	KeyID       string             `json:"key_id,omitempty"` // Key of the last attempt
+	Fingerprint string             `json:"fingerprint,omitempty"`
+	Attempts    int                `json:"attempts"`
+	Client      string             `json:"client,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
+	Tokens      *accounting.Tokens `json:"tokens,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	ReplayOf    string             `json:"replay_of,omitempty"` // ID of the summary of the replayed request
+
+	// Bodies are only captured for a Recorder that asks for them
+	RequestBody       string `json:"request_body,omitempty"`
+	ResponseBody      string `json:"response_body,omitempty"`
+	RequestTruncated  bool   `json:"request_truncated,omitempty"` // Whether a body exceeded the capture limit
+	ResponseTruncated bool   `json:"response_truncated,omitempty"`
+	RequestRedacted   bool   `json:"request_redacted,omitempty"` // Whether credentials were removed from the logged request body
+}
+
+// Recorder keeps the summaries of served requests
+type Recorder interface {
+	// Record stores the summary of a served request
+	Record(s Summary)
+	// BodyLimit returns how many bytes of the request and response bodies to
+	// capture, or 0 to capture none
+	BodyLimit() int
+}
+
+// requestSummary collects the summary of a request while it is served
+type requestSummary struct {
+	mu        sync.Mutex
+	summary   Summary
+	bodyLimit int
+}
+
+// summaryKey is the request context key of the requestSummary
+type summaryKey struct{}
+
+// replayKey is the request context key of the ID of a replayed summary
+type replayKey struct{}
+
+// WithReplay marks the request of ctx as a replay of the request summarized by id
+func WithReplay(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, replayKey{}, id)
+}
+
+// newSummaryID returns a random summary ID
+func newSummaryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
+
+// updateSummary applies fn to the summary of the request being served, if any
+func updateSummary(ctx context.Context, fn func(s *Summary)) {
+	if rs, ok := ctx.Value(summaryKey{}).(*requestSummary); ok {
+		rs.mu.Lock()
+		fn(&rs.summary)
+		rs.mu.Unlock()
+	}
+}
+
+// summarizeRequest records the requested model and the client of a request
+func summarizeRequest(r *http.Request, model string, stream bool) {
+	updateSummary(r.Context(), func(s *Summary) {
+		s.Model = model
+		s.Stream = stream
+		s.Client = clientName(r)
+	})
+}
+
+// summarizeBody captures the request body if the recorder asked for bodies
+func summarizeBody(r *http.Request, body []byte) {
+	if rs, ok := r.Context().Value(summaryKey{}).(*requestSummary); ok && rs.bodyLimit > 0 {
+		rs.mu.Lock()
+		if len(body) > rs.bodyLimit {
+			body = body[:rs.bodyLimit]
+			rs.summary.RequestTruncated = true
+		}
+		rs.summary.RequestBody = string(body)
+		rs.mu.Unlock()
+	}
+}
+
+// summarizeAttempt records an upstream attempt made with a key
+func summarizeAttempt(ctx context.Context, up *upstream.Upstream, model string, apiKey *keymanager.ApiKey) {
+	updateSummary(ctx, func(s *Summary) {
+		s.Attempts++
+		s.Upstream = up.Name
+		s.ModelUsed = model
+		s.KeyID = apiKey.ID
+		s.Fingerprint = apiKey.Fingerprint
+	})
+}
+
+// summarizeResult records the token usage of a successful request, or why it failed
+func summarizeResult(ctx context.Context, tokens *accounting.Tokens, err error) {
+	updateSummary(ctx, func(s *Summary) {
+		s.Tokens = tokens
+		s.Error = ""
+		if err != nil {
+			s.Error = err.Error()
+		}
+	})
+}
+
+// summaryWriter captures the status code written by a handler and, up to limit
+// bytes, the response body
+type summaryWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (sw *summaryWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *summaryWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if room := sw.limit - sw.body.Len(); room > 0 {
+		sw.body.Write(p[:min(len(p), room)])
+		sw.truncated = sw.truncated || len(p) > room
+	} else if sw.limit > 0 {
+		sw.truncated = true
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush keeps streamed responses flowing through the writer
+func (sw *summaryWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sw *summaryWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Summarize collects a Summary of every request it wraps. Once the request was
+// served, the summary is published as a request_completed event and passed to
+// recorder, if not nil.
+func Summarize(recorder Recorder) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			summarize(recorder, next, w, r)
+		})
+	}
+}
+
+// summarize serves a request with next and reports its summary
+func summarize(recorder Recorder, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rs := &requestSummary{}
+	if recorder != nil {
+		rs.bodyLimit = recorder.BodyLimit()
+	}
+	sw := &summaryWriter{ResponseWriter: w, limit: rs.bodyLimit}
+
+	next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), summaryKey{}, rs)))
+
+	// Wildcard routes are summarized with their path, which names the model and
+	// method of the request
+	route := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" && !strings.HasSuffix(rctx.RoutePattern(), "*") {
+		route = rctx.RoutePattern()
+	}
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	rs.mu.Lock()
+	summary := rs.summary
+	rs.mu.Unlock()
+	summary.ID = newSummaryID()
+	summary.RequestID = middleware.GetReqID(r.Context())
+	summary.Time = start
+	summary.Method = r.Method
+	summary.Route = route
+	summary.Path = r.URL.Path
+	summary.Query = loggedQuery(r.URL)
+	summary.Status = status
+	summary.LatencyMS = time.Since(start).Milliseconds()
+	summary.ReplayOf, _ = r.Context().Value(replayKey{}).(string)
+	if sw.limit > 0 {
+		summary.ResponseBody = sw.body.String()
+		summary.ResponseTruncated = sw.truncated
+	}
+
+	events.Publish(summary.event())
+	if recorder != nil {
+		recorder.Record(summary)
+	}
+}
+
+// loggedQuery returns the raw query of a request without the key parameter,
+// which Gemini clients may use to pass their API key
+func loggedQuery(u *url.URL) string {
+	query := u.Query()
+	if !query.Has("key") {
+		return u.RawQuery
+	}
+	query.Del("key")
+	return query.Encode()
+}
+
+// event returns the request_completed event of a summary
+func (s Summary) event() events.Event {
+	data := map[string]any{
+		"summary_id":   s.ID,
+		"request_id":   s.RequestID,
+		"method":       s.Method,
+		"route":        s.Route,
+		"status":       s.Status,
+		"latency_ms":   s.LatencyMS,
+		"model":        s.Model,
+		"model_used":   s.ModelUsed,
+		"attempts":     s.Attempts,
+		"client":       s.Client,
+		"stream":       s.Stream,
+		"total_tokens": totalTokens(s.Tokens),
+	}
+	if s.Error != "" {
+		data["error"] = s.Error
+	}
+	if s.ReplayOf != "" {
+		data["replay_of"] = s.ReplayOf
+	}
+	return events.Event{
+		Type:        events.RequestCompleted,
+		Pool:        s.Upstream,
+		KeyID:       s.KeyID,
+		Fingerprint: s.Fingerprint,
+		Data:        data,
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/loseleaf/modelscope-balancer/keymanager"
+	"github.com/loseleaf/modelscope-balancer/tracing"
+	"github.com/loseleaf/modelscope-balancer/upstream"
+)
+
+// startAttemptSpan starts the span of one upstream attempt made with a key. The
+// upstream request inherits its trace context through the returned context.
+func startAttemptSpan(ctx context.Context, name string, up *upstream.Upstream, model string, apiKey *keymanager.ApiKey, attempt int) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("msb.upstream", up.Name),
+			attribute.String("msb.model", model),
+			attribute.String("msb.key.id", apiKey.ID),
+			attribute.String("msb.key.fingerprint", apiKey.Fingerprint),
+			attribute.String("msb.key.status", string(apiKey.Status)),
+			attribute.Int("msb.attempt", attempt+1),
+		))
+}
+
+// endAttemptSpan records the result of an upstream attempt, "success" or its
+// failure class, and ends its span
+func endAttemptSpan(span trace.Span, result string, err error) {
+	span.SetAttributes(attribute.String("msb.result", result))
+
+	var statusErr *upstreamStatusError
+	switch {
+	case err == nil:
+		span.SetAttributes(attribute.Int("http.response.status_code", http.StatusOK))
+	case errors.As(err, &statusErr):
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", statusErr.status),
+			attribute.String("msb.failure_class", result))
+		span.SetStatus(codes.Error, err.Error())
+	default:
+		span.SetAttributes(attribute.String("msb.failure_class", result))
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/loseleaf/modelscope-balancer/accounting"
+)
+
+// chatCompletionRequest is a chat completion request built by the handlers that
+// translate other APIs into chat completions
+type chatCompletionRequest struct {
+	Model             string             `json:"model"`
+	Messages          []chatMessage      `json:"messages"`
+	MaxTokens         *int               `json:"max_tokens,omitempty"`
+	Temperature       *float64           `json:"temperature,omitempty"`
+	TopP              *float64           `json:"top_p,omitempty"`
+	TopK              *int               `json:"top_k,omitempty"`
+	Stop              []string           `json:"stop,omitempty"`
+	Stream            bool               `json:"stream,omitempty"`
+	StreamOptions     *chatStreamOptions `json:"stream_options,omitempty"`
+	Tools             []chatTool         `json:"tools,omitempty"`
+	ToolChoice        any                `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool              `json:"parallel_tool_calls,omitempty"`
+	N                 *int               `json:"n,omitempty"`
+	Seed              *int64             `json:"seed,omitempty"`
+	PresencePenalty   *float64           `json:"presence_penalty,omitempty"`
+	FrequencyPenalty  *float64           `json:"frequency_penalty,omitempty"`
+	ResponseFormat    any                `json:"response_format,omitempty"`
+	User              string             `json:"user,omitempty"`
+	EnableThinking    *bool              `json:"enable_thinking,omitempty"` // ModelScope switch for reasoning models
+}
+
+// chatStreamOptions asks for a final usage chunk in streamed completions
+type chatStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// chatMessage is a message of a chat completion request
+type chatMessage struct {
+	Role       string         `json:"role"`
+	Content    any            `json:"content"` // A string, []chatContentPart or nil
+	ToolCalls  []chatToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+// chatContentPart is a part of a multimodal message
+type chatContentPart struct {
+	Type     string        `json:"type"` // "text" or "image_url"
+	Text     string        `json:"text,omitempty"`
+	ImageURL *chatImageURL `json:"image_url,omitempty"`
+}
+
+type chatImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// chatTool declares a function the model may call
+type chatTool struct {
+	Type     string       `json:"type"`
+	Function chatFunction `json:"function"`
+}
+
+type chatFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// chatToolCall is a function call made by the model. In stream chunks only
+// Index is always set and the arguments arrive in pieces.
+type chatToolCall struct {
+	Index    *int             `json:"index,omitempty"`
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function chatFunctionCall `json:"function"`
+}
+
+type chatFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// chatCompletion is a complete chat completion response
+type chatCompletion struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Created int64  `json:"created"`
+	Choices []struct {
+		Index        int                `json:"index"`
+		Message      chatResponseOutput `json:"message"`
+		FinishReason string             `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *accounting.Tokens `json:"usage"`
+}
+
+// chatCompletionChunk is one chunk of a streamed chat completion
+type chatCompletionChunk struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Created int64  `json:"created"`
+	Choices []struct {
+		Index        int                `json:"index"`
+		Delta        chatResponseOutput `json:"delta"`
+		FinishReason string             `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *accounting.Tokens `json:"usage"`
+}
+
+// chatResponseOutput is the message of a completion or the delta of a chunk
+type chatResponseOutput struct {
+	Role             string         `json:"role"`
+	Content          string         `json:"content"`
+	ReasoningContent string         `json:"reasoning_content"` // Thinking of reasoning models
+	ToolCalls        []chatToolCall `json:"tool_calls"`
+}
+
+// chatTranslator turns chat completion answers into the answers of another API
+type chatTranslator interface {
+	// completion writes the translation of a complete chat completion
+	completion(w http.ResponseWriter, c *chatCompletion)
+	// chunk writes the events for one chunk of a streamed completion
+	chunk(w io.Writer, c *chatCompletionChunk)
+	// streamError reports a failure of the upstream after the stream started
+	streamError(w io.Writer, message string)
+	// streamEnd writes the closing events of a stream that ended normally
+	streamEnd(w io.Writer)
+	// error answers a failed request
+	error(w http.ResponseWriter, status int, message string)
+}
+
+// translatedHeaders are the response headers of a chat completion that are kept
+// in a translated answer
+var translatedHeaders = []string{modelUsedHeader, "Retry-After", "X-Request-Id"}
+
+// translatingWriter receives the answer of a chat completion and writes its
+// translation to the client. Streams are translated chunk by chunk as they
+// arrive; other answers are translated by finish.
+type translatingWriter struct {
+	w          http.ResponseWriter
+	translator chatTranslator
+	header     http.Header
+	status     int
+	streamType string // Content type of a translated stream
+	streaming  bool
+	failed     bool         // Whether the stream reported an upstream error
+	pending    bytes.Buffer // Partial stream events, or the complete body of other answers
+}
+
+func newTranslatingWriter(w http.ResponseWriter, translator chatTranslator) *translatingWriter {
+	return &translatingWriter{w: w, translator: translator, header: make(http.Header), streamType: "text/event-stream"}
+}
+
+func (tw *translatingWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *translatingWriter) WriteHeader(status int) {
+	if tw.status != 0 {
+		return
+	}
+	tw.status = status
+	for _, name := range translatedHeaders {
+		if value := tw.header.Get(name); value != "" {
+			tw.w.Header().Set(name, value)
+		}
+	}
+	if status != http.StatusOK || !strings.HasPrefix(tw.header.Get("Content-Type"), "text/event-stream") {
+		return
+	}
+
+	tw.streaming = true
+	tw.w.Header().Set("Content-Type", tw.streamType)
+	tw.w.Header().Set("Cache-Control", "no-cache")
+	tw.w.WriteHeader(http.StatusOK)
+}
+
+func (tw *translatingWriter) Write(p []byte) (int, error) {
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	tw.pending.Write(p)
+	if tw.streaming {
+		tw.translateEvents()
+	}
+	return len(p), nil
+}
+
+// Flush sends the translated events written so far to the client
+func (tw *translatingWriter) Flush() {
+	if flusher, ok := tw.w.(http.Flusher); ok && tw.streaming {
+		flusher.Flush()
+	}
+}
+
+// translateEvents translates every complete event of the pending stream data
+func (tw *translatingWriter) translateEvents() {
+	for {
+		data := tw.pending.Bytes()
+		end := bytes.Index(data, []byte("\n\n"))
+		if crlf := bytes.Index(data, []byte("\r\n\r\n")); crlf >= 0 && (end < 0 || crlf < end) {
+			end = crlf + 2
+		}
+		if end < 0 {
+			return
+		}
+		ev, _ := newSSEReader(bytes.NewReader(data[:end+2])).next()
+		tw.pending.Next(end + 2)
+		if ev != nil {
+			tw.translateEvent(ev)
+		}
+	}
+}
+
+// translateEvent translates one event of a chat completion stream
+func (tw *translatingWriter) translateEvent(ev *sseEvent) {
+	if tw.failed {
+		return
+	}
+	if message, isErr := ev.upstreamError(); isErr {
+		tw.failed = true
+		tw.translator.streamError(tw.w, message)
+		return
+	}
+	if len(ev.data) == 0 || bytes.Equal(ev.data, []byte("[DONE]")) {
+		return
+	}
+
+	var chunk chatCompletionChunk
+	if err := json.Unmarshal(ev.data, &chunk); err != nil {
+		return
+	}
+	tw.translator.chunk(tw.w, &chunk)
+}
+
+// finish completes the translated answer once the chat completion was served
+func (tw *translatingWriter) finish() {
+	switch {
+	case tw.status == 0:
+		// Nothing was answered, e.g. because the client went away
+	case tw.streaming:
+		if tw.pending.Len() > 0 {
+			tw.pending.WriteString("\n\n")
+			tw.translateEvents()
+		}
+		if !tw.failed {
+			tw.translator.streamEnd(tw.w)
+		}
+		tw.Flush()
+	case tw.status != http.StatusOK:
+		tw.translator.error(tw.w, tw.status, errorMessage(tw.pending.Bytes()))
+	default:
+		var completion chatCompletion
+		if err := json.Unmarshal(tw.pending.Bytes(), &completion); err != nil {
+			tw.translator.error(tw.w, http.StatusBadGateway, "The upstream returned an invalid chat completion")
+			return
+		}
+		tw.translator.completion(tw.w, &completion)
+	}
+}
+
+// errorMessage extracts the message of an OpenAI-style error body, falling back
+// to the body itself for plain-text errors
+func errorMessage(body []byte) string {
+	var payload struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil && len(payload.Error) > 0 {
+		var detail struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(payload.Error, &detail) == nil && detail.Message != "" {
+			return detail.Message
+		}
+		var message string
+		if json.Unmarshal(payload.Error, &message) == nil && message != "" {
+			return message
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// writeJSON answers a request with a JSON body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeEvent writes a named server-sent event with a JSON payload
+func writeEvent(w io.Writer, name string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if name != "" {
+		io.WriteString(w, "event: "+name+"\n")
+	}
+	io.WriteString(w, "data: ")
+	w.Write(data)
+	io.WriteString(w, "\n\n")
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/loseleaf/modelscope-balancer/accounting"
+)
+
+// extractUsage returns the usage object of a completion response or stream
+// chunk, or nil when it carries none
+func extractUsage(data []byte) *accounting.Tokens {
+	var payload struct {
+		Usage *accounting.Tokens `json:"usage"`
+	}
+	if json.Unmarshal(data, &payload) != nil || payload.Usage == nil {
+		return nil
+	}
+	if payload.Usage.TotalTokens == 0 {
+		payload.Usage.TotalTokens = payload.Usage.PromptTokens + payload.Usage.CompletionTokens
+	}
+	return payload.Usage
+}
+
+// isUsageOnlyChunk reports whether a stream chunk is the final chunk that only
+// carries usage, as sent when stream_options.include_usage is set
+func isUsageOnlyChunk(data []byte) bool {
+	var payload struct {
+		Choices []json.RawMessage `json:"choices"`
+		Usage   json.RawMessage   `json:"usage"`
+	}
+	if json.Unmarshal(data, &payload) != nil {
+		return false
+	}
+	return len(payload.Choices) == 0 && len(payload.Usage) > 0 && !bytes.Equal(payload.Usage, []byte("null"))
+}
+
+// requestStreamUsage makes a streaming request ask the upstream for a final usage
+// chunk. injected reports whether the client had not asked for it itself, in
+// which case that chunk must not reach the client.
+func requestStreamUsage(body []byte) (rewritten []byte, injected bool, err error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, false, err
+	}
+
+	options := make(map[string]json.RawMessage)
+	if raw, ok := fields["stream_options"]; ok && !bytes.Equal(raw, []byte("null")) {
+		if err := json.Unmarshal(raw, &options); err != nil {
+			return nil, false, err
+		}
+	}
+	var includeUsage bool
+	if raw, ok := options["include_usage"]; ok {
+		json.Unmarshal(raw, &includeUsage)
+	}
+	if includeUsage {
+		return body, false, nil
+	}
+
+	options["include_usage"] = json.RawMessage("true")
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return nil, false, err
+	}
+	fields["stream_options"] = encoded
+
+	rewritten, err = json.Marshal(fields)
+	if err != nil {
+		return nil, false, err
+	}
+	return rewritten, true, nil
+}
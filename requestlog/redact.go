@@ -0,0 +1,97 @@
+package requestlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces removed credentials
+const redacted = "[REDACTED]"
+
+// secretFields are JSON fields whose values are removed wherever they appear
+var secretFields = map[string]bool{
+	"api_key":       true,
+	"apikey":        true,
+	"authorization": true,
+	"access_token":  true,
+	"refresh_token": true,
+	"token":         true,
+	"password":      true,
+	"secret":        true,
+}
+
+// secretPatterns match credentials inside free text, such as keys pasted into a prompt
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/=-]{8,}`),
+	regexp.MustCompile(`\bms-[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`), // ModelScope access tokens
+	regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{16,}`),
+}
+
+// Redact removes credentials from a request or response body and reports
+// whether any were found. JSON bodies keep their structure; other bodies, such
+// as event streams, are redacted as text. A body without credentials is
+// returned unchanged.
+func Redact(body string) (string, bool) {
+	if body == "" {
+		return body, false
+	}
+
+	var value any
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	if decoder.Decode(&value) != nil || decoder.More() {
+		text := redactText(body)
+		return text, text != body
+	}
+	changed := false
+	value = redactValue(value, &changed)
+	if !changed {
+		return body, false
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if encoder.Encode(value) != nil {
+		return redactText(body), true
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), true
+}
+
+// redactValue redacts a decoded JSON value, setting changed when it removed a credential
+func redactValue(value any, changed *bool) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for name, field := range v {
+			if secretFields[strings.ToLower(name)] {
+				v[name] = redacted
+				*changed = true
+			} else {
+				v[name] = redactValue(field, changed)
+			}
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(item, changed)
+		}
+		return v
+	case string:
+		text := redactText(v)
+		if text != v {
+			*changed = true
+		}
+		return text
+	default:
+		return v
+	}
+}
+
+// redactText replaces credentials found in text
+func redactText(text string) string {
+	for _, pattern := range secretPatterns {
+		text = pattern.ReplaceAllString(text, redacted)
+	}
+	return text
+}
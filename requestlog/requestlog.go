@@ -0,0 +1,323 @@
+// Package requestlog keeps the summaries of served API requests in a rotating
+// JSONL file and searches them.
+package requestlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/proxy"
+)
+
+// Body capture modes
+const (
+	BodiesNone     = "none"     // Metadata only
+	BodiesRedacted = "redacted" // Bodies with credentials removed
+	BodiesFull     = "full"     // Bodies as sent and received
+)
+
+// Defaults of the request log settings
+const (
+	DefaultPath      = "logs/requests.jsonl"
+	defaultMaxSizeMB = 50
+	defaultMaxFiles  = 5
+	defaultMaxBody   = 64 * 1024
+)
+
+// maxLineSize bounds a single entry read back from the log
+const maxLineSize = 16 * 1024 * 1024
+
+// maxBodyLimit caps max_body_bytes. JSON escaping grows a body by at most six
+// times, so an entry with both bodies at this size still fits in maxLineSize.
+const maxBodyLimit = 1024 * 1024
+
+// ErrNotFound is returned when no logged request has the requested ID
+var ErrNotFound = errors.New("request not found in log")
+
+// Log appends request summaries to a JSONL file. Once the file exceeds its size
+// limit it is renamed to <path>.1, older files move up by one, and files beyond
+// the configured count are deleted.
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+	bodies   string
+	maxBody  int
+	logger   *slog.Logger
+}
+
+// Open validates the settings and opens the request log for appending
+func Open(settings config.RequestLogSettings, logger *slog.Logger) (*Log, error) {
+	l := &Log{
+		path:     settings.Path,
+		maxSize:  int64(settings.MaxSizeMB) * 1024 * 1024,
+		maxFiles: settings.MaxFiles,
+		bodies:   settings.Bodies,
+		maxBody:  settings.MaxBodyBytes,
+		logger:   logger,
+	}
+	if l.path == "" {
+		l.path = DefaultPath
+	}
+	if l.maxSize <= 0 {
+		l.maxSize = defaultMaxSizeMB * 1024 * 1024
+	}
+	if l.maxFiles <= 0 {
+		l.maxFiles = defaultMaxFiles
+	}
+	if l.maxBody <= 0 {
+		l.maxBody = defaultMaxBody
+	}
+	if l.maxBody > maxBodyLimit {
+		logger.Warn("Request log max_body_bytes is too large, capping it", "max_body_bytes", l.maxBody, "cap", maxBodyLimit)
+		l.maxBody = maxBodyLimit
+	}
+	switch l.bodies {
+	case "":
+		l.bodies = BodiesNone
+	case BodiesNone, BodiesRedacted, BodiesFull:
+	default:
+		return nil, fmt.Errorf("unknown request log bodies mode %q, supported: none, redacted, full", settings.Bodies)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create request log directory: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current log file for appending. The caller must hold the lock
+// or own the log exclusively.
+func (l *Log) open() error {
+	// Bodies may hold prompts and answers, so the log is private to the balancer's user
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open request log %s: %w", l.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open request log %s: %w", l.path, err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// BodyLimit returns how many bytes of each body to capture, 0 when bodies are not logged
+func (l *Log) BodyLimit() int {
+	if l.bodies == BodiesNone {
+		return 0
+	}
+	return l.maxBody
+}
+
+// Record appends the summary of a request to the log
+func (l *Log) Record(s proxy.Summary) {
+	if l.bodies == BodiesRedacted {
+		s.RequestBody, s.RequestRedacted = Redact(s.RequestBody)
+		s.ResponseBody, _ = Redact(s.ResponseBody)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		l.logger.Error("Failed to encode request log entry", "id", s.ID, "error", err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.logger.Error("Failed to rotate request log", "path", l.path, "error", err)
+			if l.file == nil {
+				return
+			}
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		l.logger.Error("Failed to write request log entry", "path", l.path, "error", err)
+	}
+}
+
+// rotate moves the current file to <path>.1 and starts a new one. The caller
+// must hold the lock.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		l.logger.Warn("Failed to close request log before rotating", "error", err)
+	}
+	l.file = nil
+
+	os.Remove(l.rotatedPath(l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.rotatedPath(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// rotatedPath returns the path of the i-th most recently rotated file, the
+// current file for 0
+func (l *Log) rotatedPath(i int) string {
+	if i == 0 {
+		return l.path
+	}
+	return l.path + "." + strconv.Itoa(i)
+}
+
+// Close closes the log file. Requests served afterwards are not recorded.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// String returns the path of the current log file
+func (l *Log) String() string {
+	return l.path
+}
+
+// Query selects logged requests. Zero fields match every request.
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Client string
+	Model  string // Requested model or the model that answered
+	Key    string // Key ID or fingerprint
+	Route  string
+	Status string // Exact status code such as "429", or a class such as "5xx"
+	Errors bool   // Only failed requests
+	Limit  int
+}
+
+// matches reports whether a logged request is selected by the query
+func (q Query) matches(s *proxy.Summary) bool {
+	switch {
+	case !q.From.IsZero() && s.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && !s.Time.Before(q.To):
+		return false
+	case q.Client != "" && s.Client != q.Client:
+		return false
+	case q.Model != "" && s.Model != q.Model && s.ModelUsed != q.Model:
+		return false
+	case q.Key != "" && s.KeyID != q.Key && s.Fingerprint != q.Key:
+		return false
+	case q.Route != "" && s.Route != q.Route:
+		return false
+	case q.Errors && s.Status < 400:
+		return false
+	}
+	if q.Status != "" {
+		status := strconv.Itoa(s.Status)
+		if class, ok := strings.CutSuffix(strings.ToLower(q.Status), "xx"); ok {
+			return strings.HasPrefix(status, class)
+		}
+		return status == q.Status
+	}
+	return true
+}
+
+// Search returns the logged requests selected by the query, newest first. The
+// bodies are left out of the results.
+func (l *Log) Search(q Query) ([]proxy.Summary, error) {
+	results := []proxy.Summary{}
+	for i := 0; i <= l.maxFiles; i++ {
+		var matches []proxy.Summary
+		err := l.scan(l.rotatedPath(i), func(s *proxy.Summary) bool {
+			if q.matches(s) {
+				s.RequestBody, s.ResponseBody = "", ""
+				matches = append(matches, *s)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Files are in chronological order
+		for j := len(matches) - 1; j >= 0; j-- {
+			results = append(results, matches[j])
+			if q.Limit > 0 && len(results) >= q.Limit {
+				return results, nil
+			}
+		}
+	}
+	return results, nil
+}
+
+// Get returns a logged request including its bodies
+func (l *Log) Get(id string) (*proxy.Summary, error) {
+	var found *proxy.Summary
+	for i := 0; i <= l.maxFiles && found == nil; i++ {
+		err := l.scan(l.rotatedPath(i), func(s *proxy.Summary) bool {
+			if s.ID == id {
+				found = s
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// scan calls fn with every entry of a log file until fn returns false. A
+// missing file has no entries, and malformed lines are skipped.
+func (l *Log) scan(path string, fn func(s *proxy.Summary) bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		var s proxy.Summary
+		if json.Unmarshal(scanner.Bytes(), &s) != nil {
+			continue
+		}
+		if !fn(&s) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,202 @@
+package responses
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/atomicfile"
+	"github.com/loseleaf/modelscope-balancer/config"
+)
+
+// storePath is the file stored responses are persisted to
+const storePath = "responses.json"
+
+// Entry is a stored response of the Responses API together with the
+// conversation that led to it, so that a later request can continue it
+type Entry struct {
+	ID        string          `json:"id"`
+	Client    string          `json:"client,omitempty"` // Virtual client that created the response, empty for the shared API token
+	CreatedAt time.Time       `json:"created_at"`
+	Messages  json.RawMessage `json:"messages"` // Chat messages of the conversation, ending with the answer
+	Response  json.RawMessage `json:"response"` // The response object as returned to the client
+}
+
+// Store keeps the responses that later requests may refer to by their ID.
+// Entries expire after a TTL and the oldest are evicted beyond a maximum count.
+// When a path is set the store is persisted to that JSON file.
+type Store struct {
+	mu         sync.Mutex
+	entries    map[string]*Entry
+	path       string // Empty for a store kept in memory only
+	ttl        time.Duration
+	maxEntries int
+	logger     *slog.Logger
+	dirty      atomic.Bool // Set when entries changed since the last save
+}
+
+// NewStore creates an empty store persisted at path, or kept in memory only
+// when path is empty. A ttl or maxEntries of 0 leaves that bound unset.
+func NewStore(path string, ttl time.Duration, maxEntries int, logger *slog.Logger) *Store {
+	return &Store{
+		entries:    make(map[string]*Entry),
+		path:       path,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		logger:     logger,
+	}
+}
+
+// Open creates the store described by the settings and loads the persisted responses
+func Open(cfg config.ResponsesSettings, logger *slog.Logger) (*Store, error) {
+	ttl, err := time.ParseDuration(cfg.TTL)
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("invalid responses.ttl %q", cfg.TTL)
+	}
+	if cfg.MaxEntries < 0 {
+		return nil, fmt.Errorf("invalid responses.max_entries %d", cfg.MaxEntries)
+	}
+	path := ""
+	if cfg.Persist {
+		path = storePath
+	}
+
+	s := NewStore(path, ttl, cfg.MaxEntries, logger)
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads the stored responses from the store file. A missing file leaves the store empty.
+func (s *Store) Load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.logger.Info("Response store does not exist, starting with no stored responses", "path", s.path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var loaded []*Entry
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("failed to parse response store %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, e := range loaded {
+		if e.ID == "" || s.expired(e, now) {
+			continue
+		}
+		s.entries[e.ID] = e
+	}
+	s.evictLocked()
+
+	s.logger.Info("Stored responses loaded", "path", s.path, "count", len(s.entries))
+	return nil
+}
+
+// Save writes all unexpired responses to the store file
+func (s *Store) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty.Store(false)
+
+	now := time.Now()
+	list := make([]*Entry, 0, len(s.entries))
+	for id, e := range s.entries {
+		if s.expired(e, now) {
+			delete(s.entries, id)
+			continue
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		s.dirty.Store(true)
+		return err
+	}
+	// The file holds the prompts and answers of conversations, so keep it private
+	if err := atomicfile.Write(s.path, data, 0600); err != nil {
+		s.dirty.Store(true)
+		s.logger.Error("Failed to write response store", "path", s.path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// SaveIfDirty saves the store only when responses were added or deleted since the last save
+func (s *Store) SaveIfDirty() error {
+	if !s.dirty.Load() {
+		return nil
+	}
+	return s.Save()
+}
+
+// Get returns the response with the given ID unless it does not exist or expired
+func (s *Store) Get(id string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok || s.expired(e, time.Now()) {
+		return nil, false
+	}
+	return e, true
+}
+
+// Put stores a response, evicting the oldest ones beyond the maximum count
+func (s *Store) Put(e *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[e.ID] = e
+	s.evictLocked()
+	s.dirty.Store(true)
+}
+
+// Delete removes a response and reports whether it existed
+func (s *Store) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[id]; !ok {
+		return false
+	}
+	delete(s.entries, id)
+	s.dirty.Store(true)
+	return true
+}
+
+// expired reports whether an entry outlived the TTL
+func (s *Store) expired(e *Entry, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(e.CreatedAt) > s.ttl
+}
+
+// evictLocked drops the oldest entries beyond the maximum count. The caller must hold the lock.
+func (s *Store) evictLocked() {
+	if s.maxEntries <= 0 || len(s.entries) <= s.maxEntries {
+		return
+	}
+	list := make([]*Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	for _, e := range list[:len(list)-s.maxEntries] {
+		delete(s.entries, e.ID)
+	}
+}
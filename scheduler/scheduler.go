@@ -6,24 +6,73 @@ import (
 	"time"
 
 	"github.com/robfig/cron/v3"
+	"github.com/loseleaf/modelscope-balancer/accounting"
+	"github.com/loseleaf/modelscope-balancer/clients"
 	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/events"
 	"github.com/loseleaf/modelscope-balancer/keymanager"
+	"github.com/loseleaf/modelscope-balancer/metrics"
+	"github.com/loseleaf/modelscope-balancer/responses"
 )
 
+// stateFlushInterval is how often changed key, client and token usage and stored responses are written to disk
+const stateFlushInterval = time.Minute
+
 // Scheduler manages scheduled tasks for key reactivation
 type Scheduler struct {
-	cron   *cron.Cron
-	km     *keymanager.KeyManager
-	logger *slog.Logger
+	cron        *cron.Cron
+	maintenance *cron.Cron // Housekeeping tasks that do not depend on the reactivation settings
+	km          *keymanager.KeyManager
+	clients     *clients.Store
+	usage       *accounting.Tracker
+	responses   *responses.Store
+	logger      *slog.Logger
 }
 
 // New creates a new Scheduler instance
-func New(km *keymanager.KeyManager, logger *slog.Logger) *Scheduler {
+func New(km *keymanager.KeyManager, clientStore *clients.Store, usage *accounting.Tracker, responseStore *responses.Store, logger *slog.Logger) *Scheduler {
 	return &Scheduler{
-		cron:   cron.New(),
-		km:     km,
-		logger: logger,
+		cron:        cron.New(),
+		maintenance: cron.New(),
+		km:          km,
+		clients:     clientStore,
+		usage:       usage,
+		responses:   responseStore,
+		logger:      logger,
+	}
+}
+
+// StartMaintenance starts background housekeeping tasks, such as periodically
+// persisting key, client and token usage and stored responses so that they survive a restart
+func (s *Scheduler) StartMaintenance() {
+	_, err := s.maintenance.AddFunc(fmt.Sprintf("@every %s", stateFlushInterval), func() {
+		start := time.Now()
+		failed := 0
+		if err := s.km.SaveStateIfDirty(); err != nil {
+			s.logger.Error("Failed to flush key usage to state file", "error", err)
+			failed++
+		}
+		if err := s.clients.SaveIfDirty(); err != nil {
+			s.logger.Error("Failed to flush client usage to client store", "error", err)
+			failed++
+		}
+		if err := s.usage.SaveIfDirty(); err != nil {
+			s.logger.Error("Failed to flush token usage to usage file", "error", err)
+			failed++
+		}
+		if err := s.responses.SaveIfDirty(); err != nil {
+			s.logger.Error("Failed to flush stored responses to response store", "error", err)
+			failed++
+		}
+		publishRun("state_flush", start, map[string]any{"failed": failed})
+	})
+	if err != nil {
+		s.logger.Error("Failed to add state flush task", "error", err)
+		return
 	}
+
+	s.maintenance.Start()
+	s.logger.Info("Maintenance tasks started", "state_flush_interval", stateFlushInterval.String())
 }
 
 // Start starts the scheduler with the given configuration
@@ -57,7 +106,10 @@ func (s *Scheduler) Start(cfg config.AutoReactivationSettings) {
 		cronSpec := fmt.Sprintf("@every %s", cfg.Interval)
 		_, err = s.cron.AddFunc(cronSpec, func() {
 			s.logger.Debug("Running interval-based key reactivation task")
-			s.km.ReactivateDisabledKeys(interval)
+			start := time.Now()
+			reactivated := s.km.ReactivateDisabledKeys(interval)
+			metrics.Reactivations.Add(float64(reactivated), keymanager.TriggerScheduler)
+			publishRun("reactivation", start, map[string]any{"mode": "interval", "reactivated": reactivated})
 		})
 		
 		if err != nil {
@@ -84,7 +136,10 @@ func (s *Scheduler) Start(cfg config.AutoReactivationSettings) {
 		// Add scheduled task
 		_, err = s.cron.AddFunc(cfg.CronSpec, func() {
 			s.logger.Debug("Running scheduled key reactivation task")
-			s.km.ReactivateAllDisabledKeys()
+			start := time.Now()
+			reactivated := s.km.ReactivateAllDisabledKeys()
+			metrics.Reactivations.Add(float64(reactivated), keymanager.TriggerScheduler)
+			publishRun("reactivation", start, map[string]any{"mode": "scheduled", "reactivated": reactivated})
 		})
 		
 		if err != nil {
@@ -105,10 +160,20 @@ func (s *Scheduler) Start(cfg config.AutoReactivationSettings) {
 	s.logger.Info("Scheduler started successfully", "mode", cfg.Mode)
 }
 
-// Stop stops the scheduler
+// Stop stops the scheduler and waits for running tasks to finish
 func (s *Scheduler) Stop() {
+	if s.maintenance != nil {
+		<-s.maintenance.Stop().Done()
+	}
 	if s.cron != nil {
-		s.cron.Stop()
+		<-s.cron.Stop().Done()
 		s.logger.Info("Scheduler stopped")
 	}
 }
+
+// publishRun publishes a scheduler_run event for a task that started at start
+func publishRun(task string, start time.Time, data map[string]any) {
+	data["task"] = task
+	data["duration_ms"] = time.Since(start).Milliseconds()
+	events.Publish(events.Event{Type: events.SchedulerRun, Time: start, Data: data})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/config"
+)
+
+// drainSettings are the parsed shutdown settings
+type drainSettings struct {
+	delay   time.Duration
+	timeout time.Duration
+}
+
+// parseShutdownSettings validates the shutdown settings
+func parseShutdownSettings(cfg config.ShutdownSettings) (drainSettings, error) {
+	var ds drainSettings
+	var err error
+	if ds.delay, err = time.ParseDuration(cfg.DrainDelay); err != nil || ds.delay < 0 {
+		return ds, fmt.Errorf("invalid shutdown.drain_delay %q", cfg.DrainDelay)
+	}
+	if ds.timeout, err = time.ParseDuration(cfg.DrainTimeout); err != nil || ds.timeout <= 0 {
+		return ds, fmt.Errorf("invalid shutdown.drain_timeout %q", cfg.DrainTimeout)
+	}
+	return ds, nil
+}
+
+// drain stops the server gracefully. The server keeps accepting requests for the
+// drain delay while /health reports draining, so that load balancers stop routing
+// to it. Then the listener is closed and in-flight requests, including streamed
+// completions, get up to the drain timeout to finish. Another signal skips the
+// waiting and closes all connections.
+func drain(server *http.Server, signals <-chan os.Signal, ds drainSettings) {
+	select {
+	case <-time.After(ds.delay):
+	case sig := <-signals:
+		logger.Warn("Second shutdown signal received, closing connections", "signal", sig.String())
+		server.Close()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ds.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			logger.Warn("Drain timeout elapsed, closing remaining connections", "drain_timeout", ds.timeout.String(), "error", err)
+			server.Close()
+			return
+		}
+		logger.Info("All connections drained")
+	case sig := <-signals:
+		logger.Warn("Second shutdown signal received, closing connections", "signal", sig.String())
+		server.Close()
+	}
+}
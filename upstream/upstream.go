@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/tracing"
+)
+
+// Default timeouts for upstream requests. A total request timeout would cut off
+// long generations, so requests are only bounded by the time to connect, the wait
+// for the first byte and the silence between two consecutive reads.
+const (
+	DefaultConnectTimeout   = 10 * time.Second
+	DefaultFirstByteTimeout = 120 * time.Second
+	DefaultIdleTimeout      = 60 * time.Second
+)
+
+// Upstream is an OpenAI-compatible endpoint served by its own key pool.
+// The key pool shares the upstream's name.
+type Upstream struct {
+	Name             string
+	BaseURL          string        // Base URL without trailing slash, e.g. https://api-inference.modelscope.cn/v1
+	FirstByteTimeout time.Duration // Maximum wait for the upstream to start answering
+	IdleTimeout      time.Duration // Maximum silence between two reads of the response body
+
+	httpClient *http.Client
+}
+
+// URL returns the absolute URL of an API path such as "/chat/completions"
+func (u *Upstream) URL(path string) string {
+	return u.BaseURL + "/" + strings.TrimPrefix(path, "/")
+}
+
+// Client sends every outbound request of the balancer to the configured upstreams
+type Client struct {
+	upstreams []*Upstream
+	byName    map[string]*Upstream
+}
+
+// New creates the upstream client from configuration. The first upstream is the default one.
+func New(settings []config.UpstreamSettings, logger *slog.Logger) (*Client, error) {
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("no upstreams configured")
+	}
+
+	c := &Client{byName: make(map[string]*Upstream, len(settings))}
+	for _, s := range settings {
+		connectTimeout, err := parseTimeout(s.ConnectTimeout, DefaultConnectTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: invalid connect_timeout: %w", s.Name, err)
+		}
+		firstByteTimeout, err := parseTimeout(s.FirstByteTimeout, DefaultFirstByteTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: invalid first_byte_timeout: %w", s.Name, err)
+		}
+		idleTimeout, err := parseTimeout(s.IdleTimeout, DefaultIdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: invalid idle_timeout: %w", s.Name, err)
+		}
+
+		// Each upstream gets its own transport so that its connect timeout applies.
+		// There is no total client timeout; callers bound requests through their context.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = connectTimeout
+
+		u := &Upstream{
+			Name:             s.Name,
+			BaseURL:          strings.TrimRight(s.BaseURL, "/"),
+			FirstByteTimeout: firstByteTimeout,
+			IdleTimeout:      idleTimeout,
+			httpClient:       &http.Client{Transport: transport},
+		}
+		c.upstreams = append(c.upstreams, u)
+		c.byName[u.Name] = u
+
+		logger.Info("Configured upstream",
+			"name", u.Name,
+			"base_url", u.BaseURL,
+			"api_keys_count", len(s.ApiKeys),
+			"connect_timeout", connectTimeout.String(),
+			"first_byte_timeout", firstByteTimeout.String(),
+			"idle_timeout", idleTimeout.String())
+	}
+	return c, nil
+}
+
+// parseTimeout parses a duration setting, returning def when it is empty
+func parseTimeout(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be positive, got %s", value)
+	}
+	return d, nil
+}
+
+// Default returns the default upstream
+func (c *Client) Default() *Upstream {
+	return c.upstreams[0]
+}
+
+// Get returns the upstream with the given name, or the default upstream for an empty name
+func (c *Client) Get(name string) (*Upstream, bool) {
+	if name == "" {
+		return c.Default(), true
+	}
+	u, ok := c.byName[name]
+	return u, ok
+}
+
+// Upstreams returns all configured upstreams in configuration order
+func (c *Client) Upstreams() []*Upstream {
+	return c.upstreams
+}
+
+// NewRequest creates a request for an API path of the upstream authorized with apiKey
+func (c *Client) NewRequest(ctx context.Context, u *Upstream, method, path string, body io.Reader, apiKey string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.URL(path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	return req, nil
+}
+
+// Do sends a request created by NewRequest to its upstream, propagating the
+// trace context of the request as a W3C traceparent header
+func (c *Client) Do(u *Upstream, req *http.Request) (*http.Response, error) {
+	tracing.Inject(req.Context(), req.Header)
+	return u.httpClient.Do(req)
+}
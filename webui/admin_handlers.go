@@ -2,61 +2,122 @@ package webui
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/loseleaf/modelscope-balancer/accounting"
+	"github.com/loseleaf/modelscope-balancer/clients"
 	"github.com/loseleaf/modelscope-balancer/config"
+	"github.com/loseleaf/modelscope-balancer/events"
 	"github.com/loseleaf/modelscope-balancer/keymanager"
+	"github.com/loseleaf/modelscope-balancer/metrics"
 	"github.com/loseleaf/modelscope-balancer/middleware"
+	"github.com/loseleaf/modelscope-balancer/proxy"
+	"github.com/loseleaf/modelscope-balancer/requestlog"
 	"github.com/loseleaf/modelscope-balancer/scheduler"
+	"github.com/loseleaf/modelscope-balancer/upstream"
 )
 
 // AdminHandler handles web admin API requests
 type AdminHandler struct {
-	km         *keymanager.KeyManager
-	logger     *slog.Logger
-	adminToken string
-	scheduler  *scheduler.Scheduler
-	adminAuth  *middleware.DynamicAuthenticator
-	apiAuth    *middleware.DynamicAuthenticator
+	km        *keymanager.KeyManager
+	upstreams *upstream.Client
+	logger    *slog.Logger
+	scheduler *scheduler.Scheduler
+	adminAuth *middleware.DynamicAuthenticator
+	apiAuth   *middleware.DynamicAuthenticator
+	clients   *clients.Store
+	usage     *accounting.Tracker
+	webhooks  *events.Dispatcher
+
+	requestLog *requestlog.Log // Nil while the request log is disabled
+	replay     http.Handler    // Serves replayed API requests
+
+	streamsDone  chan struct{} // Closed to end the admin event streams
+	closeStreams sync.Once
 }
 
 // Request structures for key operations
-type KeyOperationRequest struct {
-	Value string `json:"value"`
-}
-
 type DisableKeyRequest struct {
-	Value  string `json:"value"`
 	Reason string `json:"reason,omitempty"`
 }
 
+type SetKeyWeightRequest struct {
+	Weight int `json:"weight"`
+}
+
 // NewAdminHandler creates a new AdminHandler instance
-func NewAdminHandler(km *keymanager.KeyManager, logger *slog.Logger, adminToken string, scheduler *scheduler.Scheduler, adminAuth *middleware.DynamicAuthenticator, apiAuth *middleware.DynamicAuthenticator) *AdminHandler {
+func NewAdminHandler(km *keymanager.KeyManager, upstreams *upstream.Client, logger *slog.Logger, scheduler *scheduler.Scheduler, adminAuth *middleware.DynamicAuthenticator, apiAuth *middleware.DynamicAuthenticator, clientStore *clients.Store, usage *accounting.Tracker, webhooks *events.Dispatcher, requestLog *requestlog.Log, replay http.Handler) *AdminHandler {
 	return &AdminHandler{
-		km:         km,
-		logger:     logger,
-		adminToken: adminToken,
-		scheduler:  scheduler,
-		adminAuth:  adminAuth,
-		apiAuth:    apiAuth,
+		km:        km,
+		upstreams: upstreams,
+		logger:    logger,
+		scheduler: scheduler,
+		adminAuth: adminAuth,
+		apiAuth:   apiAuth,
+		clients:   clientStore,
+		usage:     usage,
+		webhooks:  webhooks,
+
+		requestLog: requestLog,
+		replay:     replay,
+
+		streamsDone: make(chan struct{}),
 	}
 }
 
-// validateAdminToken validates the provided token against the configured admin token
-func (ah *AdminHandler) validateAdminToken(token string) bool {
-	return ah.adminToken != "" && token == ah.adminToken
+// KeyResponse is the admin API representation of a key including its remaining
+// quota. The key value is masked; RevealKey returns the full secret.
+type KeyResponse struct {
+	*keymanager.ApiKey
+	Value          string `json:"value"`           // Masked key value, shadows the secret of ApiKey
+	DailyLimit     int64  `json:"daily_limit"`     // 0 when no daily limit is configured
+	RemainingQuota int64  `json:"remaining_quota"` // -1 when no daily limit is configured
+}
+
+// keyResponse builds the admin API representation of a key
+func (ah *AdminHandler) keyResponse(key *keymanager.ApiKey) *KeyResponse {
+	if key == nil {
+		return nil
+	}
+	return &KeyResponse{
+		ApiKey:         key,
+		Value:          keymanager.MaskKey(key.Value),
+		DailyLimit:     ah.km.DailyLimit(),
+		RemainingQuota: ah.km.RemainingQuota(key),
+	}
+}
+
+// keyFromURL looks up the key addressed by the {id} URL parameter, answering 404 when it does not exist
+func (ah *AdminHandler) keyFromURL(w http.ResponseWriter, r *http.Request) (*keymanager.ApiKey, bool) {
+	id := chi.URLParam(r, "id")
+	key, ok := ah.km.FindKeyByID(id)
+	if !ok {
+		ah.logger.Warn("Key not found", "key_id", id, "path", r.URL.Path)
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return nil, false
+	}
+	return key, true
 }
 
 // ListKeys handles GET /admin/api/keys requests
 func (ah *AdminHandler) ListKeys(w http.ResponseWriter, r *http.Request) {
 	// Get all keys from key manager
-	keys := ah.km.ListKeys()
+	keys := make([]*KeyResponse, 0)
+	for _, key := range ah.km.ListKeys() {
+		keys = append(keys, ah.keyResponse(key))
+	}
 
 	// Set response headers
 	w.Header().Set("Content-Type", "application/json")
@@ -74,7 +135,9 @@ func (ah *AdminHandler) ListKeys(w http.ResponseWriter, r *http.Request) {
 
 // AddKeyRequest represents the request body for adding a new key
 type AddKeyRequest struct {
-	Value string `json:"value"`
+	Value  string `json:"value"`
+	Pool   string `json:"pool,omitempty"`   // Optional key pool, defaults to the default upstream's pool
+	Weight int    `json:"weight,omitempty"` // Optional weight for weighted round-robin
 }
 
 // AddKey handles POST /admin/api/keys requests
@@ -94,8 +157,31 @@ func (ah *AdminHandler) AddKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Weight < 0 {
+		ah.logger.Warn("Negative key weight provided", "weight", req.Weight)
+		http.Error(w, "Key weight cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	if req.Pool != "" && !ah.km.HasPool(req.Pool) {
+		ah.logger.Warn("Unknown key pool provided", "pool", req.Pool)
+		http.Error(w, "Unknown key pool", http.StatusBadRequest)
+		return
+	}
+
+	// Keys are addressed by value, so the same value may only be added once
+	if _, exists := ah.km.FindKeyByValue(req.Value); exists {
+		ah.logger.Warn("Key already exists", "key", keymanager.MaskKey(req.Value))
+		http.Error(w, "Key already exists", http.StatusConflict)
+		return
+	}
+
 	// Add new key to key manager
-	newKey := ah.km.AddKey(req.Value)
+	newKey := ah.km.AddKey(req.Value, req.Pool)
+	if req.Weight > 0 {
+		ah.km.SetKeyWeight(req.Value, req.Weight)
+		newKey.Weight = req.Weight
+	}
 
 	// Save state to file after successful addition
 	if err := ah.km.SaveState(); err != nil {
@@ -109,41 +195,24 @@ func (ah *AdminHandler) AddKey(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 
 	// Return the newly created key
-	if err := json.NewEncoder(w).Encode(newKey); err != nil {
+	if err := json.NewEncoder(w).Encode(ah.keyResponse(newKey)); err != nil {
 		ah.logger.Error("Failed to encode new key to JSON", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	ah.logger.Info("Added new key", "key_value", newKey.Value)
+	ah.logger.Info("Added new key", "key_id", newKey.ID)
 }
 
-// DeleteKey handles DELETE /admin/api/keys requests
+// DeleteKey handles DELETE /admin/api/keys/{id} requests
 func (ah *AdminHandler) DeleteKey(w http.ResponseWriter, r *http.Request) {
-	// Parse request body
-	var req KeyOperationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		ah.logger.Warn("Invalid JSON in delete request", "error", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	if req.Value == "" {
-		ah.logger.Warn("Missing key value in delete request")
-		http.Error(w, "Key value is required", http.StatusBadRequest)
-		return
-	}
-
-	// Check if key exists before deletion
-	_, exists := ah.km.FindKeyByValue(req.Value)
-	if !exists {
-		ah.logger.Warn("Attempted to delete non-existent key", "key_value", req.Value)
-		http.Error(w, "Key not found", http.StatusNotFound)
+	key, ok := ah.keyFromURL(w, r)
+	if !ok {
 		return
 	}
 
 	// Delete the key
-	ah.km.DeleteKey(req.Value)
+	ah.km.DeleteKey(key.Value)
 
 	// Save state to file after successful deletion
 	if err := ah.km.SaveState(); err != nil {
@@ -155,35 +224,21 @@ func (ah *AdminHandler) DeleteKey(w http.ResponseWriter, r *http.Request) {
 	// Return 204 No Content
 	w.WriteHeader(http.StatusNoContent)
 
-	ah.logger.Info("Deleted key", "key_value", req.Value)
+	ah.logger.Info("Deleted key", "key_id", key.ID)
 }
 
-// ReactivateKey handles POST /admin/api/keys/reactivate requests
+// ReactivateKey handles POST /admin/api/keys/{id}/reactivate requests
 func (ah *AdminHandler) ReactivateKey(w http.ResponseWriter, r *http.Request) {
-	// Parse request body
-	var req KeyOperationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		ah.logger.Warn("Invalid JSON in reactivate request", "error", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	if req.Value == "" {
-		ah.logger.Warn("Missing key value in reactivate request")
-		http.Error(w, "Key value is required", http.StatusBadRequest)
-		return
-	}
-
-	// Check if key exists
-	key, exists := ah.km.FindKeyByValue(req.Value)
-	if !exists {
-		ah.logger.Warn("Attempted to reactivate non-existent key", "key_value", req.Value)
-		http.Error(w, "Key not found", http.StatusNotFound)
+	key, ok := ah.keyFromURL(w, r)
+	if !ok {
 		return
 	}
 
 	// Reactivate the key
-	ah.km.ReactivateKey(req.Value)
+	ah.km.ReactivateKey(key.Value, keymanager.TriggerManual)
+	if key.Status != keymanager.StatusActive {
+		metrics.Reactivations.Inc(keymanager.TriggerManual)
+	}
 
 	// Save state to file after successful reactivation
 	if err := ah.km.SaveState(); err != nil {
@@ -193,43 +248,35 @@ func (ah *AdminHandler) ReactivateKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the updated key to return
-	updatedKey, _ := ah.km.FindKeyByValue(req.Value)
+	updatedKey, _ := ah.km.FindKeyByID(key.ID)
 
 	// Set response headers
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	// Return the reactivated key
-	if err := json.NewEncoder(w).Encode(updatedKey); err != nil {
+	if err := json.NewEncoder(w).Encode(ah.keyResponse(updatedKey)); err != nil {
 		ah.logger.Error("Failed to encode reactivated key to JSON", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	ah.logger.Info("Reactivated key", "key_value", req.Value, "previous_status", key.Status)
+	ah.logger.Info("Reactivated key", "key_id", key.ID, "previous_status", key.Status)
 }
 
-// DisableKey handles POST /admin/api/keys/disable requests
+// DisableKey handles POST /admin/api/keys/{id}/disable requests. The body may
+// carry a reason; an empty body disables the key with a default reason.
 func (ah *AdminHandler) DisableKey(w http.ResponseWriter, r *http.Request) {
-	// Parse request body
-	var req DisableKeyRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		ah.logger.Warn("Invalid JSON in disable request", "error", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	if req.Value == "" {
-		ah.logger.Warn("Missing key value in disable request")
-		http.Error(w, "Key value is required", http.StatusBadRequest)
+	key, ok := ah.keyFromURL(w, r)
+	if !ok {
 		return
 	}
 
-	// Check if key exists
-	key, exists := ah.km.FindKeyByValue(req.Value)
-	if !exists {
-		ah.logger.Warn("Attempted to disable non-existent key", "key_value", req.Value)
-		http.Error(w, "Key not found", http.StatusNotFound)
+	// Parse the optional request body
+	var req DisableKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		ah.logger.Warn("Invalid JSON in disable request", "error", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
@@ -240,7 +287,7 @@ func (ah *AdminHandler) DisableKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Disable the key
-	ah.km.DisableKey(req.Value, reason)
+	ah.km.DisableKey(key.Value, reason)
 
 	// Save state to file after successful disabling
 	if err := ah.km.SaveState(); err != nil {
@@ -250,38 +297,166 @@ func (ah *AdminHandler) DisableKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the updated key to return
-	updatedKey, _ := ah.km.FindKeyByValue(req.Value)
+	updatedKey, _ := ah.km.FindKeyByID(key.ID)
 
 	// Set response headers
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	// Return the disabled key
-	if err := json.NewEncoder(w).Encode(updatedKey); err != nil {
+	if err := json.NewEncoder(w).Encode(ah.keyResponse(updatedKey)); err != nil {
 		ah.logger.Error("Failed to encode disabled key to JSON", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	ah.logger.Info("Disabled key", "key_value", req.Value, "previous_status", key.Status)
+	ah.logger.Info("Disabled key", "key_id", key.ID, "previous_status", key.Status)
+}
+
+// SetKeyWeight handles POST /admin/api/keys/{id}/weight requests
+func (ah *AdminHandler) SetKeyWeight(w http.ResponseWriter, r *http.Request) {
+	key, ok := ah.keyFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	// Parse request body
+	var req SetKeyWeightRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ah.logger.Warn("Invalid JSON in set weight request", "error", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.Weight < 0 {
+		ah.logger.Warn("Negative key weight provided", "weight", req.Weight)
+		http.Error(w, "Key weight cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	// Update the weight of the key
+	if !ah.km.SetKeyWeight(key.Value, req.Weight) {
+		ah.logger.Warn("Attempted to set weight of deleted key", "key_id", key.ID)
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	// Save state to file after successful update
+	if err := ah.km.SaveState(); err != nil {
+		ah.logger.Error("Failed to save state after setting key weight", "error", err)
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	// Get the updated key to return
+	updatedKey, _ := ah.km.FindKeyByID(key.ID)
+
+	// Set response headers
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	// Return the updated key
+	if err := json.NewEncoder(w).Encode(ah.keyResponse(updatedKey)); err != nil {
+		ah.logger.Error("Failed to encode updated key to JSON", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ah.logger.Info("Set key weight", "key_id", key.ID, "weight", req.Weight)
+}
+
+// KeyHistory handles GET /admin/api/keys/{id}/history requests. Only storage
+// backends recording status changes support it.
+func (ah *AdminHandler) KeyHistory(w http.ResponseWriter, r *http.Request) {
+	key, ok := ah.keyFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	history, err := ah.km.KeyHistory(key.ID)
+	if errors.Is(err, keymanager.ErrHistoryUnsupported) {
+		http.Error(w, "Key history requires the bolt storage backend", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		ah.logger.Error("Failed to read key history", "key_id", key.ID, "error", err)
+		http.Error(w, "Failed to read key history", http.StatusInternalServerError)
+		return
+	}
+	if history == nil {
+		history = []keymanager.StatusChange{}
+	}
+
+	// Set response headers
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		ah.logger.Error("Failed to encode key history to JSON", "error", err)
+	}
+}
+
+// RevealKeyResponse carries the full secret of a key
+type RevealKeyResponse struct {
+	ID          string `json:"id"`
+	Fingerprint string `json:"fingerprint"`
+	Value       string `json:"value"`
+}
+
+// RevealKey handles POST /admin/api/keys/{id}/reveal requests. It is the only
+// endpoint returning a full key value, and every call is written to the audit log.
+func (ah *AdminHandler) RevealKey(w http.ResponseWriter, r *http.Request) {
+	key, ok := ah.keyFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	ah.logger.Warn("Key value revealed",
+		"audit", true,
+		"key_id", key.ID,
+		"fingerprint", key.Fingerprint,
+		"pool", key.Pool,
+		"remote_addr", r.RemoteAddr,
+		"user_agent", r.UserAgent(),
+		"request_id", chimiddleware.GetReqID(r.Context()))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	response := RevealKeyResponse{ID: key.ID, Fingerprint: key.Fingerprint, Value: key.Value}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		ah.logger.Error("Failed to encode revealed key to JSON", "error", err)
+	}
 }
 
 // TestKeysRequest represents the request body for testing keys
 type TestKeysRequest struct {
-	Source string   `json:"source"` // "system" or "custom"
-	Model  string   `json:"model"`
-	Keys   []string `json:"keys,omitempty"` // omitempty表示如果为空则不序列化
+	Source   string   `json:"source"` // "system" or "custom"
+	Model    string   `json:"model"`
+	Keys     []string `json:"keys,omitempty"`     // omitempty表示如果为空则不序列化
+	Upstream string   `json:"upstream,omitempty"` // Upstream custom keys are tested against, defaults to the default upstream
 }
 
-// TestResult represents the result of testing a single key
+// TestResult represents the result of testing a single key. Keys are identified
+// by their masked value, fingerprint and position in the tested list, and system
+// keys also by their ID.
 type TestResult struct {
-	KeyValue string `json:"key_value"`
-	Status   string `json:"status"` // "success" or "failed"
-	Message  string `json:"message,omitempty"`
-	Error    string `json:"error,omitempty"`
+	KeyValue    string `json:"key_value"` // Masked key value
+	KeyID       string `json:"key_id,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	Index       int    `json:"index"`
+	Status      string `json:"status"` // "success" or "failed"
+	Message     string `json:"message,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	FailureClass keymanager.FailureClass `json:"failure_class,omitempty"` // Category of the failure, if any
+	retryAfter   time.Duration           // Cooldown requested by the upstream for quota failures
 }
 
-// TestKeys handles POST /admin/api/keys/test requests with Server-Sent Events
+// TestKeys handles GET and POST /admin/api/keys/test requests with Server-Sent
+// Events. EventSource clients pass the request as query parameters and
+// authenticate with the admin session cookie.
 func (ah *AdminHandler) TestKeys(w http.ResponseWriter, r *http.Request) {
 	// Parse request - support both JSON body and URL query parameters
 	var req TestKeysRequest
@@ -290,6 +465,7 @@ func (ah *AdminHandler) TestKeys(w http.ResponseWriter, r *http.Request) {
 	if source := r.URL.Query().Get("source"); source != "" {
 		req.Source = source
 		req.Model = r.URL.Query().Get("model")
+		req.Upstream = r.URL.Query().Get("upstream")
 
 		// Parse keys from query parameter if provided
 		if keysParam := r.URL.Query().Get("keys"); keysParam != "" {
@@ -300,22 +476,6 @@ func (ah *AdminHandler) TestKeys(w http.ResponseWriter, r *http.Request) {
 				req.Keys[i] = strings.TrimSpace(key)
 			}
 		}
-
-		// For EventSource requests, check token in URL parameter
-		if token := r.URL.Query().Get("token"); token != "" {
-			// Validate the token manually since middleware won't handle it
-			if !ah.validateAdminToken(token) {
-				ah.logger.Warn("Invalid admin token in URL parameter")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-		} else {
-			// No token in URL, this should be handled by middleware
-			// But EventSource can't send custom headers, so this is an error
-			ah.logger.Warn("No admin token provided for EventSource request")
-			http.Error(w, "Unauthorized: Token required in URL parameter for EventSource", http.StatusUnauthorized)
-			return
-		}
 	} else {
 		// Fallback to JSON body parsing
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -332,18 +492,36 @@ func (ah *AdminHandler) TestKeys(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create keysToTest slice based on source
+	// Create keysToTest slice based on source, along with the upstream each key is tested against
 	var keysToTest []string
+	var keyIDs []string // IDs of system keys, empty for custom keys
+	var keyUpstreams []*upstream.Upstream
 	switch req.Source {
 	case "system":
-		// Get all system keys from KeyManager
+		// Get all system keys from KeyManager and test them against the upstream of their pool
 		systemKeys := ah.km.ListKeys()
 		for _, key := range systemKeys {
+			up, ok := ah.upstreams.Get(key.Pool)
+			if !ok {
+				up = ah.upstreams.Default()
+			}
 			keysToTest = append(keysToTest, key.Value)
+			keyIDs = append(keyIDs, key.ID)
+			keyUpstreams = append(keyUpstreams, up)
 		}
 	case "custom":
 		// Use provided custom keys
+		up, ok := ah.upstreams.Get(req.Upstream)
+		if !ok {
+			ah.logger.Warn("Unknown upstream provided for key testing", "upstream", req.Upstream)
+			http.Error(w, "Unknown upstream", http.StatusBadRequest)
+			return
+		}
 		keysToTest = req.Keys
+		for range keysToTest {
+			keyIDs = append(keyIDs, "")
+			keyUpstreams = append(keyUpstreams, up)
+		}
 	default:
 		ah.logger.Warn("Invalid source provided for key testing", "source", req.Source)
 		http.Error(w, "Source must be 'system' or 'custom'", http.StatusBadRequest)
@@ -373,35 +551,47 @@ func (ah *AdminHandler) TestKeys(w http.ResponseWriter, r *http.Request) {
 
 	ah.logger.Info("Starting key health test", "model", req.Model, "source", req.Source, "key_count", len(keysToTest))
 
-	// Create HTTP client for testing
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
 	// Track if any keys state were changed during this test run
 	var keysStateChanged bool = false
+	passed := 0
 
 	// Test each key
 	for i, keyValue := range keysToTest {
 		ah.logger.Debug("Testing key", "key_index", i+1, "total", len(keysToTest))
 
-		result := ah.testSingleKeyValue(client, keyValue, req.Model, i)
+		result := ah.testSingleKeyValue(r.Context(), keyUpstreams[i], keyValue, req.Model)
+		result.KeyValue = keymanager.MaskKey(keyValue)
+		result.KeyID = keyIDs[i]
+		result.Fingerprint = keymanager.Fingerprint(keyValue)
+		result.Index = i
+		recordKeyTest(req.Source, keyUpstreams[i].Name, result)
+		if result.Status == "success" {
+			passed++
+		}
 
 		// **Auto-manage key states for system tests**
 		if req.Source == "system" {
 			if result.Status == "failed" {
-				// Automatically disable the invalid key
-				ah.km.DisableKey(keyValue, result.Error)
-				keysStateChanged = true
-				ah.logger.Warn("Automatically disabled invalid key found during health check",
-					"key", keyValue, "reason", result.Error)
+				if result.FailureClass == keymanager.FailureClient {
+					// The test request itself was rejected (e.g. unknown model), so the key is not at fault
+					ah.logger.Warn("Health check request rejected by upstream, key state unchanged",
+						"key_id", result.KeyID, "reason", result.Error)
+				} else {
+					// Apply the consequence of the failure class: disable, cool down or just record
+					ah.km.ReportFailure(r.Context(), keyValue, result.FailureClass, result.Error, result.retryAfter)
+					keysStateChanged = true
+					ah.logger.Warn("Recorded key failure found during health check",
+						"key_id", result.KeyID, "failure_class", result.FailureClass, "reason", result.Error)
+				}
 			} else if result.Status == "success" {
-				// Automatically enable the valid key if it was previously disabled
-				if ah.km.IsKeyDisabled(keyValue) {
-					ah.km.ReactivateKey(keyValue)
+				// Automatically enable the valid key if it was previously disabled or cooling down
+				ah.km.RecordUsage(keyValue, req.Model)
+				if key, ok := ah.km.FindKeyByValue(keyValue); ok && key.Status != keymanager.StatusActive {
+					ah.km.ReactivateKey(keyValue, keymanager.TriggerKeyTest)
+					metrics.Reactivations.Inc(keymanager.TriggerKeyTest)
 					keysStateChanged = true
 					ah.logger.Info("Automatically enabled valid key found during health check",
-						"key", keyValue)
+						"key_id", result.KeyID)
 				}
 			}
 		}
@@ -440,85 +630,35 @@ func (ah *AdminHandler) TestKeys(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
 	flusher.Flush()
 
-	ah.logger.Info("Key health test completed", "total_keys", len(keysToTest))
-}
+	events.Publish(events.Event{Type: events.TestCompleted, Data: map[string]any{
+		"source": req.Source,
+		"model":  req.Model,
+		"total":  len(keysToTest),
+		"passed": passed,
+		"failed": len(keysToTest) - passed,
+	}})
 
-// testSingleKey tests a single API key by making a lightweight request to ModelScope
-func (ah *AdminHandler) testSingleKey(client *http.Client, key *keymanager.ApiKey, model string) TestResult {
-	// Create a minimal test request
-	testRequest := map[string]interface{}{
-		"model": model,
-		"messages": []map[string]string{
-			{
-				"role":    "user",
-				"content": "Hi",
-			},
-		},
-		"max_tokens": 1,
-		"stream":     false,
-	}
-
-	// Marshal request to JSON
-	requestBody, err := json.Marshal(testRequest)
-	if err != nil {
-		return TestResult{
-			KeyValue: key.Value,
-			Status:   "failed",
-			Error:    fmt.Sprintf("Failed to marshal request: %v", err),
-		}
-	}
-
-	// Create HTTP request
-	req, err := http.NewRequest("POST", "https://api-inference.modelscope.cn/v1/chat/completions", bytes.NewReader(requestBody))
-	if err != nil {
-		return TestResult{
-			KeyValue: key.Value,
-			Status:   "failed",
-			Error:    fmt.Sprintf("Failed to create request: %v", err),
-		}
-	}
+	ah.logger.Info("Key health test completed", "total_keys", len(keysToTest), "passed", passed)
+}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+key.Value)
+// keyTestTimeout bounds a single key health check request
+const keyTestTimeout = 10 * time.Second
 
-	// Send request
-	resp, err := client.Do(req)
-	if err != nil {
-		return TestResult{
-			KeyValue: key.Value,
-			Status:   "failed",
-			Error:    fmt.Sprintf("Network error: %v", err),
-		}
+// recordKeyTest counts a key test result by pool, with custom keys counted under "custom"
+func recordKeyTest(source, pool string, result TestResult) {
+	if source != "system" {
+		pool = "custom"
 	}
-	defer resp.Body.Close()
-
-	// Check response status
-	if resp.StatusCode == http.StatusOK {
-		return TestResult{
-			KeyValue: key.Value,
-			Status:   "success",
-			Message:  "Key is working correctly",
-		}
-	} else {
-		// Read error response
-		body := make([]byte, 1024)
-		n, _ := resp.Body.Read(body)
-		errorMsg := string(body[:n])
-		if len(errorMsg) > 200 {
-			errorMsg = errorMsg[:200] + "..."
-		}
-
-		return TestResult{
-			KeyValue: key.Value,
-			Status:   "failed",
-			Error:    fmt.Sprintf("HTTP %d: %s", resp.StatusCode, errorMsg),
-		}
+	outcome := result.Status
+	if result.Status == "failed" && result.FailureClass != keymanager.FailureNone {
+		outcome = string(result.FailureClass)
 	}
+	metrics.KeyTests.Inc(pool, outcome)
 }
 
-// testSingleKeyValue tests a single API key value by making a lightweight request to ModelScope
-func (ah *AdminHandler) testSingleKeyValue(client *http.Client, keyValue string, model string, index int) TestResult {
+// testSingleKeyValue tests a single API key value by making a lightweight request
+// to its upstream. The caller fills in the key's identity in the result.
+func (ah *AdminHandler) testSingleKeyValue(ctx context.Context, up *upstream.Upstream, keyValue string, model string) TestResult {
 	// Create a minimal test request
 	testRequest := map[string]interface{}{
 		"model": model,
@@ -536,33 +676,32 @@ func (ah *AdminHandler) testSingleKeyValue(client *http.Client, keyValue string,
 	requestBody, err := json.Marshal(testRequest)
 	if err != nil {
 		return TestResult{
-			KeyValue: keyValue,
-			Status:   "failed",
-			Error:    fmt.Sprintf("Failed to marshal request: %v", err),
+			Status: "failed",
+			Error:  fmt.Sprintf("Failed to marshal request: %v", err),
 		}
 	}
 
-	// Create HTTP request
-	req, err := http.NewRequest("POST", "https://api-inference.modelscope.cn/v1/chat/completions", bytes.NewReader(requestBody))
+	// Create HTTP request authorized with the key under test
+	ctx, cancel := context.WithTimeout(ctx, keyTestTimeout)
+	defer cancel()
+	req, err := ah.upstreams.NewRequest(ctx, up, "POST", "/chat/completions", bytes.NewReader(requestBody), keyValue)
 	if err != nil {
 		return TestResult{
-			KeyValue: keyValue,
-			Status:   "failed",
-			Error:    fmt.Sprintf("Failed to create request: %v", err),
+			Status: "failed",
+			Error:  fmt.Sprintf("Failed to create request: %v", err),
 		}
 	}
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+keyValue)
 
 	// Send request
-	resp, err := client.Do(req)
+	resp, err := ah.upstreams.Do(up, req)
 	if err != nil {
 		return TestResult{
-			KeyValue: keyValue,
-			Status:   "failed",
-			Error:    fmt.Sprintf("Network error: %v", err),
+			Status:       "failed",
+			Error:        fmt.Sprintf("Network error: %v", err),
+			FailureClass: keymanager.FailureTransient,
 		}
 	}
 	defer resp.Body.Close()
@@ -570,9 +709,8 @@ func (ah *AdminHandler) testSingleKeyValue(client *http.Client, keyValue string,
 	// Check response status
 	if resp.StatusCode == http.StatusOK {
 		return TestResult{
-			KeyValue: keyValue,
-			Status:   "success",
-			Message:  "Key is working correctly",
+			Status:  "success",
+			Message: "Key is working correctly",
 		}
 	} else {
 		// Read error response
@@ -584,46 +722,55 @@ func (ah *AdminHandler) testSingleKeyValue(client *http.Client, keyValue string,
 		}
 
 		return TestResult{
-			KeyValue: keyValue,
-			Status:   "failed",
-			Error:    fmt.Sprintf("HTTP %d: %s", resp.StatusCode, errorMsg),
+			Status:       "failed",
+			Error:        fmt.Sprintf("HTTP %d: %s", resp.StatusCode, errorMsg),
+			FailureClass: proxy.ClassifyStatus(resp.StatusCode),
+			retryAfter:   proxy.ParseRetryAfter(resp.Header.Get("Retry-After")),
 		}
 	}
 }
 
+// proxiedModelsTimeout bounds a proxied model listing including its retries
+const proxiedModelsTimeout = 30 * time.Second
+
 // ProxiedGetModels handles GET /admin/api/proxied-models requests
 // This method is protected by AdminAuthMiddleware, so we know the caller is authorized
 func (ah *AdminHandler) ProxiedGetModels(w http.ResponseWriter, r *http.Request) {
-	// Get an available key from KeyManager
-	key := ah.km.GetNextActiveKey()
+	// Resolve the upstream to list models from, defaulting to the default upstream
+	up, ok := ah.upstreams.Get(r.URL.Query().Get("upstream"))
+	if !ok {
+		ah.logger.Warn("Unknown upstream for proxied models request", "upstream", r.URL.Query().Get("upstream"))
+		http.Error(w, "Unknown upstream", http.StatusBadRequest)
+		return
+	}
+
+	// Get an available key of the upstream's pool from KeyManager
+	key := ah.km.GetNextActiveKey(r.Context(), up.Name)
 	if key == nil {
 		ah.logger.Warn("No available keys for proxied models request")
 		http.Error(w, "Service Unavailable: No available keys to execute this proxy operation", http.StatusServiceUnavailable)
 		return
 	}
+	defer ah.km.ReleaseKey(key.Value)
 
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	// Bound the whole operation including retries
+	ctx, cancel := context.WithTimeout(r.Context(), proxiedModelsTimeout)
+	defer cancel()
 
-	// Create request to upstream ModelScope API
-	req, err := http.NewRequest("GET", "https://api-inference.modelscope.cn/v1/models", nil)
+	// Create request to the upstream API authorized with the selected key
+	req, err := ah.upstreams.NewRequest(ctx, up, "GET", "/models", nil, key.Value)
 	if err != nil {
 		ah.logger.Error("Failed to create upstream request", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-
-	// Set authorization header with the selected key
-	req.Header.Set("Authorization", "Bearer "+key.Value)
 	req.Header.Set("Content-Type", "application/json")
 
 	// Execute request with retry logic
 	var resp *http.Response
 	maxRetries := 3
 	for i := 0; i < maxRetries; i++ {
-		resp, err = client.Do(req)
+		resp, err = ah.upstreams.Do(up, req)
 		if err == nil && resp.StatusCode == http.StatusOK {
 			break
 		}
@@ -638,6 +785,18 @@ func (ah *AdminHandler) ProxiedGetModels(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	// Report the outcome like proxied requests do, so that a key handed out as a
+	// half-open probe closes or reopens its breaker
+	switch {
+	case err != nil:
+		ah.km.ReportFailure(r.Context(), key.Value, keymanager.FailureTransient, fmt.Sprintf("Network error: %v", err), 0)
+	case resp.StatusCode == http.StatusOK:
+		ah.km.ReportSuccess(r.Context(), key.Value)
+	default:
+		ah.km.ReportFailure(r.Context(), key.Value, proxy.ClassifyStatus(resp.StatusCode),
+			fmt.Sprintf("HTTP %d", resp.StatusCode), proxy.ParseRetryAfter(resp.Header.Get("Retry-After")))
+	}
+
 	if err != nil {
 		ah.logger.Error("Failed to execute upstream request after retries", "error", err)
 		http.Error(w, "Bad Gateway: Upstream service unavailable", http.StatusBadGateway)
@@ -665,12 +824,13 @@ func (ah *AdminHandler) ProxiedGetModels(w http.ResponseWriter, r *http.Request)
 		ah.logger.Error("Failed to copy response body", "error", err)
 	}
 
-	ah.logger.Info("Successfully proxied models request", "key_value", key.Value)
+	ah.logger.Info("Successfully proxied models request", "key_id", key.ID)
 }
 
 // BatchAddKeysRequest represents the request body for batch adding keys
 type BatchAddKeysRequest struct {
 	Keys []string `json:"keys"`
+	Pool string   `json:"pool,omitempty"` // Optional key pool, defaults to the default upstream's pool
 }
 
 // BatchAddKeysResponse represents the response for batch adding keys
@@ -697,6 +857,12 @@ func (ah *AdminHandler) BatchAddKeys(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Pool != "" && !ah.km.HasPool(req.Pool) {
+		ah.logger.Warn("Unknown key pool provided for batch add", "pool", req.Pool)
+		http.Error(w, "Unknown key pool", http.StatusBadRequest)
+		return
+	}
+
 	addedCount := 0
 	skippedCount := 0
 
@@ -719,19 +885,19 @@ func (ah *AdminHandler) BatchAddKeys(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if exists {
-			ah.logger.Debug("Key already exists, skipping", "key_prefix", keyValue[:min(8, len(keyValue))])
+			ah.logger.Debug("Key already exists, skipping", "key", keymanager.MaskKey(keyValue))
 			skippedCount++
 			continue
 		}
 
 		// Add the key
-		newKey := ah.km.AddKey(keyValue)
+		newKey := ah.km.AddKey(keyValue, req.Pool)
 		if newKey != nil {
 			addedCount++
-			ah.logger.Debug("Added key successfully", "key_value", newKey.Value)
+			ah.logger.Debug("Added key successfully", "key_id", newKey.ID)
 		} else {
 			skippedCount++
-			ah.logger.Warn("Failed to add key", "key_prefix", keyValue[:min(8, len(keyValue))])
+			ah.logger.Warn("Failed to add key", "key", keymanager.MaskKey(keyValue))
 		}
 	}
 
@@ -765,18 +931,11 @@ func (ah *AdminHandler) BatchAddKeys(w http.ResponseWriter, r *http.Request) {
 	ah.logger.Info("Batch add keys completed", "added_count", addedCount, "skipped_count", skippedCount)
 }
 
-// Helper function for min
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 // GetSettings handles GET /admin/api/settings requests
 func (ah *AdminHandler) GetSettings(w http.ResponseWriter, r *http.Request) {
-	// Get all current settings from the global Viper instance
+	// Get all current settings from the global Viper instance, without the API key secrets
 	settings := config.AppViper.AllSettings()
+	maskSettingsKeys(settings)
 
 	// Set response headers
 	w.Header().Set("Content-Type", "application/json")
@@ -792,6 +951,69 @@ func (ah *AdminHandler) GetSettings(w http.ResponseWriter, r *http.Request) {
 	ah.logger.Info("Retrieved application settings")
 }
 
+// maskSettingsKeys replaces the API keys listed in settings, at the top level and
+// per upstream, and the webhook URLs and secrets with masked copies. The lists are copied so that the values held
+// by Viper stay untouched.
+func maskSettingsKeys(settings map[string]interface{}) {
+	mask := func(section map[string]interface{}) {
+		var keys []string
+		switch list := section["api_keys"].(type) {
+		case []interface{}:
+			for _, key := range list {
+				keys = append(keys, fmt.Sprint(key))
+			}
+		case []string:
+			keys = list
+		default:
+			return
+		}
+		masked := make([]string, len(keys))
+		for i, key := range keys {
+			masked[i] = keymanager.MaskKey(key)
+		}
+		section["api_keys"] = masked
+	}
+
+	mask(settings)
+	if upstreams, ok := settings["upstreams"].([]interface{}); ok {
+		copied := make([]interface{}, len(upstreams))
+		for i, up := range upstreams {
+			copied[i] = up
+			if section, ok := up.(map[string]interface{}); ok {
+				sectionCopy := make(map[string]interface{}, len(section))
+				for k, v := range section {
+					sectionCopy[k] = v
+				}
+				mask(sectionCopy)
+				copied[i] = sectionCopy
+			}
+		}
+		settings["upstreams"] = copied
+	}
+
+	// Webhook URLs of chat services carry access tokens, so only their host is shown
+	if webhooks, ok := settings["webhooks"].([]interface{}); ok {
+		copied := make([]interface{}, len(webhooks))
+		for i, wh := range webhooks {
+			copied[i] = wh
+			if section, ok := wh.(map[string]interface{}); ok {
+				sectionCopy := make(map[string]interface{}, len(section))
+				for k, v := range section {
+					sectionCopy[k] = v
+				}
+				if u, err := url.Parse(fmt.Sprint(section["url"])); err == nil && u.Host != "" {
+					sectionCopy["url"] = u.Scheme + "://" + u.Host + "/****"
+				}
+				if secret, ok := section["secret"].(string); ok && secret != "" {
+					sectionCopy["secret"] = "****"
+				}
+				copied[i] = sectionCopy
+			}
+		}
+		settings["webhooks"] = copied
+	}
+}
+
 // UpdateSettings handles POST /admin/api/settings requests
 func (ah *AdminHandler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 	// Parse request body
@@ -802,6 +1024,19 @@ func (ah *AdminHandler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Validate the key selection strategy before anything is persisted
+	var newStrategy string
+	if keySelection, exists := newSettings["key_selection"]; exists {
+		if settingsMap, ok := keySelection.(map[string]interface{}); ok {
+			newStrategy, _ = settingsMap["strategy"].(string)
+		}
+		if _, err := keymanager.NewSelector(newStrategy); err != nil {
+			ah.logger.Warn("Invalid key selection strategy in settings update", "strategy", newStrategy, "error", err)
+			http.Error(w, fmt.Sprintf("Invalid key selection strategy, supported: %s", strings.Join(keymanager.Strategies, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Update Viper instance with new settings
 	for key, value := range newSettings {
 		config.AppViper.Set(key, value)
@@ -851,6 +1086,13 @@ func (ah *AdminHandler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Switch the key selection strategy if it was updated
+	if _, exists := newSettings["key_selection"]; exists {
+		if err := ah.km.SetStrategy(newStrategy); err != nil {
+			ah.logger.Error("Failed to switch key selection strategy", "strategy", newStrategy, "error", err)
+		}
+	}
+
 	// Check if authentication tokens were updated and update dynamic authenticators
 	if adminToken, exists := newSettings["admin_token"]; exists {
 		if tokenStr, ok := adminToken.(string); ok {
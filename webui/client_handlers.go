@@ -0,0 +1,183 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/loseleaf/modelscope-balancer/clients"
+)
+
+// ClientRequest represents the request body for creating or updating a client
+type ClientRequest struct {
+	Name              string    `json:"name"`
+	Enabled           *bool     `json:"enabled,omitempty"` // Defaults to true on create and is kept on update
+	AllowedModels     []string  `json:"allowed_models"`
+	RPM               int       `json:"rpm"`
+	DailyRequestLimit int64     `json:"daily_request_limit"`
+	DailyTokenLimit   int64     `json:"daily_token_limit"`
+	ExpiresAt         time.Time `json:"expires_at"` // RFC 3339, omitted for a token that never expires
+}
+
+// settings validates the request and converts it to client settings
+func (req *ClientRequest) settings(enabled bool) (clients.Settings, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return clients.Settings{}, errors.New("Client name is required")
+	}
+	if req.RPM < 0 || req.DailyRequestLimit < 0 || req.DailyTokenLimit < 0 {
+		return clients.Settings{}, errors.New("Limits cannot be negative")
+	}
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+
+	var models []string
+	for _, model := range req.AllowedModels {
+		if model = strings.TrimSpace(model); model != "" {
+			models = append(models, model)
+		}
+	}
+
+	return clients.Settings{
+		Name:              name,
+		Enabled:           enabled,
+		AllowedModels:     models,
+		RPM:               req.RPM,
+		DailyRequestLimit: req.DailyRequestLimit,
+		DailyTokenLimit:   req.DailyTokenLimit,
+		ExpiresAt:         req.ExpiresAt,
+	}, nil
+}
+
+// writeClient encodes a client as the JSON response
+func (ah *AdminHandler) writeClient(w http.ResponseWriter, status int, client *clients.Client) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(client); err != nil {
+		ah.logger.Error("Failed to encode client to JSON", "error", err)
+	}
+}
+
+// ListClients handles GET /admin/api/clients requests
+func (ah *AdminHandler) ListClients(w http.ResponseWriter, r *http.Request) {
+	list := ah.clients.List()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		ah.logger.Error("Failed to encode clients to JSON", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ah.logger.Info("Listed all clients", "count", len(list))
+}
+
+// GetClient handles GET /admin/api/clients/{id} requests
+func (ah *AdminHandler) GetClient(w http.ResponseWriter, r *http.Request) {
+	client, ok := ah.clients.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	ah.writeClient(w, http.StatusOK, client)
+}
+
+// CreateClient handles POST /admin/api/clients requests
+func (ah *AdminHandler) CreateClient(w http.ResponseWriter, r *http.Request) {
+	var req ClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ah.logger.Warn("Failed to parse create client request", "error", err)
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	settings, err := req.settings(true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, err := ah.clients.Create(settings)
+	if err != nil {
+		ah.logger.Error("Failed to create client", "error", err)
+		http.Error(w, "Failed to save client", http.StatusInternalServerError)
+		return
+	}
+
+	ah.writeClient(w, http.StatusCreated, client)
+}
+
+// UpdateClient handles PUT /admin/api/clients/{id} requests, replacing the client's settings
+func (ah *AdminHandler) UpdateClient(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	current, ok := ah.clients.Get(id)
+	if !ok {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	var req ClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ah.logger.Warn("Failed to parse update client request", "error", err)
+		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	settings, err := req.settings(current.Enabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, err := ah.clients.Update(id, settings)
+	if errors.Is(err, clients.ErrNotFound) {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ah.logger.Error("Failed to update client", "client_id", id, "error", err)
+		http.Error(w, "Failed to save client", http.StatusInternalServerError)
+		return
+	}
+
+	ah.writeClient(w, http.StatusOK, client)
+}
+
+// RotateClientToken handles POST /admin/api/clients/{id}/rotate requests
+func (ah *AdminHandler) RotateClientToken(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	client, err := ah.clients.RotateToken(id)
+	if errors.Is(err, clients.ErrNotFound) {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ah.logger.Error("Failed to rotate client token", "client_id", id, "error", err)
+		http.Error(w, "Failed to save client", http.StatusInternalServerError)
+		return
+	}
+
+	ah.writeClient(w, http.StatusOK, client)
+}
+
+// DeleteClient handles DELETE /admin/api/clients/{id} requests
+func (ah *AdminHandler) DeleteClient(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := ah.clients.Delete(id)
+	if errors.Is(err, clients.ErrNotFound) {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ah.logger.Error("Failed to delete client", "client_id", id, "error", err)
+		http.Error(w, "Failed to save client store", http.StatusInternalServerError)
+		return
+	}
+
+	// Return 204 No Content
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,96 @@
+package webui
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/events"
+)
+
+// Event stream settings
+const (
+	eventStreamBuffer    = 256
+	eventStreamHeartbeat = 15 * time.Second
+)
+
+// CloseStreams ends all admin event streams, so that they do not hold up a
+// server shutdown
+func (ah *AdminHandler) CloseStreams() {
+	ah.closeStreams.Do(func() { close(ah.streamsDone) })
+}
+
+// StreamEvents handles GET /admin/api/events requests. It streams balancer events
+// as Server-Sent Events until the client disconnects. The optional types query
+// parameter selects a comma-separated list of event types.
+func (ah *AdminHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	var types []events.Type
+	if param := r.URL.Query().Get("types"); param != "" {
+		for _, name := range strings.Split(param, ",") {
+			t := events.Type(strings.TrimSpace(name))
+			if !events.IsStreamType(t) {
+				http.Error(w, fmt.Sprintf("Unknown event type %q", name), http.StatusBadRequest)
+				return
+			}
+			types = append(types, t)
+		}
+	}
+	if len(types) == 0 {
+		types = events.StreamTypes
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ah.logger.Error("Streaming not supported")
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := events.Default.Subscribe(eventStreamBuffer, types...)
+	defer events.Default.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep reverse proxies from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	ah.logger.Debug("Admin event stream opened", "types", types)
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				ah.logger.Error("Failed to encode event to JSON", "event_type", ev.Type, "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			// Comments keep idle connections open through proxies
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ah.streamsDone:
+			return
+		case <-r.Context().Done():
+			if dropped := sub.Dropped(); dropped > 0 {
+				ah.logger.Warn("Admin event stream fell behind", "dropped_events", dropped)
+			}
+			return
+		}
+	}
+}
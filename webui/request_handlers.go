@@ -0,0 +1,183 @@
+package webui
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/loseleaf/modelscope-balancer/proxy"
+	"github.com/loseleaf/modelscope-balancer/requestlog"
+)
+
+// Request log search limits
+const (
+	defaultRequestLimit = 100
+	maxRequestLimit     = 1000
+)
+
+// requestLogEnabled answers requests to the request log endpoints while the log is disabled
+func (ah *AdminHandler) requestLogEnabled(w http.ResponseWriter) bool {
+	if ah.requestLog == nil {
+		http.Error(w, "The request log is disabled", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// ListRequests handles GET /admin/api/requests requests. It searches the request
+// log, newest first, by time range (from/to as YYYY-MM-DD or RFC 3339), client
+// name, model, key ID or fingerprint, route and status code or class.
+func (ah *AdminHandler) ListRequests(w http.ResponseWriter, r *http.Request) {
+	if !ah.requestLogEnabled(w) {
+		return
+	}
+	params := r.URL.Query()
+
+	q := requestlog.Query{
+		Client: params.Get("client"),
+		Model:  params.Get("model"),
+		Key:    params.Get("key"),
+		Route:  params.Get("route"),
+		Status: params.Get("status"),
+		Errors: params.Get("errors") == "true",
+		Limit:  defaultRequestLimit,
+	}
+	var err error
+	if q.From, err = parseRequestTime(params.Get("from"), false); err != nil {
+		http.Error(w, "from must be a YYYY-MM-DD date or an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseRequestTime(params.Get("to"), true); err != nil {
+		http.Error(w, "to must be a YYYY-MM-DD date or an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	if limit := params.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit <= 0 || q.Limit > maxRequestLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	requests, err := ah.requestLog.Search(q)
+	if err != nil {
+		ah.logger.Error("Failed to search request log", "error", err)
+		http.Error(w, "Failed to search request log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(requests); err != nil {
+		ah.logger.Error("Failed to encode requests to JSON", "error", err)
+	}
+}
+
+// parseRequestTime parses a search bound. A date as the upper bound includes the whole day.
+func parseRequestTime(value string, upper bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if upper {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// GetRequest handles GET /admin/api/requests/{id} requests and returns a logged
+// request including its bodies
+func (ah *AdminHandler) GetRequest(w http.ResponseWriter, r *http.Request) {
+	entry, ok := ah.requestFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(entry); err != nil {
+		ah.logger.Error("Failed to encode request to JSON", "error", err)
+	}
+}
+
+// ReplayRequest handles POST /admin/api/requests/{id}/replay requests. It sends
+// the logged request through the balancer again and returns the new answer,
+// which is logged as a replay of the original request. Only requests logged
+// with their complete body, and without credentials removed from it, can be
+// replayed.
+func (ah *AdminHandler) ReplayRequest(w http.ResponseWriter, r *http.Request) {
+	entry, ok := ah.requestFromURL(w, r)
+	if !ok {
+		return
+	}
+	if entry.Method != http.MethodGet && entry.RequestBody == "" {
+		http.Error(w, "The request body was not logged, enable request_log.bodies to replay requests", http.StatusConflict)
+		return
+	}
+	if entry.RequestTruncated {
+		http.Error(w, "The request body was truncated in the log and cannot be replayed", http.StatusConflict)
+		return
+	}
+	if entry.RequestRedacted {
+		http.Error(w, "Credentials were redacted from the logged request body, so it cannot be replayed", http.StatusConflict)
+		return
+	}
+
+	// Entries logged before paths were recorded only have their route
+	target := entry.Path
+	if target == "" {
+		target = entry.Route
+	}
+	if entry.Query != "" {
+		target += "?" + entry.Query
+	}
+
+	// Drop the routing state of the admin request so the replay is routed from the start
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, nil)
+	req, err := http.NewRequestWithContext(proxy.WithReplay(ctx, entry.ID), entry.Method, target, strings.NewReader(entry.RequestBody))
+	if err != nil {
+		http.Error(w, "The logged request cannot be replayed", http.StatusConflict)
+		return
+	}
+	req.RemoteAddr = r.RemoteAddr
+	if entry.RequestBody != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	ah.logger.Info("Replaying logged request", "id", entry.ID, "path", target, "model", entry.Model)
+	w.Header().Set("X-Replay-Of", entry.ID)
+	ah.replay.ServeHTTP(w, req)
+}
+
+// requestFromURL looks up the logged request named by the id URL parameter,
+// answering the request itself when it cannot be found
+func (ah *AdminHandler) requestFromURL(w http.ResponseWriter, r *http.Request) (*proxy.Summary, bool) {
+	if !ah.requestLogEnabled(w) {
+		return nil, false
+	}
+
+	id := chi.URLParam(r, "id")
+	entry, err := ah.requestLog.Get(id)
+	if errors.Is(err, requestlog.ErrNotFound) {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		ah.logger.Error("Failed to read request log", "id", id, "error", err)
+		http.Error(w, "Failed to read request log", http.StatusInternalServerError)
+		return nil, false
+	}
+	return entry, true
+}
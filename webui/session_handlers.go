@@ -0,0 +1,27 @@
+package webui
+
+import (
+	"net/http"
+)
+
+// CreateSession handles POST /admin/api/session requests. It sets the admin
+// session cookie, which authenticates browser requests that cannot carry an
+// Authorization header, such as EventSource streams.
+func (ah *AdminHandler) CreateSession(w http.ResponseWriter, r *http.Request) {
+	secure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	cookie, err := ah.adminAuth.NewSessionCookie(secure)
+	if err != nil {
+		ah.logger.Error("Failed to create admin session", "error", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, cookie)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteSession handles DELETE /admin/api/session requests. It ends the admin
+// session and removes its cookie.
+func (ah *AdminHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, ah.adminAuth.RevokeSession(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,93 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/loseleaf/modelscope-balancer/accounting"
+)
+
+// UsageRow is the admin API representation of an aggregated usage record
+type UsageRow struct {
+	*accounting.Record
+	KeyID      string `json:"key_id,omitempty"`      // ID of the key with the record's fingerprint, when grouped by key and the key still exists
+	ClientName string `json:"client_name,omitempty"` // Name of the virtual client, when grouped by client
+}
+
+// UsageResponse is the response of GET /admin/api/usage
+type UsageResponse struct {
+	GroupBy []string          `json:"group_by"`
+	Records []UsageRow        `json:"records"`
+	Total   accounting.Record `json:"total"` // Sum over all returned records
+}
+
+// GetUsage handles GET /admin/api/usage requests. Query parameters:
+// from and to (inclusive days, YYYY-MM-DD), key (ID or fingerprint), model and
+// client filters, and group_by, a comma-separated list of day, key, model and
+// client (default: day).
+func (ah *AdminHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	q := accounting.Query{
+		From:    params.Get("from"),
+		To:      params.Get("to"),
+		Key:     params.Get("key"),
+		Model:   params.Get("model"),
+		Client:  params.Get("client"),
+		GroupBy: []string{"day"},
+	}
+	if key, ok := ah.km.FindKeyByID(q.Key); ok {
+		q.Key = key.Fingerprint
+	}
+	for _, day := range []string{q.From, q.To} {
+		if day == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			http.Error(w, "Dates must use the YYYY-MM-DD format", http.StatusBadRequest)
+			return
+		}
+	}
+	if groupBy, ok := params["group_by"]; ok {
+		q.GroupBy = nil
+		for _, dim := range strings.Split(strings.Join(groupBy, ","), ",") {
+			if dim = strings.TrimSpace(dim); dim != "" {
+				q.GroupBy = append(q.GroupBy, dim)
+			}
+		}
+	}
+
+	records, err := ah.usage.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := UsageResponse{GroupBy: q.GroupBy, Records: make([]UsageRow, 0, len(records))}
+	if response.GroupBy == nil {
+		response.GroupBy = []string{}
+	}
+	names := make(map[string]string)
+	for _, c := range ah.clients.List() {
+		names[c.ID] = c.Name
+	}
+	keyIDs := make(map[string]string)
+	for _, key := range ah.km.ListKeys() {
+		keyIDs[key.Fingerprint] = key.ID
+	}
+	for _, rec := range records {
+		response.Records = append(response.Records, UsageRow{Record: rec, KeyID: keyIDs[rec.Key], ClientName: names[rec.Client]})
+		response.Total.Requests += rec.Requests
+		response.Total.PromptTokens += rec.PromptTokens
+		response.Total.CompletionTokens += rec.CompletionTokens
+		response.Total.TotalTokens += rec.TotalTokens
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		ah.logger.Error("Failed to encode usage to JSON", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,59 @@
+package webui
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/loseleaf/modelscope-balancer/events"
+)
+
+// webhookTestTimeout bounds a webhook test including its retries
+const webhookTestTimeout = 30 * time.Second
+
+// WebhookTestResponse is the response of POST /admin/api/webhooks/{name}/test
+type WebhookTestResponse struct {
+	Webhook   string `json:"webhook"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ListWebhooks handles GET /admin/api/webhooks requests and returns the names of the configured webhooks
+func (ah *AdminHandler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(ah.webhooks.Names()); err != nil {
+		ah.logger.Error("Failed to encode webhooks to JSON", "error", err)
+	}
+}
+
+// TestWebhook handles POST /admin/api/webhooks/{name}/test requests. It sends a
+// webhook_test event to the webhook and waits for the delivery, retries included.
+func (ah *AdminHandler) TestWebhook(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	ctx, cancel := context.WithTimeout(r.Context(), webhookTestTimeout)
+	defer cancel()
+
+	err := ah.webhooks.Test(ctx, name)
+	if errors.Is(err, events.ErrUnknownWebhook) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	response := WebhookTestResponse{Webhook: name, Delivered: err == nil}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		ah.logger.Error("Failed to encode webhook test result to JSON", "error", err)
+	}
+}